@@ -0,0 +1,113 @@
+{{define "JS" -}}
+	function BracketDisplay(root) {
+		this.root = root;
+
+		var self = this;
+		this.conn = new Connection('bracket', {
+			bracket: function(data) {
+				self.render(data);
+			}
+		});
+	}
+	BracketDisplay.sectionNames = {
+		winners: 'Winners',
+		losers: 'Losers',
+		grandFinals: 'Grand Finals'
+	};
+	BracketDisplay.prototype.render = function(bracket) {
+		while (this.root.firstChild) this.root.removeChild(this.root.firstChild);
+		if (bracket == null) return;
+
+		// Group matches into columns by section and round.
+		var sections = {};
+		var order = [];
+		for (var m of bracket.matches) {
+			if (!(m.section in sections)) {
+				sections[m.section] = [];
+				order.push(m.section);
+			}
+			var rounds = sections[m.section];
+			while (rounds.length < m.round) rounds.push([]);
+			rounds[m.round - 1].push(m);
+		}
+		for (var name of order) {
+			var section = document.createElement('div');
+			section.className = 'section ' + name;
+			var title = document.createElement('h2');
+			title.innerText = BracketDisplay.sectionNames[name] || name;
+			section.appendChild(title);
+			for (var round of sections[name]) {
+				var column = document.createElement('div');
+				column.className = 'round';
+				for (var m of round) column.appendChild(this.renderMatch_(m));
+				section.appendChild(column);
+			}
+			this.root.appendChild(section);
+		}
+	};
+	BracketDisplay.prototype.renderMatch_ = function(m) {
+		var elem = document.createElement('div');
+		elem.className = 'match';
+		if (m.current) elem.className += ' current';
+		if (m.bye) elem.className += ' bye';
+		var id = document.createElement('span');
+		id.className = 'id';
+		id.innerText = m.id;
+		elem.appendChild(id);
+		var teams = [
+			{name: m.teamA, source: m.sourceA, score: m.scoreA, slot: 'A'},
+			{name: m.teamB, source: m.sourceB, score: m.scoreB, slot: 'B'}
+		];
+		for (var t of teams) {
+			var row = document.createElement('div');
+			row.className = 'team';
+			if (m.winner === t.slot) row.className += ' winner';
+			else if (m.winner) row.className += ' loser';
+			var name = document.createElement('span');
+			name.className = 'name';
+			name.innerText = t.source || t.name;
+			if (t.source) name.className += ' placeholder';
+			row.appendChild(name);
+			if (!m.bye) {
+				var score = document.createElement('span');
+				score.className = 'score';
+				score.innerText = t.score;
+				row.appendChild(score);
+			}
+			elem.appendChild(row);
+		}
+		return elem;
+	};
+{{- end}}
+{{define "JS_init" -}}
+new BracketDisplay(document.getElementById('bracket'));
+{{- end}}
+
+{{define "CSS" -}}
+#bracket { font-family: sans-serif; }
+#bracket .section { display: flex; align-items: center; margin-bottom: 1em; }
+#bracket h2 { writing-mode: vertical-lr; transform: rotate(180deg); margin: 0 0.5em; }
+#bracket .round { display: flex; flex-direction: column; justify-content: space-around; margin-right: 1em; }
+#bracket .match { position: relative; border: 1px solid #888; margin: 0.3em 0; min-width: 10em; padding-left: 1.5em; }
+#bracket .match.current { border-color: #f80; border-width: 3px; }
+#bracket .match.bye { opacity: 0.4; }
+#bracket .id { position: absolute; left: 0.2em; top: 0.5em; font-size: 70%; color: #888; }
+#bracket .team { display: flex; justify-content: space-between; padding: 0 0.3em; }
+#bracket .team.winner { font-weight: bold; }
+#bracket .team.loser { color: #888; }
+#bracket .placeholder { font-style: italic; color: #888; }
+#bracket .score { margin-left: 1em; }
+{{- end}}
+
+{{define "Head" -}}
+	<title>kq-live bracket</title>
+	<script async>{{template "JS"}}
+	window.addEventListener("load", function() {
+		{{- template "JS_init" . -}}
+	});</script>
+	<style>{{template "CSS"}}</style>
+{{- end}}
+
+{{define "Body" -}}
+<div id="bracket"></div>
+{{- end}}
@@ -0,0 +1,94 @@
+{{define "JS" -}}
+	// Shows player stats from /api/stats/players. The page's query parameters
+	// are passed along, so `scope`, `sort`, `perGame` and `limit` choose what
+	// is shown. It refreshes whenever a game is recorded.
+	function Leaderboard(root) {
+		this.root = root;
+		this.params = new URLSearchParams(location.search);
+		this.perGame = ['1', 'true'].indexOf(this.params.get('perGame')) >= 0;
+
+		var self = this;
+		this.conn = new Connection('currentMatch', {
+			games: function() {
+				self.refresh();
+			}
+		});
+		this.refresh();
+	}
+	Leaderboard.columns = [
+		['rank', ''],
+		['name', 'Player'],
+		['team', 'Team'],
+		['games', 'GP'],
+		['kills', 'K'],
+		['deaths', 'D'],
+		['queenKills', 'QK'],
+		['berries', 'Berries'],
+		['snailDistance', 'Snail'],
+		['warriorSeconds', 'Warrior'],
+		['assists', 'Ast'],
+		['eatRescues', 'Rescues']
+	];
+	Leaderboard.prototype.refresh = function() {
+		var self = this;
+		fetch('/api/stats/players?' + this.params.toString()).then(function(resp) {
+			if (!resp.ok) throw new Error(resp.status + ' ' + resp.statusText);
+			return resp.json();
+		}).then(function(players) {
+			self.render(players);
+		}).catch(function(err) {
+			console.log('Failed to load player stats:', err);
+		});
+	};
+	Leaderboard.prototype.render = function(players) {
+		while (this.root.firstChild) this.root.removeChild(this.root.firstChild);
+
+		var table = document.createElement('table');
+		var header = table.createTHead().insertRow();
+		for (var c of Leaderboard.columns) {
+			var th = document.createElement('th');
+			th.className = c[0];
+			th.innerText = c[1];
+			header.appendChild(th);
+		}
+		var body = table.createTBody();
+		players.forEach(function(player, i) {
+			var stats = this.perGame ? player.averages : player.totals;
+			var row = body.insertRow();
+			for (var c of Leaderboard.columns) {
+				var cell = row.insertCell();
+				cell.className = c[0];
+				var value;
+				if (c[0] == 'rank') value = i + 1;
+				else if (c[0] in player) value = player[c[0]];
+				else value = this.perGame ? stats[c[0]].toFixed(1) : Math.round(stats[c[0]]);
+				cell.innerText = value;
+			}
+		}, this);
+		this.root.appendChild(table);
+	};
+{{- end}}
+{{define "JS_init" -}}
+new Leaderboard(document.getElementById('leaderboard'));
+{{- end}}
+
+{{define "CSS" -}}
+#leaderboard { font-family: sans-serif; }
+#leaderboard table { border-collapse: collapse; }
+#leaderboard th, #leaderboard td { padding: 0.2em 0.5em; text-align: right; }
+#leaderboard .name, #leaderboard .team { text-align: left; min-width: 8em; }
+#leaderboard tbody tr:nth-child(odd) { background: rgba(128, 128, 128, 0.2); }
+{{- end}}
+
+{{define "Head" -}}
+	<title>kq-live leaderboard</title>
+	<script async>{{template "JS"}}
+	window.addEventListener("load", function() {
+		{{- template "JS_init" . -}}
+	});</script>
+	<style>{{template "CSS"}}</style>
+{{- end}}
+
+{{define "Body" -}}
+<div id="leaderboard"></div>
+{{- end}}
@@ -25,17 +25,18 @@ function PostGameStats(root) {
 	this.gameDurCell = root.getElementsByClassName('gameDur')[0].firstChild;
 
 	var rows = root.getElementsByTagName('tr');
+	this.nameCells = textNodesByPlayerId(rows[2].getElementsByTagName('td'));
 	this.dataCells = {
-		WarriorTime: textNodesByPlayerId(rows[2].getElementsByTagName('td')),
-		SnailTime: textNodesByPlayerId(rows[3].getElementsByTagName('td')),
-		BerriesRun: textNodesByPlayerId(rows[4].getElementsByTagName('td')),
-		QueenKills: textNodesByPlayerId(rows[5].getElementsByTagName('td')),
-		WarriorKills: textNodesByPlayerId(rows[6].getElementsByTagName('td')),
-		DroneKills: textNodesByPlayerId(rows[7].getElementsByTagName('td')),
-		MilitaryDeaths: textNodesByPlayerId(rows[8].getElementsByTagName('td')),
-		DroneDeaths: textNodesByPlayerId(rows[9].getElementsByTagName('td')),
-		MilitaryAssists: textNodesByPlayerId(rows[10].getElementsByTagName('td')),
-		DroneAssists: textNodesByPlayerId(rows[11].getElementsByTagName('td'))
+		WarriorTime: textNodesByPlayerId(rows[3].getElementsByTagName('td')),
+		SnailTime: textNodesByPlayerId(rows[4].getElementsByTagName('td')),
+		BerriesRun: textNodesByPlayerId(rows[5].getElementsByTagName('td')),
+		QueenKills: textNodesByPlayerId(rows[6].getElementsByTagName('td')),
+		WarriorKills: textNodesByPlayerId(rows[7].getElementsByTagName('td')),
+		DroneKills: textNodesByPlayerId(rows[8].getElementsByTagName('td')),
+		MilitaryDeaths: textNodesByPlayerId(rows[9].getElementsByTagName('td')),
+		DroneDeaths: textNodesByPlayerId(rows[10].getElementsByTagName('td')),
+		MilitaryAssists: textNodesByPlayerId(rows[11].getElementsByTagName('td')),
+		DroneAssists: textNodesByPlayerId(rows[12].getElementsByTagName('td'))
 	};
 	this.keys = Object.keys(this.dataCells);
 
@@ -45,6 +46,18 @@ function PostGameStats(root) {
 		reset: function(data) { self.reset(); },
 		stats: function(data) { self.update(data); }
 	});
+	this.matchConn = new Connection('currentMatch', {
+		lineup: function(data) { self.updateNames(data); }
+	});
+}
+
+// The lineup lists each side in position order, which matches the order of
+// player ids with gold first.
+PostGameStats.prototype.updateNames = function(lineup) {
+	for (var i = 0; i < 5; ++i) {
+		this.nameCells[2 * i].textContent = (lineup.gold[i] || {}).name || '';
+		this.nameCells[2 * i + 1].textContent = (lineup.blue[i] || {}).name || '';
+	}
 }
 
 PostGameStats.prototype.reset = function() {
@@ -77,6 +90,7 @@ PostGameStats.prototype.update = function(data) {
 
 {{define "JS_init" -}}
 new PostGameStats(document.getElementById('postGameStats'));
+Connection.reloadOnTeamSides({{.GoldOnLeft}});
 {{- end}}
 
 {{define "CSS" -}}
@@ -155,6 +169,7 @@ new PostGameStats(document.getElementById('postGameStats'));
 		<th class="right abs"></th>
 		<th class="right stripes"></th>
 	</tr>
+	{{template "postgameRow" ""}}
 	{{template "postgameRow" "Time as Warrior"}}
 	{{template "postgameRow" "Time on Snail"}}
 	{{template "postgameRow" "Berries Run"}}
@@ -175,18 +175,38 @@
 	}
 {{- end}}
 
+{{define "GameList" -}}
+	function GameList(root, properties) {
+		this.elem = document.createElement('div');
+		this.elem.id = 'gameList';
+		this.elem.className = 'gameList';
+		root.appendChild(this.elem);
+		this.updateGames(properties.games);
+	}
+	GameList.prototype.updateGames = function(games) {
+		while (this.elem.firstChild) this.elem.removeChild(this.elem.firstChild);
+		for (var i = 0; i < games.length; ++i) {
+			var marker = document.createElement('span');
+			marker.className = ['game', games[i].winner, games[i].winType].join(' ');
+			marker.title = games[i].winner + ' ' + games[i].winType + ' win';
+			this.elem.appendChild(marker);
+		}
+	};
+{{- end}}
+
 {{define "Score"}}{{template "TextScore" .}}{{end}}
 
 {{define "JS" -}}
 	{{template "Score" .}}
 	{{template "TeamName" .}}
+	{{template "GameList" .}}
 	function Scoreboard(root) {
 		this.state = {
 			teams: {
 				blue: {teamName: '', score: 0},
 				gold: {teamName: '', score: 0},
 			},
-			match: { victoryRule: null },
+			match: { victoryRule: null, games: [] },
 		};
 
 		// Initialize layout and draw initial values.
@@ -216,6 +236,7 @@
 				side: "{{if .GoldOnLeft}}left{{else}}right{{end}}"
 			})
 		};
+		this.gameList = new GameList(root, { games: this.state.match.games });
 
 		var self = this;
 		this.conn = new Connection("currentMatch", {
@@ -225,6 +246,15 @@
 				self.scores.blue.updateScore(self.state.teams.blue.score);
 				self.scores.gold.updateScore(self.state.teams.gold.score);
 			},
+			games: function(data) {
+				self.state.match.games = data || [];
+				self.gameList.updateGames(self.state.match.games);
+				root.classList.remove('matchComplete', 'blueWon', 'goldWon');
+			},
+			matchComplete: function(data) {
+				root.classList.add('matchComplete');
+				if (data.winner) root.classList.add(data.winner + 'Won');
+			},
 			settings: function(data) {
 				self.state.match.victoryRule = data.victoryRule;
 				self.scores.blue.updateVictoryRule(data.victoryRule);
@@ -242,6 +272,7 @@
 
 {{define "JS_init" -}}
 	new Scoreboard(document.getElementById("scoreboard"));
+	Connection.reloadOnTeamSides({{.GoldOnLeft}});
 {{- end}}
 
 {{define "Style"}}data:text/css,%23scoreboard{position:absolute;top:0;left:0;bottom:0;right:0;font-size:5vh;text-align:center}
@@ -250,7 +281,11 @@
 .scoreMarkers.right{left:50%}
 .teamName{position:absolute;bottom:0;width:30%}
 .teamName.left{right:55%}
-.teamName.right{left:55%}{{end}}
+.teamName.right{left:55%}
+.gameList{position:absolute;top:0;width:100%}
+.gameList .game{display:inline-block;width:1em;height:0.3em;margin:0 0.1em}
+.gameList .game.blue{background:%2300f}
+.gameList .game.gold{background:%23fc0}{{end}}
 
 {{define "Head" -}}
 	<title>kq-live scoreboard</title>
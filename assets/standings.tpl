@@ -0,0 +1,84 @@
+{{define "JS" -}}
+	function StandingsDisplay(root) {
+		this.root = root;
+
+		var self = this;
+		this.conn = new Connection('standings', {
+			standings: function(data) {
+				self.render(data);
+			}
+		});
+	}
+	StandingsDisplay.columns = [
+		['rank', ''],
+		['team', 'Team'],
+		['played', 'P'],
+		['matchWins', 'W'],
+		['matchLosses', 'L'],
+		['matchDraws', 'D'],
+		['points', 'Pts'],
+		['gameWins', 'GW'],
+		['gameLosses', 'GL'],
+		['berryWins', 'Berry'],
+		['snailWins', 'Snail'],
+		['militaryWins', 'Mil']
+	];
+	StandingsDisplay.prototype.render = function(standings) {
+		while (this.root.firstChild) this.root.removeChild(this.root.firstChild);
+		if (standings == null) return;
+
+		for (var group of standings.groups) {
+			var section = document.createElement('div');
+			section.className = 'group';
+			if (standings.groups.length > 1) {
+				var title = document.createElement('h2');
+				title.innerText = 'Group ' + group.name;
+				section.appendChild(title);
+			}
+			var table = document.createElement('table');
+			var header = table.createTHead().insertRow();
+			for (var c of StandingsDisplay.columns) {
+				var th = document.createElement('th');
+				th.className = c[0];
+				th.innerText = c[1];
+				header.appendChild(th);
+			}
+			var body = table.createTBody();
+			for (var team of group.standings) {
+				var row = body.insertRow();
+				for (var c of StandingsDisplay.columns) {
+					var cell = row.insertCell();
+					cell.className = c[0];
+					cell.innerText = team[c[0]];
+				}
+			}
+			section.appendChild(table);
+			this.root.appendChild(section);
+		}
+	};
+{{- end}}
+{{define "JS_init" -}}
+new StandingsDisplay(document.getElementById('standings'));
+{{- end}}
+
+{{define "CSS" -}}
+#standings { font-family: sans-serif; }
+#standings .group { display: inline-block; vertical-align: top; margin-right: 2em; }
+#standings table { border-collapse: collapse; }
+#standings th, #standings td { padding: 0.2em 0.5em; text-align: right; }
+#standings .team { text-align: left; min-width: 8em; }
+#standings tbody tr:nth-child(odd) { background: rgba(128, 128, 128, 0.2); }
+{{- end}}
+
+{{define "Head" -}}
+	<title>kq-live standings</title>
+	<script async>{{template "JS"}}
+	window.addEventListener("load", function() {
+		{{- template "JS_init" . -}}
+	});</script>
+	<style>{{template "CSS"}}</style>
+{{- end}}
+
+{{define "Body" -}}
+<div id="standings"></div>
+{{- end}}
@@ -18,11 +18,16 @@
 // is called for any data message for the client's section, after all parts are
 // passed to handlers of every client. It does not receive any data.
 //
-// Communication with the server occurs over a websocket, using a JSON-like
-// payload. The payload is a valid JSON object, but it is required to have the
-// first key be "type"; JSON does not specify any key order. This required
-// ordering allows partial parsing, where the payload is only ever parsed for
-// known message types and can be parsed directly into a known data structure.
+// Communication with the server occurs over a websocket. Every message is a
+// JSON object with a "type" and "data", as described by
+// /static/ws_protocol.schema.json. The client names the protocol versions it
+// speaks when starting, and the server reports problems with its messages as
+// error messages.
+//
+// When multiple cabinets are tracked, the page URL selects which one to watch
+// with a `cab` query parameter, e.g. `/scoreboard?cab=left`. Without it, the
+// server picks its default cabinet. Similarly, a `token` query parameter is
+// passed along to identify the user when the server requires credentials.
 function Connection(section, handler_map) {
 	if (Connection.sock === null) {
 		Connection.initSocket();
@@ -37,8 +42,12 @@ Connection.debug = false;
 Connection.sock = null;
 Connection.clients = [];
 Connection.reconnectInfo = { last: null, count: 0 };
+Connection.protocolVersions = [1];
+Connection.cabinet = new URLSearchParams(location.search).get('cab');
+Connection.token = new URLSearchParams(location.search).get('token');
 Connection.initSocket = function() {
 	var server = 'ws://' + location.host + '/ws';
+	if (Connection.token) server += '?token=' + encodeURIComponent(Connection.token);
 	console.log('connecting to ' + server + '...');
 	var conn = new WebSocket(server);
 	conn.onopen = Connection.handleOpen;
@@ -59,9 +68,7 @@ Connection.addClient = function(client) {
 	Connection.clients.push(client);
 	if (Connection.sock !== null &&
 		Connection.sock.readyState == WebSocket.OPEN) {
-		Connection.send('client_start', {
-			sections: [client.section]
-		});
+		Connection.sendClientStart([client.section]);
 	}
 };
 Connection.handleOpen = function(event) {
@@ -71,9 +78,12 @@ Connection.handleOpen = function(event) {
 	for (var i = 0; i < Connection.clients.length; ++i) {
 		sections[Connection.clients[i].section] = null;
 	}
-	Connection.send('client_start', {
-		sections: Object.keys(sections)
-	});
+	Connection.sendClientStart(Object.keys(sections));
+};
+Connection.sendClientStart = function(sections) {
+	var data = { sections: sections, versions: Connection.protocolVersions };
+	if (Connection.cabinet) data.cabinet = Connection.cabinet;
+	Connection.send('client_start', data);
 };
 Connection.waitAndReconnect = function() {
 	if (Connection.reconnectInfo.last != null &&
@@ -103,6 +113,12 @@ Connection.handleMessage = function(event) {
 	}
 	if (msg.type === 'data' && msg.data != null) {
 		Connection.handleDataMessage(event, msg.data);
+	} else if (msg.type === 'client_start') {
+		if (msg.data.resync) {
+			console.log('websocket fell behind; resyncing', msg.data);
+		} else if (Connection.debug) {
+			console.log('websocket started', msg.data);
+		}
 	} else if (msg.type === 'error') {
 		console.log("websocket received error", msg.data);
 	} else if ('string' !== typeof msg.type) {
@@ -134,6 +150,16 @@ Connection.handleDataMessage = function(event, data) {
 	}
 };
 
+// Reloads the page when the cabinet's team sides no longer match the ones it
+// was laid out for by the server.
+Connection.reloadOnTeamSides = function(goldOnLeft) {
+	new Connection('currentMatch', {
+		teamSides: function(data) {
+			if ((data.leftTeam === 'gold') !== goldOnLeft) location.reload();
+		}
+	});
+};
+
 Connection.prototype.send = function(tag, data) {
 	if (this.pendingParts === null) {
 		this.pendingParts = [];
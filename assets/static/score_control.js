@@ -7,6 +7,8 @@ function ScoreController(form, conn) {
 	this.goldTeamOther = inputs.goldTeamOther;
 	this.blueScore = inputs.blueScore;
 	this.goldScore = inputs.goldScore;
+	this.gameList = form.getElementsByClassName('gameList')[0];
+	this.matchStatus = form.getElementsByClassName('matchStatus')[0];
 	var selects = form.getElementsByTagName('select');
 	this.goldTeamSelect = selects.goldTeam;
 	this.blueTeamSelect = selects.blueTeam;
@@ -52,6 +54,13 @@ function ScoreController(form, conn) {
 		});
 	}
 
+	buttons = form.getElementsByClassName('undoLastGameButton');
+	for (var b of buttons) {
+		b.addEventListener('click', function() {
+			self.conn.send('undoLastGame', null);
+		});
+	}
+
 	this.updateTeamList(null);
 
 	this.hasMatchSettings = form.getAttribute('matchsettings') || false;
@@ -81,6 +90,34 @@ function ScoreController(form, conn) {
 			self.blueScore.value = data.blue;
 			self.goldScore.value = data.gold;
 		});
+		conn.setHandler(this.matchScores + 'Games', function(data) {
+			self.updateGameList_(data || []);
+			self.matchStatus.innerText = '';
+		});
+		conn.setHandler('matchComplete', function(data) {
+			var status = 'Match complete';
+			if (data.winner) {
+				status += '; ' + (data.teams[data.winner] || data.winner) +
+					' wins ' + data.scores[data.winner] + '-' +
+					data.scores[data.winner === 'blue' ? 'gold' : 'blue'];
+			}
+			if (data.advanceDelaySeconds) {
+				status += '. Advancing in ' + data.advanceDelaySeconds +
+					' seconds.';
+			}
+			self.matchStatus.innerText = status;
+		});
+	}
+}
+
+ScoreController.prototype.updateGameList_ = function(games) {
+	while (this.gameList.firstChild) {
+		this.gameList.removeChild(this.gameList.firstChild);
+	}
+	for (var g of games) {
+		var item = document.createElement('li');
+		item.innerText = g.winner + ' (' + g.winType + ')';
+		this.gameList.appendChild(item);
 	}
 }
 
@@ -191,8 +228,168 @@ ScoreController.prototype.updateTeamSelect_ = function(teams, select,
 	select.style.display = teams.length > 0 ? 'initial' : 'none';
 }
 
+function TournamentController(form, conn) {
+	this.form = form;
+	this.conn = conn;
+	this.format = form.getElementsByTagName('select').format;
+	this.seeds = form.getElementsByTagName('textarea').seeds;
+	var inputs = form.getElementsByTagName('input');
+	this.groups = inputs.groups;
+	this.tiebreakers = inputs.tiebreakers;
+	this.teamList = [];
+
+	var self = this;
+	form.addEventListener('submit', function(e) {
+		e.preventDefault();
+		self.sendStart();
+	});
+	var buttons = form.getElementsByClassName('useTeamListButton');
+	for (var b of buttons) {
+		b.addEventListener('click', function() {
+			self.seeds.value = self.teamList.join('\n');
+		});
+	}
+}
+
+TournamentController.prototype.updateTeamList = function(teams) {
+	this.teamList = teams || [];
+}
+TournamentController.prototype.sendStart = function() {
+	var teams = [];
+	for (var line of this.seeds.value.split('\n')) {
+		line = line.trim();
+		if (line !== '') teams.push(line);
+	}
+	if (!confirm('Discard the current matches and start a new tournament?')) {
+		return;
+	}
+	var data = {format: this.format.value, teams: teams};
+	if (data.format === 'roundRobin') {
+		data.groups = parseInt(this.groups.value, 10) || 1;
+		data.tiebreakers = [];
+		for (var name of this.tiebreakers.value.split(',')) {
+			name = name.trim();
+			if (name !== '') data.tiebreakers.push(name);
+		}
+	}
+	this.conn.send('tournament', data);
+}
+
+// Assigns roster players to cabinet positions for the current match. Each
+// side's selects are in position order: queen, stripes, abs, skulls, checks.
+function LineupController(form, conn) {
+	this.form = form;
+	this.conn = conn;
+	this.teams = {blue: '', gold: ''};
+	this.roster = {};
+	this.assigned = {blue: [], gold: []};
+	this.teamNames = {};
+	for (var th of form.getElementsByClassName('teamName')) {
+		this.teamNames[th.getAttribute('side')] = th;
+	}
+	this.selects = {blue: [], gold: []};
+	for (var select of form.getElementsByTagName('select')) {
+		this.selects[select.getAttribute('side')].push(select);
+	}
+
+	var self = this;
+	form.addEventListener('submit', function(e) {
+		e.preventDefault();
+		self.sendLineup();
+	});
+	conn.setHandler('currentLineup', function(data) {
+		self.assigned = {blue: data.blue || [], gold: data.gold || []};
+		self.render_();
+	});
+	this.matchConn = new Connection('currentMatch', {
+		teams: function(data) {
+			self.teams = {blue: data.blue || '', gold: data.gold || ''};
+			self.render_();
+		}
+	});
+	this.rosterConn = new Connection('tournamentData', {
+		teams: function(data) {
+			self.roster = data || {};
+			self.render_();
+		}
+	});
+	this.render_();
+}
+
+LineupController.prototype.render_ = function() {
+	for (var side of ['blue', 'gold']) {
+		var team = this.teams[side];
+		this.teamNames[side].innerText = team || side;
+		var players = (this.roster[team] || []).map(function(p) {
+			return p.name;
+		});
+		for (var i = 0; i < this.selects[side].length; ++i) {
+			var select = this.selects[side][i];
+			var curr = this.assigned[side][i] || '';
+			var names = [''].concat(players);
+			if (names.indexOf(curr) < 0) names.push(curr);
+			while (select.firstChild) select.removeChild(select.firstChild);
+			for (var name of names) {
+				var opt = document.createElement('option');
+				opt.value = name;
+				opt.innerText = name || 'Roster';
+				select.appendChild(opt);
+			}
+			select.value = curr;
+		}
+	}
+}
+LineupController.prototype.sendLineup = function() {
+	var data = {blue: [], gold: []};
+	for (var side of ['blue', 'gold']) {
+		for (var select of this.selects[side]) data[side].push(select.value);
+	}
+	this.conn.send('lineup', data);
+}
+
+// Lists the problems found in the roster file, so they can be fixed before
+// they show up on stream.
+function RosterStatus(root) {
+	this.status = root.getElementsByClassName('rosterStatus')[0];
+	this.errors = root.getElementsByClassName('rosterErrors')[0];
+}
+
+RosterStatus.prototype.update = function(errors) {
+	while (this.errors.firstChild) this.errors.removeChild(this.errors.firstChild);
+	errors = errors || [];
+	this.status.innerText = errors.length === 0 ? 'No problems found.' :
+		errors.length + ' problem' + (errors.length === 1 ? '' : 's') +
+		' found. The rest of the roster is still used.';
+	for (var e of errors) {
+		var item = document.createElement('li');
+		item.innerText = e;
+		this.errors.appendChild(item);
+	}
+}
+
+// Chooses which team is on the left side of the cabinet, or has it detected
+// from games.
+function TeamSidesController(root, conn) {
+	this.select = root.elements['leftTeam'];
+	this.status = root.getElementsByClassName('teamSidesStatus')[0];
+	var self = this;
+	this.select.addEventListener('change', function() {
+		conn.send('teamSides', {leftTeam: self.select.value});
+	});
+}
+
+TeamSidesController.prototype.update = function(data) {
+	this.select.value = data.detect ? 'auto' : data.leftTeam;
+	var team = data.leftTeam === 'gold' ? 'Gold' : 'Blue';
+	this.status.innerText = team + ' is on the left' +
+		(data.detect ? ', checked against berry deposits each game.' : '.');
+}
+
 window.addEventListener("load", function() {
 	var currentMatchController;
+	var tournamentController;
+	var rosterStatus;
+	var teamSidesController;
 	// This is capturing the controller variable before it is filled, which in
 	// theory could allow the callback to run before it is filled. However, we
 	// know the callback will only be run from network events, and since JS is
@@ -201,8 +398,21 @@ window.addEventListener("load", function() {
 	var conn = new Connection("control", {
 		teamList: function(data) {
 			currentMatchController.updateTeamList(data);
+			tournamentController.updateTeamList(data);
+		},
+		rosterErrors: function(data) {
+			rosterStatus.update(data);
+		},
+		teamSides: function(data) {
+			teamSidesController.update(data);
 		}
 	});
 	currentMatchController =
 		new ScoreController(document.getElementById('currentMatchForm'), conn);
+	tournamentController =
+		new TournamentController(document.getElementById('tournamentForm'), conn);
+	rosterStatus = new RosterStatus(document.getElementById('roster'));
+	teamSidesController =
+		new TeamSidesController(document.getElementById('teamSidesForm'), conn);
+	new LineupController(document.getElementById('lineupForm'), conn);
 });
@@ -29,6 +29,11 @@
     }
   }
   function Stats(root) {
+    var names = document.getElementById('statsNames').getElementsByTagName('td');
+    this.nameCells = {
+      blue: [names[0], names[1], names[2], names[3], names[4]],
+      gold: [names[6], names[7], names[8], names[9], names[10]]
+    };
     var row = root.firstElementChild;
 	this.mapCell = row.firstElementChild.nextElementSibling;
 	row = row.nextElementSibling;
@@ -67,6 +72,9 @@
       reset: function(data) { self.reset(); },
       stats: function(data) { self.update(data); }
     });
+    this.matchConn = new Connection("currentMatch", {
+      lineup: function(data) { self.updateNames(data); }
+    });
 
     this.reset();
   }
@@ -80,6 +88,14 @@
       }
     }
   };
+  Stats.prototype.updateNames = function(lineup) {
+    // The lineup is in position order: queen, stripes, abs, skulls, checks.
+    var positions = [4, 3, 0, 2, 1];
+    for (var i = 0; i < 5; ++i) {
+      this.nameCells.blue[i].innerText = (lineup.blue[positions[i]] || {}).name || '';
+      this.nameCells.gold[i].innerText = (lineup.gold[positions[i]] || {}).name || '';
+    }
+  };
   Stats.prototype.update = function(data) {
     this.mapCell.innerText = data.map || '';
     this.timeCell.innerText = formatTime(data.duration || 0);
@@ -136,6 +152,7 @@
 <table>
   <thead>
     <tr><th colspan="2"></th><th>Blue Checks</th><th>Blue Skulls</th><th>Blue Queen</th><th>Blue Abs</th><th>Blue Stripes</th><td><div style="width:20pt"></div></td><th>Gold Checks</th><th>Gold Skulls</th><th>Gold Queen</th><th>Gold Abs</th><th>Gold Stripes</th></tr>
+    <tr id="statsNames"><th colspan="2"></th><td></td><td></td><td></td><td></td><td></td><td></td><td></td><td></td><td></td><td></td><td></td></tr>
   </thead>
   <tbody id="stats">
     <tr><th>Map</th><td colspan="6"></td><td rowspan="26"></td><td colspan="5"></td></tr>
@@ -1,6 +1,6 @@
 {{define "JS" -}}
 	function StatsboardCell(root) {
-		this.splitWarrior = window.location.search == '?kills=split';
+		this.splitWarrior = new URLSearchParams(window.location.search).get('kills') == 'split';
 
 		this.root = root;
 		if (this.splitWarrior) {
@@ -20,6 +20,9 @@
 		this.status = document.createElement('div');
 		this.status.className = 'statusIcon';
 		root.appendChild(this.status);
+		this.name = document.createElement('div');
+		this.name.className = 'playerName';
+		root.appendChild(this.name);
 	}
 	StatsboardCell.prototype.update = function(stats) {
 		if (this.splitWarrior) {
@@ -56,9 +59,19 @@
 			reset: function(data) { self.reset(); },
 			stats: function(data) { self.update(data); }
 		});
+		this.matchConn = new Connection("currentMatch", {
+			lineup: function(data) { self.updateNames(data[self.side] || []); }
+		});
 
 		this.reset();
 	}
+	Statsboard.prototype.updateNames = function(players) {
+		// The lineup is in position order: queen, stripes, abs, skulls, checks.
+		var positions = [4, 3, 0, 2, 1];
+		for (var i = 0; i < 5; ++i) {
+			this.cells[i].name.innerText = (players[positions[i]] || {}).name || '';
+		}
+	};
 	Statsboard.prototype.reset = function() {
 		var stats = {Kills: 0, DroneKills: 0, Assists: 0, Deaths: 0, QueenKills: 0};
 		for (var i = 0; i < 5; ++i) {
@@ -115,6 +128,16 @@ new Statsboard(document.getElementById('statsboard{{.Side}}'), {{.Side}});
 	.statsboardCell .kills { left: -1ch; }
 	.statsboardCell .military.kills { top: 0; }
 	.statsboardCell .deaths { right: -1ch; }
+	.statsboardCell .playerName {
+		position: absolute;
+		top: 64px;
+		left: -40px;
+		right: -40px;
+		font-size: 18px;
+		text-align: center;
+		white-space: nowrap;
+		overflow: hidden;
+	}
 	.statsboardCell .killLabel, .statsboardCell .statusIcon {
 		position: absolute;
 		display: inline-block;
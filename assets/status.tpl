@@ -25,39 +25,27 @@ function TeamPictures(root, color) {
 	var self = this;
 	this.conn = new Connection('currentMatch', {
 		teams: function(data) {
-			self.selectTeam(data[color] || '');
+			self.teamName.innerText = data[color] || '';
+		},
+		lineup: function(data) {
+			self.setPlayers(data[color] || []);
 		}
 	});
 
-	this.selectTeam('');
+	this.setPlayers([]);
 }
-TeamPictures.teamPlayerData = {};
-TeamPictures.prototype.getPlayerData = function(teamName) {
-	// TODO: Sort the players based on which cab they are on if they have such settings.
-	return TeamPictures.teamPlayerData[teamName] || [];
-}
-TeamPictures.prototype.selectTeam = function(teamName) {
-	this.teamName.innerText = teamName;
-	var playerData = this.getPlayerData(teamName);
+// Shows the players in position order: queen, stripes, abs, skulls, checks.
+TeamPictures.prototype.setPlayers = function(players) {
 	for (var i = 0; i < 5; ++i) {
-		this.photos[i].update(playerData[i] || {});
+		this.photos[i].update(players[i] || {});
 	}
 }
-TeamPictures.prototype.update = function() {
-	this.selectTeam(this.teamName.innerText);
-}
 {{- end}}
 {{define "JS_init" -}}
 TeamPicsPlayerPhoto.defaultUri = "{{with .DefaultPlayerPhoto}}{{.}}{{else}}data:image/svg+xml,%3csvg xmlns='http://www.w3.org/2000/svg'/%3e{{end}}";
-var blue = new TeamPictures(document.getElementById('teamPics_blue'), 'blue');
-var gold = new TeamPictures(document.getElementById('teamPics_gold'), 'gold');
-new Connection('tournamentData', {
-	teams: function(data) {
-		TeamPictures.teamPlayerData = data || {};
-		blue.update();
-		gold.update();
-	}
-});
+new TeamPictures(document.getElementById('teamPics_blue'), 'blue');
+new TeamPictures(document.getElementById('teamPics_gold'), 'gold');
+Connection.reloadOnTeamSides({{.GoldOnLeft}});
 {{- end}}
 
 {{define "CSS" -}}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a client is allowed to do. Each role can do everything the roles
+// before it can.
+type Role int
+
+const (
+	// No access at all.
+	NoRole Role = iota
+	// May watch the overlays and read match state, but not change anything.
+	OverlayRole
+	// May also change the match state.
+	OperatorRole
+)
+
+func (r Role) String() string {
+	switch r {
+	case OverlayRole:
+		return "overlay"
+	case OperatorRole:
+		return "operator"
+	}
+	return "none"
+}
+
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "none":
+		return NoRole, nil
+	case "overlay":
+		return OverlayRole, nil
+	case "operator":
+		return OperatorRole, nil
+	}
+	return NoRole, fmt.Errorf("unknown role %q", s)
+}
+
+// A user allowed to access the server. Clients identify themselves with the
+// token, either as a bearer token, as the password for HTTP basic auth with
+// the user's name, or in a `token` query parameter.
+type UserConfig struct {
+	Name  string
+	Token string
+	Role  string
+}
+
+// Decides the role of each request. With no users configured, authentication
+// is disabled and every request gets the operator role.
+type authenticator struct {
+	users     []UserConfig
+	roles     []Role
+	anonymous Role
+}
+
+func newAuthenticator(users []UserConfig, anonymousRole string) (*authenticator, error) {
+	a := &authenticator{users: users, anonymous: OperatorRole}
+	if len(users) == 0 {
+		return a, nil
+	}
+	a.anonymous = OverlayRole
+	if anonymousRole != "" {
+		r, err := ParseRole(anonymousRole)
+		if err != nil {
+			return nil, fmt.Errorf("AnonymousRole: %v", err)
+		}
+		a.anonymous = r
+	}
+	seen := make(map[string]bool)
+	for _, u := range users {
+		if u.Name == "" || u.Token == "" {
+			return nil, fmt.Errorf("every user needs a Name and Token")
+		}
+		if seen[u.Name] {
+			return nil, fmt.Errorf("duplicate user %q", u.Name)
+		}
+		seen[u.Name] = true
+		r, err := ParseRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %v", u.Name, err)
+		}
+		a.roles = append(a.roles, r)
+	}
+	return a, nil
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.users) > 0
+}
+
+// Returns the user making the request and their role. Anonymous requests have
+// an empty user name. Requests with invalid credentials get no role.
+func (a *authenticator) identify(req *http.Request) (user string, role Role) {
+	if !a.enabled() {
+		return "", a.anonymous
+	}
+	name, token, hasBasic := req.BasicAuth()
+	if !hasBasic {
+		name = ""
+		if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		} else {
+			token = req.URL.Query().Get("token")
+		}
+	}
+	if token == "" {
+		return "", a.anonymous
+	}
+	for i, u := range a.users {
+		if name != "" && name != u.Name {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(u.Token)) == 1 {
+			return u.Name, a.roles[i]
+		}
+	}
+	return "", NoRole
+}
+
+// Checks that the request has at least the given role, replying with an error
+// if it does not. Browsers are asked to prompt for credentials when they are
+// missing or wrong.
+func (a *authenticator) authorize(w http.ResponseWriter, req *http.Request, required Role) (user string, role Role, ok bool) {
+	user, role = a.identify(req)
+	if role >= required {
+		return user, role, true
+	}
+	if user != "" {
+		http.Error(w, fmt.Sprintf("%s is not allowed to do that", user), http.StatusForbidden)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kq-live"`)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+	}
+	return user, role, false
+}
+
+// Wraps a handler to require at least the given role.
+func (a *authenticator) require(required Role, f http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := a.authorize(w, req, required); ok {
+			f(w, req)
+		}
+	})
+}
+
+// Records every change made through the control interfaces, one JSON object
+// per line.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	f   *os.File
+}
+
+type auditEntry struct {
+	Time     time.Time
+	User     string
+	Role     string
+	Remote   string
+	Via      string
+	Cabinet  string
+	Commands []auditCommand
+}
+
+type auditCommand struct {
+	Type string
+	Data interface{} `json:",omitempty"`
+}
+
+// Opens the audit log at path, appending to it. An empty path disables
+// auditing.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return &auditLog{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{enc: json.NewEncoder(f), f: f}, nil
+}
+
+// Records commands sent by a client. via names the interface they came
+// through, such as "ws" or "http".
+func (l *auditLog) Record(user string, role Role, remote, via, cabinet string, commands []ControlCommand) {
+	if l.enc == nil {
+		return
+	}
+	if user == "" {
+		user = "anonymous"
+	}
+	entry := auditEntry{time.Now(), user, role.String(), remote, via, cabinet, nil}
+	for _, c := range commands {
+		ac := auditCommand{Type: c.Type.String(), Data: c.Data}
+		if vr, ok := c.Data.(MatchVictoryRule); ok {
+			ac.Data = victoryRuleToJSON(vr)
+		}
+		entry.Commands = append(entry.Commands, ac)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(&entry); err != nil {
+		fmt.Println("Failed to write audit log:", err)
+	}
+}
+
+func (l *auditLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
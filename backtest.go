@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	kq "github.com/ughoavgfhw/libkq"
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/parser"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// Callbacks for walking through the games in a recorded log. Any may be nil.
+type gameVisitor struct {
+	// Called when a game starts.
+	Start func(state *kq.GameState)
+	// Called at most once per sample interval of game time while a game is
+	// in progress.
+	Sample func(cab *tracking.GameTracker, when time.Time)
+	// Called when a game ends with a victory. Games which never end, such as
+	// one cut off at the end of a log, get a Start but no End.
+	End func(state *kq.GameState, result parser.GameResultMessage, when time.Time)
+}
+
+// Replays a recorded log as fast as possible, reporting each game to v.
+func visitRecordedGames(path string, interval time.Duration, v gameVisitor) error {
+	replay, err := openReplay(path, 0)
+	if err != nil {
+		return err
+	}
+	defer replay.Close()
+	// Only the last message is needed, to parse bonus maps.
+	recorder := &messageRecorder{MessageStringReader: replay}
+	reader := kq.NewCabinet(recorder)
+	cab := tracking.NewGameTracker()
+	cab.Log = io.Discard
+	ticker := &messageTimeTicker{interval: interval}
+	var msg kqio.Message
+	for {
+		if err := readMessage(reader, recorder, &msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			continue
+		}
+		cab.Apply(msg)
+		state := cab.State()
+		switch {
+		case msg.Type == "gamestart":
+			if v.Start != nil {
+				v.Start(&state)
+			}
+		case msg.Type == "victory" && !state.Start.IsZero():
+			if v.End != nil {
+				v.End(&state, msg.Val.(parser.GameResultMessage), msg.Time)
+			}
+		case state.InGame() && ticker.Tick(msg.Time):
+			if v.Sample != nil {
+				v.Sample(cab, msg.Time)
+			}
+		}
+	}
+}
+
+// The side whose win probability the models report, which is the team on
+// the right side of the cabinet.
+func predictedSide(cab *tracking.GameTracker) Side {
+	if cab.GoldOnLeft() {
+		return BlueSide
+	}
+	return GoldSide
+}
+
+// Games are split into thirds by duration, so that phases line up across
+// games of different lengths.
+var backtestPhases = []string{"early", "mid", "late"}
+
+func backtestPhase(elapsed, duration time.Duration) string {
+	i := int(3 * elapsed / duration)
+	if i >= len(backtestPhases) {
+		i = len(backtestPhases) - 1
+	}
+	return backtestPhases[i]
+}
+
+// The key used to group samples. Map and Phase are "all" for the groups that
+// combine every map or phase.
+type backtestGroup struct {
+	Model, Map, Phase string
+}
+
+type calibrationBin struct {
+	samples                   int
+	predictionSum, outcomeSum float64
+}
+
+type backtestStats struct {
+	samples, games, skipped int
+	brierSum, logLossSum    float64
+	bins                    []calibrationBin
+
+	lastGame int
+}
+
+func (s *backtestStats) add(game int, prediction, outcome float64) {
+	if s.games == 0 || s.lastGame != game {
+		s.games++
+		s.lastGame = game
+	}
+	// Some models can produce NaN in odd states, such as the snail estimate
+	// running past a net. Those samples are counted but not scored.
+	if math.IsNaN(prediction) || math.IsInf(prediction, 0) {
+		s.skipped++
+		return
+	}
+	s.samples++
+	s.brierSum += (prediction - outcome) * (prediction - outcome)
+	// Clamp to keep a confidently wrong prediction from being infinitely bad.
+	const epsilon = 1e-15
+	p := math.Min(math.Max(prediction, epsilon), 1-epsilon)
+	s.logLossSum -= outcome*math.Log(p) + (1-outcome)*math.Log(1-p)
+	bin := int(prediction * float64(len(s.bins)))
+	if bin < 0 {
+		bin = 0
+	} else if bin >= len(s.bins) {
+		bin = len(s.bins) - 1
+	}
+	s.bins[bin].samples++
+	s.bins[bin].predictionSum += prediction
+	s.bins[bin].outcomeSum += outcome
+}
+
+// One row of the summary output. The scores are nil if every sample was
+// skipped.
+type backtestSummary struct {
+	Model, Map, Phase       string
+	Samples, Games, Skipped int
+	Brier, LogLoss          *float64
+}
+
+// One row of the calibration output. Bins without samples are omitted.
+type backtestCalibration struct {
+	Model, Map, Phase       string
+	LowerBound, UpperBound  float64
+	Samples                 int
+	MeanPrediction, WinRate float64
+}
+
+type backtestReport struct {
+	Summary     []backtestSummary
+	Calibration []backtestCalibration
+}
+
+// Collects model predictions over many games and scores them against the
+// actual winners.
+type backtester struct {
+	models []string
+	bins   int
+	groups map[backtestGroup]*backtestStats
+	games  int
+
+	// The samples for the game in progress. They are only scored once the
+	// game ends, since the phase depends on the game's duration.
+	pending []backtestSample
+}
+
+type backtestSample struct {
+	elapsed time.Duration
+	scores  []float64
+	side    Side // The side the scores are for.
+}
+
+func newBacktester(models []string, bins int) *backtester {
+	return &backtester{models: models, bins: bins, groups: make(map[backtestGroup]*backtestStats)}
+}
+
+func (b *backtester) visitor() gameVisitor {
+	return gameVisitor{
+		Start: func(*kq.GameState) { b.pending = b.pending[:0] },
+		Sample: func(cab *tracking.GameTracker, when time.Time) {
+			state := cab.State()
+			b.pending = append(b.pending, backtestSample{when.Sub(state.Start), AllStateScores(cab, when), predictedSide(cab)})
+		},
+		End: func(state *kq.GameState, result parser.GameResultMessage, when time.Time) {
+			b.finishGame(state.Map.String(), when.Sub(state.Start), result.Winner)
+		},
+	}
+}
+
+func (b *backtester) finishGame(mapName string, duration time.Duration, winner Side) {
+	if len(b.pending) == 0 || duration <= 0 {
+		return
+	}
+	b.games++
+	for _, s := range b.pending {
+		var outcome float64
+		if winner == s.side {
+			outcome = 1
+		}
+		phase := backtestPhase(s.elapsed, duration)
+		for i, prediction := range s.scores {
+			if i >= len(b.models) {
+				break
+			}
+			for _, m := range []string{mapName, "all"} {
+				for _, p := range []string{phase, "all"} {
+					b.stats(backtestGroup{b.models[i], m, p}).add(b.games, prediction, outcome)
+				}
+			}
+		}
+	}
+	b.pending = b.pending[:0]
+}
+
+func (b *backtester) stats(g backtestGroup) *backtestStats {
+	s := b.groups[g]
+	if s == nil {
+		s = &backtestStats{bins: make([]calibrationBin, b.bins)}
+		b.groups[g] = s
+	}
+	return s
+}
+
+// Returns the results ordered by model (in AllStateScores order), then map
+// and phase, with the "all" groups first.
+func (b *backtester) report() backtestReport {
+	modelOrder := make(map[string]int)
+	for i, m := range b.models {
+		modelOrder[m] = i
+	}
+	phaseOrder := map[string]int{"all": 0}
+	for i, p := range backtestPhases {
+		phaseOrder[p] = i + 1
+	}
+	var groups []backtestGroup
+	for g := range b.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.Model != b.Model {
+			return modelOrder[a.Model] < modelOrder[b.Model]
+		}
+		if a.Map != b.Map {
+			if a.Map == "all" || b.Map == "all" {
+				return a.Map == "all"
+			}
+			return a.Map < b.Map
+		}
+		return phaseOrder[a.Phase] < phaseOrder[b.Phase]
+	})
+
+	var r backtestReport
+	for _, g := range groups {
+		s := b.groups[g]
+		summary := backtestSummary{Model: g.Model, Map: g.Map, Phase: g.Phase, Samples: s.samples, Games: s.games, Skipped: s.skipped}
+		if s.samples > 0 {
+			n := float64(s.samples)
+			brier, logLoss := s.brierSum/n, s.logLossSum/n
+			summary.Brier, summary.LogLoss = &brier, &logLoss
+		}
+		r.Summary = append(r.Summary, summary)
+		for i, bin := range s.bins {
+			if bin.samples == 0 {
+				continue
+			}
+			bn := float64(bin.samples)
+			r.Calibration = append(r.Calibration, backtestCalibration{
+				g.Model, g.Map, g.Phase,
+				float64(i) / float64(b.bins), float64(i+1) / float64(b.bins),
+				bin.samples, bin.predictionSum / bn, bin.outcomeSum / bn,
+			})
+		}
+	}
+	return r
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Formats a score which may be missing, as an empty string.
+func formatScore(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return formatFloat(*f)
+}
+
+func (r *backtestReport) writeCSV(summary, calibration io.Writer) error {
+	w := csv.NewWriter(summary)
+	w.Write([]string{"model", "map", "phase", "samples", "games", "skipped", "brier", "logLoss"})
+	for _, s := range r.Summary {
+		w.Write([]string{s.Model, s.Map, s.Phase, strconv.Itoa(s.Samples), strconv.Itoa(s.Games), strconv.Itoa(s.Skipped),
+			formatScore(s.Brier), formatScore(s.LogLoss)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	w = csv.NewWriter(calibration)
+	w.Write([]string{"model", "map", "phase", "lowerBound", "upperBound", "samples", "meanPrediction", "winRate"})
+	for _, c := range r.Calibration {
+		w.Write([]string{c.Model, c.Map, c.Phase, formatFloat(c.LowerBound), formatFloat(c.UpperBound),
+			strconv.Itoa(c.Samples), formatFloat(c.MeanPrediction), formatFloat(c.WinRate)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Replays recorded logs and measures how well each model predicted the
+// winner of every completed game.
+func runBacktest(args []string) {
+	flags := flag.NewFlagSet("backtest", flag.ExitOnError)
+	interval := flags.Duration("interval", time.Second, "how often to sample the models, in game time")
+	bins := flags.Int("bins", 10, "the number of calibration bins")
+	format := flags.String("format", "csv", "the output format, csv or json")
+	out := flags.String("out", "backtest", "the output file prefix; csv writes <out>-summary.csv and <out>-calibration.csv, json writes <out>.json")
+	modelsFile := flags.String("models", "models.json", "the path to a JSON file defining additional prediction models")
+	trainedFile := flags.String("trainedModel", "trained_model.json", "the path to a model file written by the train command")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: kq-live backtest [flags] <cabinet log>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *bins <= 0 || *interval <= 0 || (*format != "csv" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := loadModelsFile(*modelsFile); err != nil {
+		fmt.Fprintln(logOut, "Invalid models file:", err)
+		os.Exit(1)
+	}
+	if err := loadTrainedModelFile(*trainedFile); err != nil {
+		fmt.Fprintln(logOut, "Invalid trained model:", err)
+		os.Exit(1)
+	}
+
+	b := newBacktester(StateScorerNames(), *bins)
+	for _, path := range flags.Args() {
+		if err := visitRecordedGames(path, *interval, b.visitor()); err != nil {
+			fmt.Fprintln(logOut, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Fprintf(logOut, "Scored %d games from %d logs\n", b.games, flags.NArg())
+	r := b.report()
+
+	var err error
+	if *format == "json" {
+		err = writeFile(*out+".json", func(w io.Writer) error {
+			e := json.NewEncoder(w)
+			e.SetIndent("", "\t")
+			return e.Encode(&r)
+		})
+	} else {
+		err = writeFile(*out+"-summary.csv", func(summary io.Writer) error {
+			return writeFile(*out+"-calibration.csv", func(calibration io.Writer) error {
+				return r.writeCSV(summary, calibration)
+			})
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-12s %8s %8s\n", "model", "brier", "logLoss")
+	for _, s := range r.Summary {
+		if s.Map != "all" || s.Phase != "all" {
+			continue
+		}
+		if s.Brier == nil {
+			fmt.Printf("%-12s %8s %8s\n", s.Model, "-", "-")
+		} else {
+			fmt.Printf("%-12s %8.4f %8.4f\n", s.Model, *s.Brier, *s.LogLoss)
+		}
+	}
+}
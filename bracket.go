@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+
+	kq "github.com/ughoavgfhw/libkq/common"
+)
+
+// Which part of an elimination bracket a match is in.
+type BracketSection int
+
+const (
+	WinnersBracket BracketSection = iota
+	LosersBracket
+	GrandFinals
+)
+
+func (s BracketSection) String() string {
+	switch s {
+	case WinnersBracket:
+		return "winners"
+	case LosersBracket:
+		return "losers"
+	case GrandFinals:
+		return "grandFinals"
+	}
+	return fmt.Sprintf("BracketSection(%d)", int(s))
+}
+
+// Where a team in a bracket match comes from.
+type bracketSource struct {
+	// The index of the match the team comes from, or -1 for a seeded team.
+	match int
+	// Whether the team is the loser of the match rather than the winner.
+	loser bool
+	// The seeded team. Empty means a bye.
+	seed string
+}
+
+type bracketMatch struct {
+	section BracketSection
+	round   int // Starting from 1 within the section.
+	scores  *MatchScores
+	sources [2]bracketSource
+	// Set once the match has been played and advanced past.
+	done bool
+	// Whether this is the grand finals reset, which is only played if the
+	// team from the losers bracket wins the first grand finals.
+	reset bool
+}
+
+// The result of resolving a bracketSource.
+type bracketTeam struct {
+	name  string
+	known bool // Whether the source match has been decided.
+	bye   bool
+}
+
+// A single or double elimination bracket. Teams are seeded in order, with the
+// top seeds getting byes when the number of teams is not a power of two.
+// Matches are played in bracket order as their teams become known.
+//
+// A match is decided when it is advanced past with one team ahead. Advancing
+// a tied match leaves it to be played again.
+type Bracket struct {
+	// The setup the bracket was created from, to recreate it on restart.
+	seeds   []string
+	double  bool
+	matches []*bracketMatch
+	// The index of the current match, or -1 once the bracket is finished.
+	currentIndex int
+	current      ActiveMatch
+}
+
+// Creates a bracket for the given teams, listed from the first seed down.
+func StartBracket(teams []string, double bool, victoryRule MatchVictoryRule) (*Bracket, error) {
+	if len(teams) < 2 {
+		return nil, fmt.Errorf("a bracket needs at least 2 teams")
+	}
+	seen := make(map[string]bool)
+	for _, t := range teams {
+		if t == "" {
+			return nil, fmt.Errorf("team names must not be empty")
+		}
+		if seen[t] {
+			return nil, fmt.Errorf("duplicate team %q", t)
+		}
+		seen[t] = true
+	}
+
+	b := &Bracket{seeds: teams, double: double}
+	add := func(section BracketSection, round int, a, c bracketSource) int {
+		b.matches = append(b.matches, &bracketMatch{
+			section: section,
+			round:   round,
+			scores:  new(MatchScores),
+			sources: [2]bracketSource{a, c},
+		})
+		return len(b.matches) - 1
+	}
+	winnerOf := func(m int) bracketSource { return bracketSource{match: m} }
+	loserOf := func(m int) bracketSource { return bracketSource{match: m, loser: true} }
+
+	// Standard seeding, so that the top seeds meet as late as possible.
+	size := 2
+	order := []int{1, 2}
+	for size < len(teams) {
+		size *= 2
+		next := make([]int, 0, size)
+		for _, s := range order {
+			next = append(next, s, size+1-s)
+		}
+		order = next
+	}
+	seed := func(s int) bracketSource {
+		if s <= len(teams) {
+			return bracketSource{match: -1, seed: teams[s-1]}
+		}
+		return bracketSource{match: -1}
+	}
+
+	var round []int
+	for i := 0; i < size; i += 2 {
+		round = append(round, add(WinnersBracket, 1, seed(order[i]), seed(order[i+1])))
+	}
+	var losers []int
+	if double && size >= 4 {
+		for i := 0; i < len(round); i += 2 {
+			losers = append(losers, add(LosersBracket, 1, loserOf(round[i]), loserOf(round[i+1])))
+		}
+	}
+	for r := 2; len(round) > 1; r++ {
+		prev := round
+		round = nil
+		for i := 0; i < len(prev); i += 2 {
+			round = append(round, add(WinnersBracket, r, winnerOf(prev[i]), winnerOf(prev[i+1])))
+		}
+		if !double {
+			continue
+		}
+		// Losers dropping from the winners bracket meet the survivors of
+		// the losers bracket, in alternating order to delay rematches.
+		lr := 2*r - 2
+		prevLosers := losers
+		losers = nil
+		for i, m := range prevLosers {
+			drop := round[i]
+			if r%2 == 0 {
+				drop = round[len(round)-1-i]
+			}
+			losers = append(losers, add(LosersBracket, lr, winnerOf(m), loserOf(drop)))
+		}
+		if len(round) > 1 {
+			prevLosers = losers
+			losers = nil
+			for i := 0; i < len(prevLosers); i += 2 {
+				losers = append(losers, add(LosersBracket, lr+1, winnerOf(prevLosers[i]), winnerOf(prevLosers[i+1])))
+			}
+		}
+	}
+	if double {
+		final := round[0]
+		champion := loserOf(final)
+		if len(losers) > 0 {
+			champion = winnerOf(losers[0])
+		}
+		gf := add(GrandFinals, 1, winnerOf(final), champion)
+		reset := add(GrandFinals, 2, winnerOf(gf), loserOf(gf))
+		b.matches[reset].reset = true
+	}
+
+	b.current.MatchVictoryRule = victoryRule
+	b.currentIndex = -1
+	b.moveToNextMatch()
+	return b, nil
+}
+
+// Resolves the team coming from a source.
+func (b *Bracket) team(src bracketSource) bracketTeam {
+	if src.match < 0 {
+		return bracketTeam{src.seed, true, src.seed == ""}
+	}
+	winner, loser, decided := b.result(src.match)
+	if !decided {
+		return bracketTeam{}
+	}
+	if src.loser {
+		return loser
+	}
+	return winner
+}
+
+// Returns the teams in a match, in A/B order.
+func (b *Bracket) teams(i int) (a, c bracketTeam) {
+	m := b.matches[i]
+	return b.team(m.sources[0]), b.team(m.sources[1])
+}
+
+// Returns whether a match has been decided, and if so its winner and loser.
+// Matches against a bye, and an unneeded grand finals reset, are decided
+// without being played.
+func (b *Bracket) result(i int) (winner, loser bracketTeam, decided bool) {
+	m := b.matches[i]
+	a, c := b.teams(i)
+	if !a.known || !c.known {
+		return bracketTeam{}, bracketTeam{}, false
+	}
+	switch {
+	case a.bye:
+		return c, a, true
+	case c.bye:
+		return a, c, true
+	}
+	if m.reset {
+		// The first grand finals' winner is slot A here. If that was the
+		// team from the winners bracket, the bracket is over.
+		gf := m.sources[0].match
+		gfA, _ := b.teams(gf)
+		if gfWinner, gfLoser, _ := b.result(gf); gfWinner.name == gfA.name {
+			return gfWinner, gfLoser, true
+		}
+	}
+	if !m.done {
+		return bracketTeam{}, bracketTeam{}, false
+	}
+	a.name, c.name = m.scores.TeamA, m.scores.TeamB
+	if m.scores.ScoreA > m.scores.ScoreB {
+		return a, c, true
+	}
+	return c, a, true
+}
+
+// Whether a match can be played now.
+func (b *Bracket) playable(i int) bool {
+	if _, _, decided := b.result(i); decided {
+		return false
+	}
+	a, c := b.teams(i)
+	return a.known && c.known && !a.bye && !c.bye
+}
+
+// Makes the first playable match current. If none are, the bracket is
+// finished and an empty match is current.
+func (b *Bracket) moveToNextMatch() {
+	for i := range b.matches {
+		if b.playable(i) {
+			a, c := b.teams(i)
+			scores := b.matches[i].scores
+			if len(scores.Games) == 0 {
+				scores.TeamA, scores.TeamB = a.name, c.name
+			}
+			b.currentIndex = i
+			b.current.Reset(scores)
+			return
+		}
+	}
+	b.currentIndex = -1
+	b.current.Reset(new(MatchScores))
+}
+
+func (b *Bracket) CurrentMatch() *MatchScores {
+	return b.current.MatchScores
+}
+
+// Returns an upcoming match in play order, whose teams may not be known yet.
+// Beyond the end of the bracket, returns an empty match which is never
+// played.
+func (b *Bracket) UpcomingMatch(distance int) *MatchScores {
+	for i := range b.matches {
+		if i == b.currentIndex {
+			continue
+		}
+		if _, _, decided := b.result(i); decided {
+			continue
+		}
+		if distance == 0 {
+			m := b.matches[i]
+			if a, c := b.teams(i); len(m.scores.Games) == 0 {
+				m.scores.TeamA, m.scores.TeamB = a.name, c.name
+			}
+			return m.scores
+		}
+		distance--
+	}
+	return new(MatchScores)
+}
+
+// Finishes the current match if one team is ahead, then moves to the next
+// playable match.
+func (b *Bracket) AdvanceMatch() {
+	if b.currentIndex >= 0 {
+		m := b.matches[b.currentIndex]
+		if m.scores.ScoreA != m.scores.ScoreB {
+			m.done = true
+		}
+	}
+	b.moveToNextMatch()
+}
+
+func (b *Bracket) TeamASide() kq.Side {
+	return b.current.TeamASide
+}
+
+func (b *Bracket) SetTeamASide(side kq.Side) {
+	b.current.TeamASide = side
+}
+
+func (b *Bracket) SwapSides() {
+	b.current.SwapSides()
+}
+
+func (b *Bracket) RecordGame(winner kq.Side, winType kq.WinType) {
+	b.current.RecordGame(winner, winType)
+}
+
+func (b *Bracket) ClearPreviousGame() {
+	b.current.ClearPreviousGame()
+}
+
+func (b *Bracket) VictoryRule() MatchVictoryRule {
+	return b.current.MatchVictoryRule
+}
+
+func (b *Bracket) SetVictoryRule(rule MatchVictoryRule) {
+	b.current.MatchVictoryRule = rule
+}
+
+func (b *Bracket) CurrentMatchIsComplete() bool {
+	return b.current.IsComplete()
+}
+
+// A match in a bracket, as sent to clients.
+type BracketMatchView struct {
+	Id      int    `json:"id"`
+	Section string `json:"section"`
+	Round   int    `json:"round"`
+	TeamA   string `json:"teamA"`
+	TeamB   string `json:"teamB"`
+	ScoreA  int    `json:"scoreA"`
+	ScoreB  int    `json:"scoreB"`
+	// Describes where each team comes from while it is not known yet, such
+	// as "Winner of 3".
+	SourceA string `json:"sourceA,omitempty"`
+	SourceB string `json:"sourceB,omitempty"`
+	// "A" or "B" once the match is decided.
+	Winner string `json:"winner,omitempty"`
+	// Whether the match was decided without being played.
+	Bye     bool `json:"bye,omitempty"`
+	Current bool `json:"current,omitempty"`
+}
+
+// The structure and results of a bracket, as sent to clients.
+type BracketView struct {
+	Double  bool               `json:"double"`
+	Matches []BracketMatchView `json:"matches"`
+}
+
+func (b *Bracket) View() *BracketView {
+	v := new(BracketView)
+	describe := func(src bracketSource) string {
+		if src.loser {
+			return fmt.Sprintf("Loser of %d", src.match+1)
+		}
+		return fmt.Sprintf("Winner of %d", src.match+1)
+	}
+	for i, m := range b.matches {
+		if m.section != WinnersBracket {
+			v.Double = true
+		}
+		mv := BracketMatchView{
+			Id:      i + 1,
+			Section: m.section.String(),
+			Round:   m.round,
+			ScoreA:  m.scores.ScoreA,
+			ScoreB:  m.scores.ScoreB,
+			Current: i == b.currentIndex,
+		}
+		a, c := b.teams(i)
+		if len(m.scores.Games) > 0 || m.done {
+			mv.TeamA, mv.TeamB = m.scores.TeamA, m.scores.TeamB
+		} else {
+			mv.TeamA, mv.TeamB = a.name, c.name
+		}
+		if a.bye {
+			mv.SourceA = "Bye"
+		} else if !a.known {
+			mv.SourceA = describe(m.sources[0])
+		}
+		if c.bye {
+			mv.SourceB = "Bye"
+		} else if !c.known {
+			mv.SourceB = describe(m.sources[1])
+		}
+		if winner, _, decided := b.result(i); decided {
+			mv.Winner = "B"
+			if winner.name == mv.TeamA && !a.bye {
+				mv.Winner = "A"
+			}
+			mv.Bye = !m.done
+		}
+		v.Matches = append(v.Matches, mv)
+	}
+	return v
+}
+
+// Chooses the tournament format, as sent by control clients.
+type TournamentSetup struct {
+	// "unstructured", "singleElimination", "doubleElimination" or
+	// "roundRobin".
+	Format string `json:"format"`
+	// The teams in a bracket or round robin, from the first seed down. If
+	// empty, the server uses the roster's team list.
+	Teams []string `json:"teams,omitempty"`
+	// For round robins, the number of groups to split the teams into, and
+	// the tiebreakers for the standings.
+	Groups      int      `json:"groups,omitempty"`
+	Tiebreakers []string `json:"tiebreakers,omitempty"`
+}
+
+// Starts a tournament in the given format. Every match uses the victory rule
+// until it is changed.
+func StartTournament(setup TournamentSetup, victoryRule MatchVictoryRule) (Tournament, error) {
+	switch setup.Format {
+	case "unstructured":
+		return StartUnstructuredPlay(victoryRule), nil
+	case "singleElimination":
+		return StartBracket(setup.Teams, false, victoryRule)
+	case "doubleElimination":
+		return StartBracket(setup.Teams, true, victoryRule)
+	case "roundRobin":
+		return StartRoundRobin(setup.Teams, setup.Groups, setup.Tiebreakers, victoryRule)
+	}
+	return nil, fmt.Errorf("unknown tournament format %q", setup.Format)
+}
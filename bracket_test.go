@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	kq "github.com/ughoavgfhw/libkq/common"
+)
+
+func seedNames(n int) []string {
+	teams := make([]string, n)
+	for i := range teams {
+		teams[i] = fmt.Sprintf("seed%d", i+1)
+	}
+	return teams
+}
+
+// Records a game won by the named team in the tournament's current match.
+func winGame(tm Tournament, team string) {
+	side := tm.TeamASide()
+	if team != tm.CurrentMatch().TeamA {
+		side = kq.BlueSide
+		if tm.TeamASide() == kq.BlueSide {
+			side = kq.GoldSide
+		}
+	}
+	tm.RecordGame(side, kq.MilitaryWin)
+}
+
+// Plays the bracket to the end, with pick choosing the winner of each match.
+// Returns the matches played, in order.
+func playBracket(t *testing.T, b *Bracket, pick func(m *bracketMatch) string) []MatchScores {
+	var played []MatchScores
+	for b.currentIndex >= 0 {
+		if len(played) > len(b.matches) {
+			t.Fatalf("bracket did not finish after %d matches", len(played))
+		}
+		m := b.matches[b.currentIndex]
+		cur := b.CurrentMatch()
+		if cur.TeamA == "" || cur.TeamB == "" || cur.TeamA == cur.TeamB {
+			t.Fatalf("match %d has teams %q and %q", b.currentIndex+1, cur.TeamA, cur.TeamB)
+		}
+		winGame(b, pick(m))
+		played = append(played, *cur)
+		b.AdvanceMatch()
+	}
+	return played
+}
+
+// Returns the seed of a team named by seedNames.
+func seedOf(team string) int {
+	var seed int
+	fmt.Sscanf(team, "seed%d", &seed)
+	return seed
+}
+
+// Picks the better seed.
+func betterSeed(m *bracketMatch) string {
+	if seedOf(m.scores.TeamA) < seedOf(m.scores.TeamB) {
+		return m.scores.TeamA
+	}
+	return m.scores.TeamB
+}
+
+func worseSeed(m *bracketMatch) string {
+	if betterSeed(m) == m.scores.TeamA {
+		return m.scores.TeamB
+	}
+	return m.scores.TeamA
+}
+
+func losses(played []MatchScores) map[string]int {
+	l := make(map[string]int)
+	for _, m := range played {
+		if m.ScoreA > m.ScoreB {
+			l[m.TeamB]++
+		} else {
+			l[m.TeamA]++
+		}
+	}
+	return l
+}
+
+// Returns the winner of the bracket's last match.
+func champion(b *Bracket) string {
+	v := b.View()
+	last := v.Matches[len(v.Matches)-1]
+	switch last.Winner {
+	case "A":
+		return last.TeamA
+	case "B":
+		return last.TeamB
+	}
+	return ""
+}
+
+func TestBracketPlaysEveryTeam(t *testing.T) {
+	// With byes, the top seeds skip the first round, so the first match is
+	// between the lowest seeds which play it.
+	firstMatch := map[int][2]string{
+		2: {"seed1", "seed2"},
+		3: {"seed2", "seed3"},
+		4: {"seed1", "seed4"},
+		5: {"seed4", "seed5"},
+		6: {"seed4", "seed5"},
+		7: {"seed4", "seed5"},
+		8: {"seed1", "seed8"},
+	}
+	for n := 2; n <= 8; n++ {
+		for _, double := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d teams double=%v", n, double), func(t *testing.T) {
+				b, err := StartBracket(seedNames(n), double, BestOfN(1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				cur := b.CurrentMatch()
+				if got := [2]string{cur.TeamA, cur.TeamB}; got != firstMatch[n] {
+					t.Errorf("first match is %v, want %v", got, firstMatch[n])
+				}
+
+				played := playBracket(t, b, betterSeed)
+				// Every team but the champion is knocked out, after one loss
+				// or two.
+				maxLosses := 1
+				if double {
+					maxLosses = 2
+				}
+				if want := maxLosses * (n - 1); len(played) != want {
+					t.Errorf("played %d matches, want %d", len(played), want)
+				}
+				l := losses(played)
+				for _, team := range seedNames(n)[1:] {
+					if l[team] != maxLosses {
+						t.Errorf("%s lost %d matches, want %d", team, l[team], maxLosses)
+					}
+				}
+				if l["seed1"] != 0 {
+					t.Errorf("seed1 lost %d matches, want 0", l["seed1"])
+				}
+				if got := champion(b); got != "seed1" {
+					t.Errorf("champion is %q, want seed1", got)
+				}
+				if got := b.CurrentMatch(); got.TeamA != "" || got.TeamB != "" {
+					t.Errorf("finished bracket has current match %q vs %q", got.TeamA, got.TeamB)
+				}
+			})
+		}
+	}
+}
+
+func TestBracketByes(t *testing.T) {
+	b, err := StartBracket(seedNames(5), false, BestOfN(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := b.View()
+	// Seeds 1, 2 and 3 get byes in the first round.
+	byes := 0
+	for _, m := range v.Matches {
+		if m.Round != 1 {
+			continue
+		}
+		if m.SourceA == "Bye" || m.SourceB == "Bye" {
+			byes++
+			if !m.Bye || m.Winner != "A" {
+				t.Errorf("bye match %d: bye=%v winner=%q, want decided for team A", m.Id, m.Bye, m.Winner)
+			}
+		}
+	}
+	if byes != 3 {
+		t.Errorf("%d byes, want 3", byes)
+	}
+	// Seed 1 is waiting for the winner of the only first round match.
+	next := b.UpcomingMatch(0)
+	if next.TeamA != "seed1" || next.TeamB != "" {
+		t.Errorf("upcoming match is %q vs %q, want seed1 vs an unknown team", next.TeamA, next.TeamB)
+	}
+	winGame(b, "seed5")
+	b.AdvanceMatch()
+	if cur := b.CurrentMatch(); cur.TeamA != "seed1" || cur.TeamB != "seed5" {
+		t.Errorf("current match is %q vs %q, want seed1 vs seed5", cur.TeamA, cur.TeamB)
+	}
+}
+
+func TestBracketUpcomingMatch(t *testing.T) {
+	b, err := StartBracket(seedNames(4), false, BestOfN(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"seed2", "seed3"}, {"", ""}, {"", ""}}
+	for i, w := range want {
+		m := b.UpcomingMatch(i)
+		if got := [2]string{m.TeamA, m.TeamB}; got != w {
+			t.Errorf("UpcomingMatch(%d) is %v, want %v", i, got, w)
+		}
+	}
+	final := b.UpcomingMatch(1)
+	winGame(b, "seed1")
+	b.AdvanceMatch()
+	winGame(b, "seed3")
+	b.AdvanceMatch()
+	if cur := b.CurrentMatch(); cur != final || cur.TeamA != "seed1" || cur.TeamB != "seed3" {
+		t.Errorf("final is %q vs %q, want seed1 vs seed3", cur.TeamA, cur.TeamB)
+	}
+}
+
+func TestBracketTiedMatchIsReplayed(t *testing.T) {
+	b, err := StartBracket(seedNames(4), false, BestOfN(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := b.CurrentMatch()
+	winGame(b, "seed1")
+	winGame(b, "seed4")
+	b.AdvanceMatch()
+	if b.CurrentMatch() != first {
+		t.Fatalf("advancing a tied match moved on to %q vs %q", b.CurrentMatch().TeamA, b.CurrentMatch().TeamB)
+	}
+	winGame(b, "seed4")
+	b.AdvanceMatch()
+	if b.CurrentMatch() == first {
+		t.Fatal("advancing a decided match did not move on")
+	}
+}
+
+func TestBracketGrandFinals(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Picks the winner of the first grand finals, and of the reset.
+		grandFinals, reset func(m *bracketMatch) string
+		played             int
+		champion           string
+	}{
+		{"winners bracket team wins", betterSeed, nil, 6, "seed1"},
+		{"reset won by winners bracket team", worseSeed, betterSeed, 7, "seed1"},
+		{"reset won by losers bracket team", worseSeed, worseSeed, 7, "seed2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := StartBracket(seedNames(4), true, BestOfN(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			played := playBracket(t, b, func(m *bracketMatch) string {
+				switch {
+				case m.reset:
+					if tc.reset == nil {
+						t.Fatal("played an unneeded reset")
+					}
+					return tc.reset(m)
+				case m.section == GrandFinals:
+					if m.scores.TeamA != "seed1" || m.scores.TeamB != "seed2" {
+						t.Errorf("grand finals is %q vs %q, want seed1 vs seed2", m.scores.TeamA, m.scores.TeamB)
+					}
+					return tc.grandFinals(m)
+				}
+				return betterSeed(m)
+			})
+			if len(played) != tc.played {
+				t.Errorf("played %d matches, want %d", len(played), tc.played)
+			}
+			if got := champion(b); got != tc.champion {
+				t.Errorf("champion is %q, want %q", got, tc.champion)
+			}
+			reset := b.View().Matches[len(b.matches)-1]
+			if reset.Bye != (tc.reset == nil) {
+				t.Errorf("reset decided without being played is %v, want %v", reset.Bye, tc.reset == nil)
+			}
+		})
+	}
+}
@@ -3,24 +3,161 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
 )
 
 type Config struct {
 	ServerPort int
+	// The address of the only cabinet. Ignored if Cabinets is non-empty.
 	CabAddress string
+	// Which team is on the left side of the only cabinet, as in
+	// CabinetConfig. Ignored if Cabinets is non-empty.
+	LeftTeam string
+	// The cabinets to track. Each must have a unique, non-empty name, which is
+	// used to select the cabinet in web views and to name output files.
+	Cabinets []CabinetConfig
+
+	// Where to write the output of each run. Every run gets a directory
+	// named for when it started, holding the messages read from each
+	// cabinet and the states of each game.
+	OutputDir string
+	// The formats to write game states in: "csv", "jsonl", or both.
+	OutputFormats []string
 
 	// TODO: Some config for the various existing web views, optionally point
 	// to template like used for the scoreboard now.
 
+	// A JSON file listing the teams and players. If it does not exist,
+	// teams.conf is used instead.
+	RosterFile string
+
+	// What to do automatically when games and matches end.
+	MatchAutomation MatchAutomation
+	// Where to save the tournament, including the current match and what is
+	// on deck, so it can be resumed after a restart. Empty disables saving.
+	StateFile string
+	// Names the event being played, such as a tournament, so player stats can
+	// be totalled for just its games.
+	EventName string
+	// The directory of the game store, which keeps every game's messages,
+	// final state and player stats. Empty keeps only a summary of each game
+	// until the server stops.
+	GameStoreDir string
+
 	TextOutputPredictionModelName string
+	// A JSON file defining additional prediction models. It is reloaded when
+	// it changes.
+	ModelsFile string
+	// A model file written by the train command. It is reloaded when it
+	// changes.
+	TrainedModelFile string
+
+	// The users allowed to access the server. If empty, anyone can do
+	// anything.
+	Users []UserConfig
+	// The role of clients without credentials when there are Users: "overlay"
+	// (the default) to allow watching but not changing the match, or "none".
+	AnonymousRole string
+	// Where to record changes made through the control interfaces. Empty
+	// disables the audit log.
+	AuditLogFile string
+}
+
+type CabinetConfig struct {
+	Name    string
+	Address string
+	// Which team is on the left side of the cabinet: "blue", "gold", or
+	// "auto" (the default) to detect it from each game. Can be changed from
+	// the control page.
+	LeftTeam string
+}
+
+// The name used for the cabinet when only CabAddress is configured.
+const DefaultCabinetName = "default"
+
+// Returns the cabinets to track. If no cabinets are listed, this is a single
+// cabinet using CabAddress.
+func (c *Config) CabinetList() []CabinetConfig {
+	if len(c.Cabinets) == 0 {
+		return []CabinetConfig{{DefaultCabinetName, c.CabAddress, c.LeftTeam}}
+	}
+	return c.Cabinets
+}
+
+// Parses the index'th cabinet given on the command line, either as
+// `name=address` or as just an address. If there is no name, the first cabinet
+// gets the default name and others are numbered.
+func ParseCabinetArg(arg string, index int) CabinetConfig {
+	if i := strings.Index(arg, "="); i > 0 && !strings.Contains(arg[:i], "/") {
+		return CabinetConfig{Name: arg[:i], Address: arg[i+1:]}
+	}
+	if index == 0 {
+		return CabinetConfig{Name: DefaultCabinetName, Address: arg}
+	}
+	return CabinetConfig{Name: fmt.Sprintf("cab%d", index+1), Address: arg}
+}
+
+// Checks that every cabinet has a unique, non-empty name which is safe to use
+// as a file name, and a valid LeftTeam.
+func ValidateCabinets(cabs []CabinetConfig) error {
+	seen := make(map[string]bool)
+	for _, cab := range cabs {
+		if cab.Name == "" {
+			return fmt.Errorf("cabinet at %q has no name", cab.Address)
+		}
+		if seen[cab.Name] {
+			return fmt.Errorf("duplicate cabinet name %q", cab.Name)
+		}
+		// Each cabinet's replay log is named after it, so the name must stay
+		// within the session directory.
+		if strings.ContainsAny(cab.Name, `/\`) || cab.Name == "." || cab.Name == ".." {
+			return fmt.Errorf("cabinet name %q must not contain / or \\, or be . or ..", cab.Name)
+		}
+		switch cab.LeftTeam {
+		case "", "auto", "blue", "gold":
+		default:
+			return fmt.Errorf("cabinet %q has unknown left team %q; expected blue, gold or auto", cab.Name, cab.LeftTeam)
+		}
+		seen[cab.Name] = true
+	}
+	return nil
+}
+
+// Applies a LeftTeam setting to a cabinet's sides. "blue" and "gold" fix the
+// team on the left, while "auto" or "" detect it, starting from the current
+// sides.
+func setLeftTeam(sides *tracking.TeamSides, leftTeam string) error {
+	switch leftTeam {
+	case "blue":
+		sides.Set(false, false)
+	case "gold":
+		sides.Set(true, false)
+	case "", "auto":
+		sides.Set(sides.GoldOnLeft(), true)
+	default:
+		return fmt.Errorf("unknown left team %q; expected blue, gold or auto", leftTeam)
+	}
+	return nil
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		ServerPort:                    8080,
 		CabAddress:                    "ws://kq.local:12749",
+		OutputDir:                     "output",
+		OutputFormats:                 []string{"csv"},
+		RosterFile:                    "teams.json",
+		MatchAutomation:               MatchAutomation{AdvanceDelaySeconds: 30},
+		StateFile:                     "tournament.json",
+		GameStoreDir:                  "games",
 		TextOutputPredictionModelName: "",
+		ModelsFile:                    "models.json",
+		TrainedModelFile:              "trained_model.json",
+		AuditLogFile:                  "audit.log",
 	}
 }
 
@@ -28,6 +165,7 @@ func ReadConfig(filepath string) (*Config, error) {
 	config := DefaultConfig()
 	f, err := os.Open(filepath)
 	if err != nil {
+		overrideByFlags(config)
 		return config, err
 	}
 	defer f.Close()
@@ -39,6 +177,9 @@ func ReadConfig(filepath string) (*Config, error) {
 
 var portFlag = flag.Int("port", 0, "the port number to listen on")
 var modelFlag = flag.String("model", "", "the name of the model to use for predictions")
+var modelsFileFlag = flag.String("models", "", "the path to a JSON file defining additional prediction models")
+var trainedModelFlag = flag.String("trainedModel", "", "the path to a model file written by the train command")
+var outputDirFlag = flag.String("outputDir", "", "the directory to write each run's output to")
 
 func overrideByFlags(config *Config) {
 	if *portFlag > 0 {
@@ -47,4 +188,13 @@ func overrideByFlags(config *Config) {
 	if len(*modelFlag) > 0 {
 		config.TextOutputPredictionModelName = *modelFlag
 	}
+	if len(*modelsFileFlag) > 0 {
+		config.ModelsFile = *modelsFileFlag
+	}
+	if len(*trainedModelFlag) > 0 {
+		config.TrainedModelFile = *trainedModelFlag
+	}
+	if len(*outputDirFlag) > 0 {
+		config.OutputDir = *outputDirFlag
+	}
 }
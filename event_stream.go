@@ -26,20 +26,28 @@ type Event struct {
 	Type   EventType
 	Data   map[interface{}]interface{}
 	IsTick bool
+	// The name of the cabinet this event applies to, or empty if it applies to
+	// all cabinets.
+	Cabinet string
 }
 
-func EventWithMessage(msg *kqio.Message, tick bool) *Event {
-	e := &Event{msg.Time, CabMessageEvent, make(map[interface{}]interface{}), tick}
+func EventWithMessage(cabinet string, msg *kqio.Message, tick bool) *Event {
+	e := &Event{msg.Time, CabMessageEvent, make(map[interface{}]interface{}), tick, cabinet}
 	e.Data[CabMessageKey] = msg
 	return e
 }
 
-func NewControlEvent(commands []ControlCommand) *Event {
-	e := &Event{time.Now(), ControlEvent, make(map[interface{}]interface{}), false}
+func NewControlEvent(cabinet string, commands []ControlCommand) *Event {
+	e := &Event{time.Now(), ControlEvent, make(map[interface{}]interface{}), false, cabinet}
 	e.Data[ControlCommandKey] = commands
 	return e
 }
 
+// Whether the event should be delivered to a client watching the given cabinet.
+func (e *Event) AppliesTo(cabinet string) bool {
+	return e.Cabinet == "" || e.Cabinet == cabinet
+}
+
 type EventStream chan *Event
 
 func NewEventStream() EventStream {
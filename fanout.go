@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many events may wait for a client, beyond its own buffer, before its
+// updates are coalesced or dropped.
+const clientQueueLimit = 256
+
+// Updates which only matter for their latest value. When a client falls
+// behind, these are merged into a single pending event instead of dropped.
+var coalescedKeys = map[interface{}]bool{
+	ScoreUpdateKey:  true,
+	TeamUpdateKey:   true,
+	VictoryRuleKey:  true,
+	GameListKey:     true,
+	FamineUpdateKey: true,
+	TeamListKey:     true,
+	PlayerDataKey:   true,
+	RosterErrorsKey: true,
+	LineupKey:       true,
+	TeamSidesKey:    true,
+	BracketKey:      true,
+	StandingsKey:    true,
+}
+
+// Data clients receive which can't be recovered from a later update. When a
+// client falls behind, events with these are dropped, and the client is
+// resynced once it catches up. Other data is never sent to clients, so
+// dropping it doesn't matter.
+var droppedKeys = map[interface{}]bool{
+	GameStartTimeKey: true,
+	StatsUpdateKey:   true,
+	MatchCompleteKey: true,
+	ControlErrorKey:  true,
+}
+
+// A client registering with runRegistry, identified by its registration token.
+type clientRegistration struct {
+	token    *chan<- *Event
+	endpoint string
+	remote   string
+	user     string
+	// The cabinet the client watches, if known before its start request.
+	cabinet string
+}
+
+// How well a client is keeping up, as reported by /api/clients.
+type clientMetrics struct {
+	Endpoint  string    `json:"endpoint"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Cabinet   string    `json:"cabinet,omitempty"`
+	Connected time.Time `json:"connected"`
+	Delivered uint64    `json:"delivered"`
+	// State updates merged into a later one while the client was behind.
+	Coalesced uint64 `json:"coalesced"`
+	// Events lost while the client was behind, and how many times it was
+	// resent its snapshot afterwards.
+	Dropped uint64 `json:"dropped"`
+	Resyncs uint64 `json:"resyncs"`
+	// Events waiting for the client, and how long the oldest one has waited.
+	Queued        int     `json:"queued"`
+	LagSeconds    float64 `json:"lagSeconds"`
+	MaxLagSeconds float64 `json:"maxLagSeconds"`
+}
+
+type queuedEvent struct {
+	event  *Event
+	queued time.Time
+}
+
+// Queues events for one client, so a slow client never blocks the registry.
+// The registry pushes events, and the feed's own goroutine hands them to the
+// client's channel.
+type clientFeed struct {
+	clientRegistration
+	connected time.Time
+	wake      chan struct{}
+	done      chan struct{}
+
+	mu    sync.Mutex
+	queue []queuedEvent
+	// The last event in the queue, if it holds coalesced updates and can
+	// still take more.
+	coalesced *Event
+	// The client's subscription, from its start requests, so it can be
+	// resynced.
+	sections map[string]bool
+	version  int
+	// Whether events were dropped since the client last caught up.
+	lost bool
+
+	delivered, coalescedCount, dropped, resyncs uint64
+	maxLag                                      time.Duration
+}
+
+func newClientFeed(r *clientRegistration) *clientFeed {
+	return &clientFeed{
+		clientRegistration: *r,
+		connected:          time.Now(),
+		wake:               make(chan struct{}, 1),
+		done:               make(chan struct{}),
+		sections:           make(map[string]bool),
+	}
+}
+
+// Returns the options of a client start request event.
+func clientStartOptions(e *Event) (ClientStartOptions, bool) {
+	cmd, ok := e.Data[ControlCommandKey].([]ControlCommand)
+	if e.Type != ControlEvent || !ok || len(cmd) != 1 || cmd[0].Type != ClientStartRequest {
+		return ClientStartOptions{}, false
+	}
+	return cmd[0].Data.(ClientStartOptions), true
+}
+
+// Queues an event for the client. Never blocks for long.
+func (f *clientFeed) push(e *Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	opts, isStart := clientStartOptions(e)
+	isStart = isStart && opts.ClientIdentifier == f.token
+	if isStart {
+		f.cabinet = e.Cabinet
+		for section := range opts.Sections {
+			f.sections[section] = true
+		}
+		f.version = opts.Version
+	}
+	// The client's own start request is never dropped, so it always gets
+	// its snapshot.
+	if isStart || len(f.queue) < clientQueueLimit {
+		f.queue = append(f.queue, queuedEvent{e, time.Now()})
+		f.coalesced = nil
+	} else {
+		f.overflow(e)
+	}
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Handles an event which doesn't fit in the queue, by coalescing its state
+// updates and dropping the rest.
+func (f *clientFeed) overflow(e *Event) {
+	if f.cabinet == "" || !e.AppliesTo(f.cabinet) {
+		return // The client wouldn't see it anyway.
+	}
+	merged, lost := false, false
+	for key, v := range e.Data {
+		if droppedKeys[key] {
+			lost = true
+		}
+		if !coalescedKeys[key] {
+			continue
+		}
+		if f.coalesced == nil {
+			// Only events for the client's cabinet get this far, so the
+			// coalesced event can be for that cabinet.
+			f.coalesced = &Event{Type: e.Type, Data: make(map[interface{}]interface{}), Cabinet: f.cabinet}
+			f.queue = append(f.queue, queuedEvent{f.coalesced, time.Now()})
+		}
+		if lineups, ok := v.(map[string]LineupView); ok && key == LineupKey {
+			// Lineups are keyed by cabinet, and an event only has those it
+			// applies to, so keep any from earlier events.
+			prev, _ := f.coalesced.Data[LineupKey].(map[string]LineupView)
+			all := make(map[string]LineupView, len(prev)+len(lineups))
+			for cab, lv := range prev {
+				all[cab] = lv
+			}
+			for cab, lv := range lineups {
+				all[cab] = lv
+			}
+			v = all
+		}
+		f.coalesced.Data[key] = v
+		merged = true
+	}
+	if merged {
+		f.coalesced.When = e.When
+		f.coalescedCount++
+	}
+	if lost {
+		if !f.lost {
+			fmt.Printf("%s client %s is falling behind; dropping events until it catches up\n", f.endpoint, f.remote)
+		}
+		f.lost = true
+		f.dropped++
+	}
+}
+
+// Hands queued events to the client until it unregisters. When the client
+// catches up after losing events, asks the server to resend its snapshot.
+func (f *clientFeed) run(eventOutput EventStream) {
+	for {
+		f.mu.Lock()
+		if len(f.queue) == 0 {
+			// Clients which never sent a start request have no snapshot to
+			// resend.
+			resync := f.lost && len(f.sections) > 0
+			f.lost = false
+			var resyncEvent *Event
+			if resync {
+				f.resyncs++
+				sections := make(map[string]bool, len(f.sections))
+				for section := range f.sections {
+					sections[section] = true
+				}
+				resyncEvent = NewControlEvent(f.cabinet, []ControlCommand{{
+					Type: ClientStartRequest,
+					Data: ClientStartOptions{
+						ClientIdentifier: f.token,
+						Sections:         sections,
+						Version:          f.version,
+						Resync:           true,
+					},
+				}})
+			}
+			f.mu.Unlock()
+			if resyncEvent != nil {
+				fmt.Printf("Resyncing %s client %s after it lost events\n", f.endpoint, f.remote)
+				eventOutput.AddEvent(resyncEvent)
+			}
+			select {
+			case <-f.wake:
+				continue
+			case <-f.done:
+				return
+			}
+		}
+		q := f.queue[0]
+		f.queue[0] = queuedEvent{}
+		f.queue = f.queue[1:]
+		if q.event == f.coalesced {
+			f.coalesced = nil
+		}
+		f.mu.Unlock()
+
+		select {
+		case *f.token <- q.event:
+		case <-f.done:
+			return
+		}
+		f.mu.Lock()
+		f.delivered++
+		if lag := time.Since(q.queued); lag > f.maxLag {
+			f.maxLag = lag
+		}
+		f.mu.Unlock()
+	}
+}
+
+// Stops handing events to the client.
+func (f *clientFeed) close() {
+	close(f.done)
+}
+
+func (f *clientFeed) metrics() clientMetrics {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := clientMetrics{
+		Endpoint:      f.endpoint,
+		Remote:        f.remote,
+		User:          f.user,
+		Cabinet:       f.cabinet,
+		Connected:     f.connected,
+		Delivered:     f.delivered,
+		Coalesced:     f.coalescedCount,
+		Dropped:       f.dropped,
+		Resyncs:       f.resyncs,
+		Queued:        len(f.queue) + len(*f.token),
+		MaxLagSeconds: f.maxLag.Seconds(),
+	}
+	if len(f.queue) > 0 {
+		m.LagSeconds = time.Since(f.queue[0].queued).Seconds()
+	}
+	return m
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	kq "github.com/ughoavgfhw/libkq"
+	. "github.com/ughoavgfhw/libkq/common"
+)
+
+// The formats game states can be written in.
+var outputFormats = map[string]string{
+	"csv":   ".csv",
+	"jsonl": ".jsonl",
+}
+
+func checkOutputFormats(formats []string) error {
+	for _, f := range formats {
+		if _, ok := outputFormats[f]; !ok {
+			return fmt.Errorf("unknown output format %q; expected csv or jsonl", f)
+		}
+	}
+	return nil
+}
+
+// Formats a game state as a line of JSON. Unlike CsvPrinter, it includes the
+// famine state, and the columns do not depend on the map.
+type JsonlPrinter struct {
+	GameId         string
+	Map            Map
+	Duration       time.Duration
+	Time           time.Time
+	State          kq.GameState
+	SnailEstimates []int
+}
+
+type jsonlState struct {
+	GameId     string    `json:"gameId"`
+	Map        string    `json:"map"`
+	TimeMillis int64     `json:"timeMillis"`
+	Time       time.Time `json:"time"`
+	// Indexed by PlayerId.Index(), so gold players come first at each
+	// position.
+	Players      [NumPlayers]jsonlPlayer `json:"players"`
+	Gold         jsonlTeam               `json:"gold"`
+	Blue         jsonlTeam               `json:"blue"`
+	Snails       []jsonlSnail            `json:"snails"`
+	WarriorGates []string                `json:"warriorGates"`
+	SpeedGates   []string                `json:"speedGates"`
+	BerriesUsed  int                     `json:"berriesUsed"`
+	InFamine     bool                    `json:"inFamine"`
+	NumFamines   int                     `json:"numFamines"`
+	Winner       string                  `json:"winner,omitempty"`
+	EndCondition string                  `json:"endCondition,omitempty"`
+}
+
+type jsonlPlayer struct {
+	Type     string `json:"type"`
+	HasSpeed bool   `json:"hasSpeed"`
+	HasBerry bool   `json:"hasBerry"`
+	OnSnail  int    `json:"onSnail"` // The snail ridden, counting from 1, or 0.
+}
+
+type jsonlSnail struct {
+	Pos      int `json:"pos"` // From the center; positive is toward the right.
+	Estimate int `json:"estimate"`
+	MaxPos   int `json:"maxPos"`
+}
+
+type jsonlTeam struct {
+	Warriors      int `json:"warriors"`
+	SpeedWarriors int `json:"speedWarriors"`
+	QueenDeaths   int `json:"queenDeaths"`
+	Berries       int `json:"berries"`
+}
+
+func (this *JsonlPrinter) String() string {
+	s := jsonlState{
+		GameId:       this.GameId,
+		Map:          this.Map.String(),
+		TimeMillis:   int64(this.Duration / time.Millisecond),
+		Time:         this.Time.UTC(),
+		Snails:       []jsonlSnail{},
+		WarriorGates: []string{},
+		SpeedGates:   []string{},
+		BerriesUsed:  this.State.BerriesUsed,
+		InFamine:     this.State.InFamine(),
+		NumFamines:   this.State.NumFamines,
+	}
+	for i, p := range this.State.Players {
+		s.Players[i] = jsonlPlayer{p.Type.String(), p.HasSpeed, p.HasBerry, p.OnSnail}
+	}
+	for _, t := range []struct {
+		out *jsonlTeam
+		in  kq.TeamState
+	}{{&s.Gold, this.State.GoldTeam}, {&s.Blue, this.State.BlueTeam}} {
+		*t.out = jsonlTeam{t.in.Warriors, t.in.SpeedWarriors, t.in.QueenDeaths, t.in.BerriesIn}
+	}
+	for i, sn := range this.State.Snails {
+		s.Snails = append(s.Snails, jsonlSnail{sn.Pos, this.SnailEstimates[i], sn.MaxPos})
+	}
+	for _, g := range this.State.WarriorGates {
+		s.WarriorGates = append(s.WarriorGates, g.ClaimedBy.String())
+	}
+	for _, g := range this.State.SpeedGates {
+		s.SpeedGates = append(s.SpeedGates, g.ClaimedBy.String())
+	}
+	if this.State.Winner != Neutral {
+		s.Winner = this.State.Winner.String()
+		s.EndCondition = this.State.EndCondition.String()
+	}
+	data, err := json.Marshal(&s)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// Writes the states of each game on a cabinet to files named after the game,
+// one per format, in a session's output directory.
+type gameOutput struct {
+	dir     string
+	formats []string
+
+	gameId string
+	files  []*os.File
+}
+
+func newGameOutput(dir string, formats []string) *gameOutput {
+	return &gameOutput{dir: dir, formats: formats}
+}
+
+// Finishes the previous game's files, and creates the files for a new game.
+func (o *gameOutput) StartGame(gameId string, m Map) {
+	o.EndGame()
+	o.gameId = gameId
+	for _, format := range o.formats {
+		f, err := os.Create(filepath.Join(o.dir, gameId+outputFormats[format]))
+		if err != nil {
+			fmt.Fprintln(logOut, "Failed to create game output:", err)
+			f = nil
+		} else if format == "csv" {
+			fmt.Fprintln(f, CsvHeader(m))
+		}
+		o.files = append(o.files, f)
+	}
+}
+
+// Writes a state of the current game, if there is one.
+func (o *gameOutput) Write(mp Map, duration time.Duration, when time.Time, state kq.GameState, snailEstimates []int) {
+	for i, f := range o.files {
+		if f == nil {
+			continue
+		}
+		var line fmt.Stringer
+		switch o.formats[i] {
+		case "csv":
+			line = &CsvPrinter{o.gameId, mp, duration, when, state, snailEstimates}
+		case "jsonl":
+			line = &JsonlPrinter{o.gameId, mp, duration, when, state, snailEstimates}
+		}
+		fmt.Fprintln(f, line)
+	}
+}
+
+// Closes the current game's files.
+func (o *gameOutput) EndGame() {
+	for _, f := range o.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	o.gameId, o.files = "", nil
+}
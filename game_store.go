@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	kq "github.com/ughoavgfhw/libkq"
+	kqio "github.com/ughoavgfhw/libkq/io"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// A completed game, with the statistics of every player whose name is known
+// from the lineup. This is what the game store indexes.
+type GameRecord struct {
+	Id       string        `json:"id"`
+	Start    time.Time     `json:"start"`
+	Time     time.Time     `json:"time"` // When the game ended.
+	Cabinet  string        `json:"cabinet"`
+	Event    string        `json:"event,omitempty"`
+	BlueTeam string        `json:"blueTeam"`
+	GoldTeam string        `json:"goldTeam"`
+	Map      string        `json:"map"`
+	Duration time.Duration `json:"duration"`
+	Winner   string        `json:"winner"`
+	WinType  string        `json:"winType"`
+	Players  []PlayerGame  `json:"players"`
+
+	// The match the game was part of, which game of the match it was, and
+	// the format of the tournament being played.
+	MatchId    string `json:"matchId"`
+	GameNumber int    `json:"gameNumber"`
+	Tournament string `json:"tournament"`
+}
+
+type PlayerGame struct {
+	Name     string              `json:"name"`
+	Team     string              `json:"team"`
+	Side     string              `json:"side"`
+	Position string              `json:"position"`
+	Stats    tracking.PlayerStat `json:"stats"`
+}
+
+// Everything stored about a game besides its messages.
+type StoredGame struct {
+	GameRecord
+	State kq.GameState `json:"state"` // The final state.
+	// The stats of every player, named or not, indexed by PlayerId.Index().
+	Stats []tracking.PlayerStat `json:"stats"`
+}
+
+// Identifies a game by its cabinet and start time. The id is also used in
+// file names.
+func newGameId(cabinet string, start time.Time) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, cabinet) + "-" + start.UTC().Format("20060102-150405.000")
+}
+
+// The state and messages of a game, as seen by trackCabinet, sent along with
+// the victory so the server can store the game.
+type finishedGame struct {
+	id       string
+	state    kq.GameState
+	messages []kqio.MessageString
+}
+
+// Builds the record of a game from its final stats update. Players are named
+// from the lineup of each team, and unnamed players are left out. The match
+// fields are left for the caller.
+func newStoredGame(cabinet, event string, dp *dataPoint, fg *finishedGame, teams TeamUpdate, lineup Lineup) *StoredGame {
+	g := &StoredGame{
+		GameRecord: GameRecord{
+			Time:     dp.when,
+			Cabinet:  cabinet,
+			Event:    event,
+			BlueTeam: teams.Blue,
+			GoldTeam: teams.Gold,
+			Map:      dp.mp,
+			Duration: dp.dur,
+			Winner:   dp.winner,
+			WinType:  dp.winType,
+		},
+		Stats: dp.stats,
+	}
+	if fg != nil {
+		g.Id = fg.id
+		g.Start = fg.state.Start
+		g.State = fg.state
+	}
+	for pos, name := range rosterPositions {
+		// Gold players come first in the stats for each position.
+		for i, side := range []struct {
+			name, team string
+			player     playerData
+		}{{"gold", teams.Gold, lineup.Gold[pos]}, {"blue", teams.Blue, lineup.Blue[pos]}} {
+			index := 2*pos + i
+			if side.player.Name == "" || index >= len(dp.stats) {
+				continue
+			}
+			g.Players = append(g.Players, PlayerGame{
+				Name:     side.player.Name,
+				Team:     side.team,
+				Side:     side.name,
+				Position: name,
+				Stats:    dp.stats[index],
+			})
+		}
+	}
+	return g
+}
+
+// Selects games from the store. Empty fields match every game.
+type GameQuery struct {
+	Cabinet string
+	Event   string
+	MatchId string
+	Team    string // Either side.
+	Player  string
+	Map     string
+	Winner  string // "blue" or "gold".
+	// Games which ended at or after Since and before Until.
+	Since, Until time.Time
+	// If positive, only the most recent Limit games are returned.
+	Limit int
+}
+
+// Reads a query from URL parameters of the same names, in lower case. Times
+// are RFC 3339.
+func parseGameQuery(v url.Values) (GameQuery, error) {
+	q := GameQuery{
+		Cabinet: v.Get("cab"),
+		Event:   v.Get("event"),
+		MatchId: v.Get("match"),
+		Team:    v.Get("team"),
+		Player:  v.Get("player"),
+		Map:     v.Get("map"),
+		Winner:  v.Get("winner"),
+	}
+	var err error
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	return q, nil
+}
+
+func (q *GameQuery) matches(g *GameRecord) bool {
+	switch {
+	case q.Cabinet != "" && g.Cabinet != q.Cabinet,
+		q.Event != "" && g.Event != q.Event,
+		q.MatchId != "" && g.MatchId != q.MatchId,
+		q.Team != "" && g.BlueTeam != q.Team && g.GoldTeam != q.Team,
+		q.Map != "" && g.Map != q.Map,
+		q.Winner != "" && g.Winner != q.Winner,
+		!q.Since.IsZero() && g.Time.Before(q.Since),
+		!q.Until.IsZero() && !g.Time.Before(q.Until):
+		return false
+	}
+	if q.Player == "" {
+		return true
+	}
+	for _, p := range g.Players {
+		if p.Name == q.Player {
+			return true
+		}
+	}
+	return false
+}
+
+// An embedded database of every game played, kept in a directory:
+//
+//	index.jsonl  A GameRecord per line, in the order the games ended.
+//	<id>.json    The game's StoredGame.
+//	<id>.log     The game's cabinet messages, in the same format as session logs.
+//
+// The index is kept in memory, and the rest is read when asked for. Without a
+// directory, only the index is kept, and only until the server stops.
+type gameStore struct {
+	dir string
+
+	mu    sync.Mutex
+	games []GameRecord
+	// Every id given out, and whether its game has been stored.
+	ids   map[string]bool
+	index *os.File
+}
+
+func openGameStore(dir string) (*gameStore, error) {
+	s := &gameStore{dir: dir, ids: make(map[string]bool)}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "index.jsonl")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewScanner(f)
+	r.Buffer(nil, 1<<20)
+	for line := 1; r.Scan(); line++ {
+		var g GameRecord
+		if err := json.Unmarshal(r.Bytes(), &g); err != nil || g.Id == "" {
+			// Most likely a write cut off by a crash. The game's other
+			// files may exist, but without an index entry it is skipped.
+			fmt.Printf("Skipping %s line %d: %v\n", path, line, err)
+			continue
+		}
+		s.games = append(s.games, g)
+		s.ids[g.Id] = true
+	}
+	if err := r.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.index = f
+	return s, nil
+}
+
+// Gives out the id for a game on cabinet which started at start. Ids are made
+// unique by adding a number, so games which start together on a cabinet are
+// still kept apart.
+func (s *gameStore) NewId(cabinet string, start time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newId(newGameId(cabinet, start))
+}
+
+func (s *gameStore) newId(base string) string {
+	id := base
+	for n := 2; ; n++ {
+		if _, used := s.ids[id]; !used {
+			break
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	s.ids[id] = false
+	return id
+}
+
+// Stores a game with its messages. The game's id should come from NewId; if
+// it has none, it is given one from its end time.
+func (s *gameStore) Add(g *StoredGame, messages []kqio.MessageString) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g.Id == "" {
+		g.Id = s.newId(newGameId(g.Cabinet, g.Time))
+	} else if stored, given := s.ids[g.Id]; stored || !given {
+		g.Id = s.newId(g.Id)
+	}
+	s.ids[g.Id] = true
+	s.games = append(s.games, g.GameRecord)
+	if s.dir == "" {
+		return nil
+	}
+
+	// The index entry goes last, so the game is only listed once the rest
+	// has been written.
+	err := writeFile(filepath.Join(s.dir, g.Id+".log"), func(f io.Writer) error {
+		w := kqio.NewMessageStringWriter(f)
+		for i := range messages {
+			if err := w.WriteMessageString(&messages[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(s.dir, g.Id+".json"), func(f io.Writer) error {
+		return json.NewEncoder(f).Encode(g)
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&g.GameRecord)
+	if err != nil {
+		return err
+	}
+	_, err = s.index.Write(append(data, '\n'))
+	return err
+}
+
+// Returns the games matching the query, in the order they ended.
+func (s *gameStore) Games(q GameQuery) []GameRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	games := []GameRecord{}
+	for i := range s.games {
+		if q.matches(&s.games[i]) {
+			games = append(games, s.games[i])
+		}
+	}
+	if q.Limit > 0 && q.Limit < len(games) {
+		games = games[len(games)-q.Limit:]
+	}
+	return games
+}
+
+func (s *gameStore) checkId(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ids[id] {
+		return fmt.Errorf("unknown game %q", id)
+	} else if s.dir == "" {
+		return fmt.Errorf("game %q was not saved", id)
+	}
+	return nil
+}
+
+// Reads everything stored about a game besides its messages.
+func (s *gameStore) Game(id string) (*StoredGame, error) {
+	if err := s.checkId(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	g := new(StoredGame)
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Opens a game's messages, which can be read as a recorded log.
+func (s *gameStore) OpenMessages(id string) (*os.File, error) {
+	if err := s.checkId(id); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.dir, id+".log"))
+}
+
+func (s *gameStore) Close() error {
+	if s.index == nil {
+		return nil
+	}
+	return s.index.Close()
+}
+
+// Serves the game store under /api/games:
+//
+//	GET /api/games                The games matching a query, as []GameRecord.
+//	GET /api/games/<id>           Everything about a game, as StoredGame.
+//	GET /api/games/<id>/messages  The game's messages, as a recorded log.
+//
+// The query parameters are those of parseGameQuery.
+type gameStoreAPI struct {
+	store *gameStore
+}
+
+func (api *gameStoreAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/games"), "/")
+	if path == "" {
+		q, err := parseGameQuery(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, api.store.Games(q))
+		return
+	}
+	id, part := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		id, part = path[:i], path[i+1:]
+	}
+	switch part {
+	case "":
+		g, err := api.store.Game(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, g)
+	case "messages":
+		f, err := api.store.OpenMessages(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var modtime time.Time
+		if info, err := f.Stat(); err == nil {
+			modtime = info.ModTime()
+		}
+		http.ServeContent(w, req, id+".log", modtime, f)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Lists the games in a game store, or shows one of them.
+func runGames(args []string) {
+	flags := flag.NewFlagSet("games", flag.ExitOnError)
+	dir := flags.String("dir", "games", "the game store directory")
+	format := flags.String("format", "table", "the output format for listing games, table or json")
+	var q GameQuery
+	flags.StringVar(&q.Cabinet, "cab", "", "only list games on this cabinet")
+	flags.StringVar(&q.Event, "event", "", "only list games in this event")
+	flags.StringVar(&q.MatchId, "match", "", "only list games in the match with this id")
+	flags.StringVar(&q.Team, "team", "", "only list games played by this team")
+	flags.StringVar(&q.Player, "player", "", "only list games played by this player")
+	flags.StringVar(&q.Map, "map", "", "only list games on this map")
+	flags.StringVar(&q.Winner, "winner", "", "only list games won by this side")
+	since := flags.String("since", "", "only list games which ended at or after this RFC 3339 time")
+	until := flags.String("until", "", "only list games which ended before this RFC 3339 time")
+	flags.IntVar(&q.Limit, "limit", 0, "only list this many of the most recent games")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: kq-live games [flags]")
+		fmt.Fprintln(flags.Output(), "       kq-live games [flags] show <id>")
+		fmt.Fprintln(flags.Output(), "       kq-live games [flags] messages <id>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	var err error
+	if *since != "" {
+		q.Since, err = time.Parse(time.RFC3339, *since)
+	}
+	if err == nil && *until != "" {
+		q.Until, err = time.Parse(time.RFC3339, *until)
+	}
+	cmd := flags.Arg(0)
+	if err != nil || (*format != "table" && *format != "json") ||
+		!(flags.NArg() == 0 || flags.NArg() == 2 && (cmd == "show" || cmd == "messages")) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*dir); err != nil {
+		fmt.Fprintln(logOut, err)
+		os.Exit(1)
+	}
+	store, err := openGameStore(*dir)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	switch cmd {
+	case "show":
+		var g *StoredGame
+		if g, err = store.Game(flags.Arg(1)); err == nil {
+			e := json.NewEncoder(os.Stdout)
+			e.SetIndent("", "\t")
+			err = e.Encode(g)
+		}
+	case "messages":
+		var f *os.File
+		if f, err = store.OpenMessages(flags.Arg(1)); err == nil {
+			_, err = io.Copy(os.Stdout, f)
+			f.Close()
+		}
+	default:
+		games := store.Games(q)
+		if *format == "json" {
+			e := json.NewEncoder(os.Stdout)
+			for i := 0; i < len(games) && err == nil; i++ {
+				err = e.Encode(&games[i])
+			}
+			break
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tENDED\tMATCH\tGAME\tBLUE\tGOLD\tMAP\tWINNER\tWIN TYPE\tDURATION")
+		for _, g := range games {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%v\n",
+				g.Id, g.Time.Local().Format("2006-01-02 15:04:05"), g.MatchId, g.GameNumber,
+				g.BlueTeam, g.GoldTeam, g.Map, g.Winner, g.WinType, g.Duration.Round(time.Second))
+		}
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		os.Exit(1)
+	}
+}
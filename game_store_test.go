@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGameStoreIds(t *testing.T) {
+	s := newTestGameStore(t)
+	start := time.Date(2019, 1, 13, 20, 1, 2, 345e6, time.UTC)
+	// Games which start in the same millisecond on a cabinet get their own
+	// ids, and keep them when stored.
+	first := s.NewId("left", start)
+	second := s.NewId("left", start)
+	if first != "left-20190113-200102.345" || second != first+"-2" {
+		t.Errorf("ids are %q and %q, want left-20190113-200102.345 and a suffixed copy", first, second)
+	}
+	if other := s.NewId("right", start); other != "right-20190113-200102.345" {
+		t.Errorf("id on another cabinet is %q", other)
+	}
+	for _, id := range []string{second, first} {
+		g := &StoredGame{GameRecord: GameRecord{Id: id, Cabinet: "left"}}
+		if err := s.Add(g, nil); err != nil {
+			t.Fatal(err)
+		}
+		if g.Id != id {
+			t.Errorf("game %q was stored as %q", id, g.Id)
+		}
+	}
+	// Storing a game twice, or without an id, still gives it an unused one.
+	g := &StoredGame{GameRecord: GameRecord{Id: first, Cabinet: "left"}}
+	if err := s.Add(g, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g.Id != first+"-3" {
+		t.Errorf("game stored again as %q, want %q", g.Id, first+"-3")
+	}
+	g = &StoredGame{GameRecord: GameRecord{Cabinet: "left", Time: start}}
+	if err := s.Add(g, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g.Id != first+"-4" {
+		t.Errorf("game without an id stored as %q, want %q", g.Id, first+"-4")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/parser"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// Golden files live next to each log in testdata/replays. For `name.log`, the
+// CSV output is in `name.golden.csv`, the JSON-lines output for the final state
+// of each game is in `name.golden.jsonl`, and the per-game results are in
+// `name.golden.json`. Run `go test -tags=dev -run Golden -update` to rewrite
+// them after an intentional behavior change, then review the diff.
+//
+// There is no recording of a bonus map game yet, so bonus maps are not
+// covered.
+var updateGolden = flag.Bool("update", false, "rewrite golden files with the current output")
+
+type goldenGame struct {
+	Map          string
+	Duration     time.Duration
+	Winner       string
+	EndCondition string
+	Stats        [NumPlayers]tracking.PlayerStat
+}
+
+// Returns a store which only keeps game ids, for trackers to give out.
+func newTestGameStore(t *testing.T) *gameStore {
+	s, err := openGameStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Replays the log through the same per-message step as a live session,
+// producing the CSV of all games together, the JSON line of each game's final
+// state, and a summary of each completed game.
+func runGoldenReplay(t *testing.T, path string) (csv, jsonl []byte, games []goldenGame) {
+	replay, err := openReplay(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+
+	var out, jsonlOut bytes.Buffer
+	var header string
+	ticker := &messageTimeTicker{interval: 100 * time.Millisecond}
+	// The per-game files aren't compared, so none are written.
+	tracker := newCabinetTracker("default", tracking.NewTeamSides(false, true), newGameOutput(t.TempDir(), nil), newTestGameStore(t), replay, ticker.Tick, nil)
+	cab := tracker.cab
+	var msg kqio.Message
+	for {
+		if err := tracker.read(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			continue
+		}
+		_, recorded := tracker.step(msg)
+		state := cab.State()
+		if recorded {
+			if msg.Type == "gamestart" {
+				// Like the per-game files, but only repeating the header
+				// when the map's columns differ.
+				if h := CsvHeader(state.Map); h != header {
+					header = h
+					fmt.Fprintln(&out, header)
+				}
+			}
+			fmt.Fprintln(&out, &CsvPrinter{tracker.gameId, state.Map, msg.Time.Sub(state.Start), msg.Time, state, cab.SnailEstimates(msg.Time)})
+			if msg.Type == "victory" {
+				fmt.Fprintln(&jsonlOut, &JsonlPrinter{tracker.gameId, state.Map, msg.Time.Sub(state.Start), msg.Time, state, cab.SnailEstimates(msg.Time)})
+			}
+		}
+		if msg.Type == "victory" && !state.Start.IsZero() {
+			result := msg.Val.(parser.GameResultMessage)
+			games = append(games, goldenGame{
+				Map:          state.Map.String(),
+				Duration:     msg.Time.Sub(state.Start),
+				Winner:       result.Winner.String(),
+				EndCondition: result.EndCondition.String(),
+				Stats:        cab.PlayerStats(),
+			})
+		}
+	}
+	return out.Bytes(), jsonlOut.Bytes(), games
+}
+
+// Compares output with a golden file, reporting the first differing line.
+func checkGolden(t *testing.T, path string, got []byte) {
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	gotLines := strings.Split(string(got), "\n")
+	wantLines := strings.Split(string(want), "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			t.Errorf("%s differs at line %d:\n got: %s\nwant: %s", path, i+1, g, w)
+			return
+		}
+	}
+}
+
+func TestGoldenReplays(t *testing.T) {
+	logs, err := filepath.Glob(filepath.Join("testdata", "replays", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 {
+		t.Fatal("no replay logs found")
+	}
+	for _, path := range logs {
+		base := strings.TrimSuffix(path, ".log")
+		t.Run(filepath.Base(base), func(t *testing.T) {
+			csv, jsonl, games := runGoldenReplay(t, path)
+			checkGolden(t, base+".golden.csv", csv)
+			checkGolden(t, base+".golden.jsonl", jsonl)
+
+			summary, err := json.MarshalIndent(games, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, base+".golden.json", append(summary, '\n'))
+		})
+	}
+}
+
+// Cabinets name the bonus maps differently than libkq does. Without a
+// recording, this only checks that the names cabinets send are recognized.
+func TestReadBonusMapNames(t *testing.T) {
+	log := "1540065488368,![k[gamestart],v[map_bonus_military,False,0,False]]!\n" +
+		"1540065498368,![k[gameend],v[map_bonus_snail,False,10.000,False]]!\n"
+	reader := kqio.NewMessageStringReader(strings.NewReader(log))
+	tracker := newCabinetTracker("default", tracking.NewTeamSides(false, true), newGameOutput(t.TempDir(), nil), newTestGameStore(t), reader, func(time.Time) bool { return false }, nil)
+	var msg kqio.Message
+	if err := tracker.read(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if m := msg.Val.(parser.GameStartMessage).Map; m != WarriorBonusMap {
+		t.Errorf("gamestart map is %v, want %v", m, WarriorBonusMap)
+	}
+	if err := tracker.read(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if m := msg.Val.(parser.GameEndMessage).Map; m != SnailBonusMap {
+		t.Errorf("gameend map is %v, want %v", m, SnailBonusMap)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import "fmt"
+
+// Assigns players to the cabinet positions on each side, in rosterPositions
+// order. A nil side is left unchanged, and an empty name leaves the position
+// to the roster.
+type LineupUpdate struct {
+	Blue []string `json:"blue"`
+	Gold []string `json:"gold"`
+}
+
+// Checks that each side names at most one player per position, and no player
+// twice.
+func (u LineupUpdate) validate() error {
+	for _, side := range []struct {
+		name    string
+		players []string
+	}{{"blue", u.Blue}, {"gold", u.Gold}} {
+		if len(side.players) > len(rosterPositions) {
+			return fmt.Errorf("%s lineup has %d positions, expected %d", side.name, len(side.players), len(rosterPositions))
+		}
+		seen := make(map[string]bool)
+		for _, p := range side.players {
+			if p != "" && seen[p] {
+				return fmt.Errorf("%s lineup has %q more than once", side.name, p)
+			}
+			seen[p] = true
+		}
+	}
+	return nil
+}
+
+// The players at each position on each side, in rosterPositions order, as
+// sent to clients.
+type Lineup struct {
+	Blue [5]playerData `json:"blue"`
+	Gold [5]playerData `json:"gold"`
+}
+
+// A cabinet's lineup, as assigned for the match and as filled in from the
+// roster.
+type LineupView struct {
+	Assigned LineupUpdate
+	Players  Lineup
+}
+
+// Fills in a team's positions. Players assigned for the match come first,
+// then players in their usual roster positions, then the rest of the roster
+// in order.
+func fillLineup(assigned []string, roster []playerData) [5]playerData {
+	var lineup [5]playerData
+	used := make(map[string]bool)
+	for i, name := range assigned {
+		if name == "" || i >= len(lineup) {
+			continue
+		}
+		lineup[i] = playerData{Name: name, PhotoUri: getPlayerPhotoUri(name)}
+		for _, pd := range roster {
+			if pd.Name == name {
+				lineup[i] = pd
+			}
+		}
+		used[name] = true
+	}
+	for i := range lineup {
+		if lineup[i].Name != "" {
+			continue
+		}
+		for _, pd := range roster {
+			if !used[pd.Name] && pd.Position == rosterPositions[i] {
+				lineup[i] = pd
+				used[pd.Name] = true
+				break
+			}
+		}
+	}
+	for i := range lineup {
+		if lineup[i].Name != "" {
+			continue
+		}
+		for _, pd := range roster {
+			if !used[pd.Name] && pd.Position == "" {
+				lineup[i] = pd
+				used[pd.Name] = true
+				break
+			}
+		}
+	}
+	return lineup
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// Serves the match control REST API under /api/match. Every route takes an
+// optional `cab` query parameter to pick the cabinet, like the web pages.
+//
+//	GET  /api/match              The whole match state, as matchState.
+//	GET  /api/match/teams        The current teams, as matchSides.
+//	PUT  /api/match/teams
+//	GET  /api/match/scores       The current scores, as matchScores.
+//	PUT  /api/match/scores
+//	GET  /api/match/victoryRule  The victory rule, as victoryRuleJSON.
+//	PUT  /api/match/victoryRule
+//	GET  /api/match/games        The games recorded in the match, as []GameResult.
+//	GET  /api/match/lineup       The players assigned to each position, as LineupUpdate.
+//	PUT  /api/match/lineup
+//	GET  /api/match/onDeck       The teams playing next, as matchSides.
+//	PUT  /api/match/onDeck
+//	POST /api/match/advance      Moves to the next match.
+//	POST /api/match/swapSides    Switches which team is on which side.
+//	POST /api/match/undo         Removes the last recorded game, if any.
+//	GET  /api/match/bracket      The bracket being played, as *BracketView.
+//	GET  /api/match/standings    The round robin standings, as *StandingsView.
+//	PUT  /api/match/tournament   Starts a tournament, from a TournamentSetup.
+//	GET  /api/match/teamSides    Which team is on the left of the cabinet, as teamSidesJSON.
+//	PUT  /api/match/teamSides
+//
+// PUT routes respond with the new value, and POST routes with the new match
+// state. Changes go through the same control events as the websocket control
+// section, so connected overlays update as usual.
+//
+// Reading requires the overlay role, and changes require the operator role.
+type matchAPI struct {
+	trackers       map[string]gameTracker
+	sides          map[string]*tracking.TeamSides
+	defaultCabinet string
+	auth           *authenticator
+	audit          *auditLog
+	eventStream    EventStream
+}
+
+type matchSides struct {
+	Blue string `json:"blue"`
+	Gold string `json:"gold"`
+}
+
+type matchScores struct {
+	Blue int `json:"blue"`
+	Gold int `json:"gold"`
+}
+
+// The JSON form of a MatchVictoryRule, as also used by the websocket control
+// section. A BestOfN with length 0 means there is no limit.
+type victoryRuleJSON struct {
+	Rule   string `json:"rule"`
+	Length int    `json:"length"`
+}
+
+// Which side of a cabinet each team is on, as also used by the websocket
+// control and currentMatch sections. When setting the sides, leftTeam may also
+// be "auto" to detect them, and detect is ignored.
+type teamSidesJSON struct {
+	LeftTeam string `json:"leftTeam"` // "blue" or "gold".
+	Detect   bool   `json:"detect"`   // Whether the sides are detected from games.
+}
+
+func teamSidesToJSON(s *tracking.TeamSides) teamSidesJSON {
+	return teamSidesJSON{s.LeftTeam().String(), s.Detecting()}
+}
+
+type matchState struct {
+	Cabinet     string          `json:"cabinet"`
+	Teams       matchSides      `json:"teams"`
+	Scores      matchScores     `json:"scores"`
+	VictoryRule victoryRuleJSON `json:"victoryRule"`
+	Games       []GameResult    `json:"games"`
+	Lineup      LineupUpdate    `json:"lineup"`
+	OnDeck      matchSides      `json:"onDeck"`
+}
+
+func victoryRuleToJSON(vr MatchVictoryRule) victoryRuleJSON {
+	switch vr := vr.(type) {
+	case BestOfN:
+		return victoryRuleJSON{"BestOfN", int(vr)}
+	case StraightN:
+		return victoryRuleJSON{"StraightN", int(vr)}
+	}
+	return victoryRuleJSON{}
+}
+
+func (vr victoryRuleJSON) rule() (MatchVictoryRule, error) {
+	if vr.Length < 0 {
+		return nil, fmt.Errorf("invalid length %d", vr.Length)
+	}
+	switch vr.Rule {
+	case "BestOfN":
+		return BestOfN(vr.Length), nil
+	case "StraightN":
+		return StraightN(vr.Length), nil
+	}
+	return nil, fmt.Errorf("unknown rule %q", vr.Rule)
+}
+
+func (api *matchAPI) state(cabinet string, tracker gameTracker) matchState {
+	var s matchState
+	s.Cabinet = cabinet
+	s.Teams.Blue, s.Teams.Gold = tracker.CurrentTeams()
+	s.Scores.Blue, s.Scores.Gold = tracker.Scores()
+	s.VictoryRule = victoryRuleToJSON(tracker.VictoryRule())
+	s.Games = tracker.Games()
+	s.Lineup = tracker.Lineup()
+	s.OnDeck.Blue, s.OnDeck.Gold = tracker.OnDeckTeams()
+	return s
+}
+
+// Sends control commands for the cabinet and waits for the server to apply
+// them. Returns an error if any could not be applied.
+func (api *matchAPI) apply(req *http.Request, cabinet string, commands ...ControlCommand) error {
+	user, role := api.auth.identify(req)
+	api.audit.Record(user, role, req.RemoteAddr, "http", cabinet, commands)
+	e := NewControlEvent(cabinet, commands)
+	done := make(chan struct{})
+	e.Data[ControlDoneKey] = done
+	api.eventStream.AddEvent(e)
+	<-done
+	err, _ := e.Data[ControlErrorKey].(error)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Decodes a request body, replying with an error if it is invalid.
+func readJSON(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (api *matchAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	route := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/api/match"), "/")
+	method := req.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	required := OperatorRole
+	if method == http.MethodGet {
+		required = OverlayRole
+	}
+	if _, _, ok := api.auth.authorize(w, req, required); !ok {
+		return
+	}
+	// Only look at the query, since the body is the request's JSON value.
+	// Checked after authorizing, so unauthorized clients can't probe for
+	// cabinet names.
+	cabinet := req.URL.Query().Get("cab")
+	if cabinet == "" {
+		cabinet = api.defaultCabinet
+	}
+	tracker, ok := api.trackers[cabinet]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown cabinet %q", cabinet), http.StatusNotFound)
+		return
+	}
+	switch route + " " + method {
+	case " GET":
+		writeJSON(w, api.state(cabinet, tracker))
+
+	case "/teams GET":
+		var t matchSides
+		t.Blue, t.Gold = tracker.CurrentTeams()
+		writeJSON(w, t)
+	case "/teams PUT":
+		var t matchSides
+		if !readJSON(w, req, &t) {
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetCurrentTeams, TeamUpdate{t.Blue, t.Gold}}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Blue, t.Gold = tracker.CurrentTeams()
+		writeJSON(w, t)
+
+	case "/scores GET":
+		var s matchScores
+		s.Blue, s.Gold = tracker.Scores()
+		writeJSON(w, s)
+	case "/scores PUT":
+		var s matchScores
+		if !readJSON(w, req, &s) {
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetScores, ScoreUpdate{s.Blue, s.Gold}}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Blue, s.Gold = tracker.Scores()
+		writeJSON(w, s)
+
+	case "/victoryRule GET":
+		writeJSON(w, victoryRuleToJSON(tracker.VictoryRule()))
+	case "/victoryRule PUT":
+		var vr victoryRuleJSON
+		if !readJSON(w, req, &vr) {
+			return
+		}
+		rule, err := vr.rule()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetVictoryRule, rule}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, victoryRuleToJSON(tracker.VictoryRule()))
+
+	case "/games GET":
+		writeJSON(w, tracker.Games())
+
+	case "/lineup GET":
+		writeJSON(w, tracker.Lineup())
+	case "/lineup PUT":
+		var u LineupUpdate
+		if !readJSON(w, req, &u) {
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetLineup, u}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, tracker.Lineup())
+
+	case "/bracket GET":
+		writeJSON(w, tracker.Bracket())
+	case "/standings GET":
+		writeJSON(w, tracker.Standings())
+	case "/tournament PUT":
+		var setup TournamentSetup
+		if !readJSON(w, req, &setup) {
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetTournament, setup}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, api.state(cabinet, tracker))
+
+	case "/onDeck GET":
+		var t matchSides
+		t.Blue, t.Gold = tracker.OnDeckTeams()
+		writeJSON(w, t)
+	case "/onDeck PUT":
+		var t matchSides
+		if !readJSON(w, req, &t) {
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetOnDeckTeams, TeamUpdate{t.Blue, t.Gold}}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Blue, t.Gold = tracker.OnDeckTeams()
+		writeJSON(w, t)
+
+	case "/teamSides GET":
+		writeJSON(w, teamSidesToJSON(api.sides[cabinet]))
+	case "/teamSides PUT":
+		var ts teamSidesJSON
+		if !readJSON(w, req, &ts) {
+			return
+		}
+		if err := api.apply(req, cabinet, ControlCommand{SetTeamSides, ts.LeftTeam}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, teamSidesToJSON(api.sides[cabinet]))
+
+	case "/advance POST":
+		if err := api.apply(req, cabinet, ControlCommand{AdvanceMatch, nil}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, api.state(cabinet, tracker))
+	case "/swapSides POST":
+		if err := api.apply(req, cabinet, ControlCommand{SwapSides, nil}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, api.state(cabinet, tracker))
+	case "/undo POST":
+		if err := api.apply(req, cabinet, ControlCommand{UndoLastGame, nil}); err == errNoGameToUndo {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, api.state(cabinet, tracker))
+
+	default:
+		if allow, ok := matchAPIMethods[route]; ok {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		} else {
+			http.NotFound(w, req)
+		}
+	}
+}
+
+// The methods each route accepts, for the Allow header. HEAD is served like
+// GET.
+var matchAPIMethods = map[string]string{
+	"":             "GET, HEAD",
+	"/teams":       "GET, HEAD, PUT",
+	"/scores":      "GET, HEAD, PUT",
+	"/victoryRule": "GET, HEAD, PUT",
+	"/games":       "GET, HEAD",
+	"/lineup":      "GET, HEAD, PUT",
+	"/bracket":     "GET, HEAD",
+	"/standings":   "GET, HEAD",
+	"/tournament":  "PUT",
+	"/onDeck":      "GET, HEAD, PUT",
+	"/teamSides":   "GET, HEAD, PUT",
+	"/advance":     "POST",
+	"/swapSides":   "POST",
+	"/undo":        "POST",
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Optional steps taken automatically as the games of a match are recorded, so
+// operators do not have to remember them.
+type MatchAutomation struct {
+	// Advance to the on deck match once the current match is complete.
+	AutoAdvance bool
+	// How long to show the result of a match before advancing, in seconds.
+	AdvanceDelaySeconds float64
+	// Swap which team is on which side after every game until the match is
+	// complete.
+	SwapSidesBetweenGames bool
+}
+
+func (a MatchAutomation) advanceDelay() time.Duration {
+	if !a.AutoAdvance {
+		return 0
+	}
+	return time.Duration(a.AdvanceDelaySeconds * float64(time.Second))
+}
+
+// Applies a MatchAutomation to the server's cabinets. Only used by the
+// goroutine processing server events.
+type matchAutomator struct {
+	MatchAutomation
+	eventStream EventStream
+	// Each cabinet's finished match waiting to be advanced.
+	pending map[string]*pendingAdvance
+	// Identifies the next scheduled advance.
+	nextToken int
+}
+
+// A scheduled advance past a finished match. The timer's command carries the
+// token, so a timer from an earlier schedule of the same match is ignored even
+// if it fires before it is stopped.
+type pendingAdvance struct {
+	matchNumber int
+	token       int
+	timer       *time.Timer
+}
+
+func newMatchAutomator(config MatchAutomation, eventStream EventStream) *matchAutomator {
+	return &matchAutomator{config, eventStream, make(map[string]*pendingAdvance), 0}
+}
+
+// Called before recording a game for the cabinet. If the previous match is
+// still waiting to advance, the game belongs to the next match, so advances
+// now.
+func (a *matchAutomator) beforeGame(cabinet string, tracker gameTracker, e *Event) {
+	if p, ok := a.pending[cabinet]; ok {
+		a.advance(cabinet, tracker, p.matchNumber, e)
+	}
+}
+
+// Called after recording a game for the cabinet, with the event being
+// processed. When the match is complete, it is marked final, the event
+// announces the result, and the advance is scheduled. Otherwise, the teams
+// swap sides if configured.
+func (a *matchAutomator) gameRecorded(cabinet string, tracker gameTracker, e *Event) {
+	delay := a.advanceDelay()
+	matchNumber, complete, finished := tracker.FinishMatch(delay, e)
+	if !complete {
+		if a.SwapSidesBetweenGames {
+			tracker.SwapSides(e)
+		}
+		return
+	}
+	if !finished || !a.AutoAdvance {
+		return
+	}
+	a.schedule(cabinet, matchNumber, delay)
+}
+
+// Called after the current match is changed by hand, by setting its scores or
+// victory rule or undoing a game. A match which became complete is finished as
+// if by a game, and one which is no longer complete is reopened.
+func (a *matchAutomator) matchChanged(cabinet string, tracker gameTracker, e *Event) {
+	delay := a.advanceDelay()
+	matchNumber, complete, finished := tracker.FinishMatch(delay, e)
+	if !complete {
+		a.cancel(cabinet)
+	} else if finished && a.AutoAdvance {
+		a.schedule(cabinet, matchNumber, delay)
+	}
+}
+
+// Called for each cabinet when the server starts. If the cabinet resumed a
+// complete match, the advance is scheduled again.
+func (a *matchAutomator) resumed(cabinet string, tracker gameTracker) {
+	if !a.AutoAdvance {
+		return
+	}
+	delay := a.advanceDelay()
+	if matchNumber, complete, _ := tracker.FinishMatch(delay, nil); complete {
+		a.schedule(cabinet, matchNumber, delay)
+	}
+}
+
+// Schedules advancing the cabinet past the given match after the delay,
+// replacing any advance already scheduled.
+func (a *matchAutomator) schedule(cabinet string, matchNumber int, delay time.Duration) {
+	fmt.Printf("Match complete; advancing in %v\n", delay)
+	a.cancel(cabinet)
+	a.nextToken++
+	token := a.nextToken
+	// The event stream is read by the caller, so the event must be added
+	// from another goroutine.
+	timer := time.AfterFunc(delay, func() {
+		a.eventStream.AddEvent(NewControlEvent(cabinet, []ControlCommand{
+			{AutoAdvanceMatch, token},
+		}))
+	})
+	a.pending[cabinet] = &pendingAdvance{matchNumber, token, timer}
+}
+
+// Cancels the cabinet's scheduled advance, if any. Called when its match is
+// reopened.
+func (a *matchAutomator) cancel(cabinet string) {
+	if p, ok := a.pending[cabinet]; ok {
+		p.timer.Stop()
+		delete(a.pending, cabinet)
+	}
+}
+
+// Handles the command sent by a scheduled advance. Does nothing unless the
+// advance is still the one scheduled for the cabinet.
+func (a *matchAutomator) scheduledAdvance(cabinet string, tracker gameTracker, token int, e *Event) {
+	if p, ok := a.pending[cabinet]; ok && p.token == token {
+		a.advance(cabinet, tracker, p.matchNumber, e)
+	}
+}
+
+// Advances the cabinet past the given finished match, unless it has already
+// moved on or been reopened.
+func (a *matchAutomator) advance(cabinet string, tracker gameTracker, matchNumber int, e *Event) {
+	if p, ok := a.pending[cabinet]; ok && p.matchNumber == matchNumber {
+		a.cancel(cabinet)
+	}
+	tracker.AdvanceFinishedMatch(matchNumber, e)
+}
+
+// The form of a MatchComplete sent to websocket clients.
+func matchCompleteJSON(mc MatchComplete) map[string]interface{} {
+	d := map[string]interface{}{
+		"teams":  map[string]interface{}{"blue": mc.Teams.Blue, "gold": mc.Teams.Gold},
+		"scores": map[string]interface{}{"blue": mc.Scores.Blue, "gold": mc.Scores.Gold},
+	}
+	if mc.Winner != "" {
+		d["winner"] = mc.Winner
+	}
+	if mc.AdvanceDelay > 0 {
+		d["advanceDelaySeconds"] = mc.AdvanceDelay.Seconds()
+	}
+	return d
+}
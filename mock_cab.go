@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/maps"
+)
+
+// Runs a fake cabinet, serving the cabinet websocket protocol so that kq-live
+// (or any other client) can connect to it as if it were real. Each connection
+// gets its own message source, either a recorded log or synthesized games.
+func runMockCab(args []string) {
+	flags := flag.NewFlagSet("mockcab", flag.ExitOnError)
+	port := flags.Int("port", 12749, "the port number to listen on")
+	logPath := flags.String("log", "", "the path to a recorded cabinet log to serve; if empty, games are synthesized")
+	speed := flags.Float64("speed", 1, "the playback speed multiplier; 1 is real time, 0 sends as fast as possible")
+	seed := flags.Int64("seed", 0, "the random seed for synthesized games; 0 picks a seed from the current time")
+	flags.Parse(args)
+
+	cab := &mockCab{
+		newSource: func() (kqio.MessageStringReader, error) {
+			if *logPath != "" {
+				return openReplay(*logPath, *speed)
+			}
+			s := *seed
+			if s == 0 {
+				s = time.Now().UnixNano()
+			}
+			return &replayReader{MessageStringReader: newGameSynthesizer(s), speed: *speed}, nil
+		},
+	}
+	addr := fmt.Sprintf(":%d", *port)
+	fmt.Fprintln(logOut, "Mock cabinet listening on", addr)
+	panic(http.ListenAndServe(addr, cab))
+}
+
+// An http.Handler which accepts cabinet websocket connections and sends
+// messages from a new source to each one.
+type mockCab struct {
+	newSource func() (kqio.MessageStringReader, error)
+	upgrader  websocket.Upgrader
+}
+
+func (mc *mockCab) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	src, err := mc.newSource()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	conn, err := mc.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintln(logOut, "Mock cabinet client connected from", req.RemoteAddr)
+
+	// Clients reply to "alive" messages. The replies are not checked, but they
+	// must be read for the connection to notice the client closing.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var msg kqio.MessageString
+	for {
+		select {
+		case <-closed:
+			fmt.Fprintln(logOut, "Mock cabinet client disconnected")
+			return
+		default:
+		}
+		if err := src.ReadMessageString(&msg); err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(logOut, "Mock cabinet source failed:", err)
+			}
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, msg.Message); err != nil {
+			fmt.Fprintln(logOut, err)
+			return
+		}
+	}
+}
+
+// Synthesizes an endless series of plausible games. The games are not
+// realistic, but they contain the same kinds of messages as a real cabinet in
+// a sensible order, so everything downstream has something to track.
+//
+// Message times come from a simulated clock starting at the time the
+// synthesizer was created, so they can be paced by a replayReader.
+type gameSynthesizer struct {
+	rng     *rand.Rand
+	now     time.Time
+	pending []kqio.MessageString
+
+	nextAlive time.Time
+	gameStart time.Time
+	m         Map
+	meta      *maps.MapMetadata
+
+	berries, queenDeaths [3]int // Indexed by Side.
+	warrior              [NumPlayers]bool
+	snailX               int
+	rider                PlayerId
+}
+
+// The maps synthesized games are played on. The bonus maps are left out, since
+// their layouts are not known.
+var synthesizedMaps = []Map{DayMap, NightMap, DuskMap}
+
+func newGameSynthesizer(seed int64) *gameSynthesizer {
+	now := time.Now()
+	return &gameSynthesizer{rng: rand.New(rand.NewSource(seed)), now: now, nextAlive: now}
+}
+
+func (g *gameSynthesizer) ReadMessageString(out *kqio.MessageString) error {
+	for len(g.pending) == 0 {
+		g.step()
+	}
+	*out = g.pending[0]
+	g.pending = g.pending[1:]
+	return nil
+}
+
+func (g *gameSynthesizer) emit(key string, format string, args ...interface{}) {
+	// Alive messages are interleaved based on the simulated clock.
+	for !g.nextAlive.After(g.now) {
+		g.pending = append(g.pending, kqio.MessageString{
+			Time:    g.nextAlive,
+			Message: []byte(fmt.Sprintf("![k[alive],v[%s]]!", g.nextAlive.Format("3:04:05 PM"))),
+		})
+		g.nextAlive = g.nextAlive.Add(5 * time.Second)
+	}
+	g.pending = append(g.pending, kqio.MessageString{
+		Time:    g.now,
+		Message: []byte(fmt.Sprintf("![k[%s],v[%s]]!", key, fmt.Sprintf(format, args...))),
+	})
+}
+
+func (g *gameSynthesizer) wait(min, max time.Duration) {
+	g.now = g.now.Add(min + time.Duration(g.rng.Int63n(int64(max-min)+1)))
+}
+
+func (g *gameSynthesizer) randomPlayer(side Side, queen bool) PlayerId {
+	if queen {
+		if side == GoldSide {
+			return GoldQueen
+		}
+		return BlueQueen
+	}
+	p := PlayerId(3 + 2*g.rng.Intn(4))
+	if side == BlueSide {
+		p++
+	}
+	return p
+}
+
+// Picks a drone on the side, other than the one given, or returns false if
+// there is none.
+func (g *gameSynthesizer) randomDrone(side Side, not PlayerId) (PlayerId, bool) {
+	var drones []PlayerId
+	for p := PlayerId(3); p <= NumPlayers; p++ {
+		if p.Team() == side && p != not && !g.warrior[p.Index()] {
+			drones = append(drones, p)
+		}
+	}
+	if len(drones) == 0 {
+		return 0, false
+	}
+	return drones[g.rng.Intn(len(drones))], true
+}
+
+func (g *gameSynthesizer) randomSide() Side {
+	if g.rng.Intn(2) == 0 {
+		return BlueSide
+	}
+	return GoldSide
+}
+
+func sideName(s Side) string {
+	if s == BlueSide {
+		return "Blue"
+	}
+	return "Gold"
+}
+
+func (g *gameSynthesizer) snailY() int {
+	return g.meta.Snails[0].Nets[0].Y
+}
+
+func (g *gameSynthesizer) step() {
+	if g.gameStart.IsZero() {
+		g.startGame()
+		return
+	}
+	switch r := g.rng.Intn(100); {
+	case r < 40:
+		g.runBerry()
+	case r < 55:
+		g.useGate()
+	case r < 85:
+		g.fight()
+	default:
+		g.rideSnail()
+	}
+}
+
+func (g *gameSynthesizer) startGame() {
+	g.wait(10*time.Second, 30*time.Second)
+	g.m = synthesizedMaps[g.rng.Intn(len(synthesizedMaps))]
+	g.meta = maps.MetadataForMap(g.m)
+	g.berries = [3]int{}
+	g.queenDeaths = [3]int{}
+	g.warrior = [NumPlayers]bool{}
+	g.rider = 0
+	g.snailX = (g.meta.Snails[0].Nets[0].X + g.meta.Snails[0].Nets[1].X) / 2
+	for i := 1; i <= NumPlayers; i++ {
+		g.emit("spawn", "%d,False", i)
+		g.wait(0, 300*time.Millisecond)
+	}
+	g.emit("playernames", ",,,,,,,,,")
+	g.wait(time.Second, 3*time.Second)
+	g.emit("gamestart", "map_%v,False,0,False", g.m)
+	g.gameStart = g.now
+}
+
+func (g *gameSynthesizer) endGame(winner Side, how WinType) {
+	g.getOffSnail()
+	dur := g.now.Sub(g.gameStart)
+	g.emit("gameend", "map_%v,False,%.3f,False", g.m, dur.Seconds())
+	g.emit("victory", "%s,%v", sideName(winner), how)
+	g.gameStart = time.Time{}
+}
+
+func (g *gameSynthesizer) runBerry() {
+	side := g.randomSide()
+	p := g.randomPlayer(side, false)
+	if g.warrior[p.Index()] || p == g.rider {
+		return
+	}
+	g.wait(time.Second, 4*time.Second)
+	g.emit("carryFood", "%d", p)
+	g.wait(2*time.Second, 8*time.Second)
+	x := 100 + g.rng.Intn(200)
+	if side == GoldSide {
+		x = 1920 - x
+	}
+	if g.rng.Intn(10) == 0 {
+		g.emit("berryKickIn", "%d,%d,%d", x, 800, p)
+	} else {
+		g.emit("berryDeposit", "%d,%d,%d", x, 800, p)
+	}
+	g.berries[side]++
+	if g.berries[side] >= 12 {
+		g.endGame(side, EconomicWin)
+	}
+}
+
+func (g *gameSynthesizer) useGate() {
+	side := g.randomSide()
+	p := g.randomPlayer(side, false)
+	if g.warrior[p.Index()] || p == g.rider {
+		return
+	}
+	gate := g.meta.WarriorGates[g.rng.Intn(len(g.meta.WarriorGates))].Pos
+	g.wait(time.Second, 5*time.Second)
+	g.emit("carryFood", "%d", p)
+	g.wait(time.Second, 5*time.Second)
+	g.emit("blessMaiden", "%d,%d,%s", gate.X, gate.Y, sideName(side))
+	g.emit("reserveMaiden", "%d,%d,%d", gate.X, gate.Y, p)
+	g.wait(3*time.Second, 3500*time.Millisecond)
+	g.emit("useMaiden", "%d,%d,maiden_wings,%d", gate.X, gate.Y, p)
+	g.warrior[p.Index()] = true
+}
+
+func (g *gameSynthesizer) fight() {
+	killerSide := g.randomSide()
+	victimSide := BlueSide
+	if killerSide == BlueSide {
+		victimSide = GoldSide
+	}
+	killer := g.randomPlayer(killerSide, g.rng.Intn(3) == 0)
+	if !killer.IsQueen() && !g.warrior[killer.Index()] {
+		// Drones can only bump.
+		g.wait(500*time.Millisecond, 2*time.Second)
+		g.emit("glance", "%d,%d", killer, g.randomPlayer(victimSide, false))
+		return
+	}
+	victim := g.randomPlayer(victimSide, g.rng.Intn(4) == 0)
+	if victim == g.rider {
+		g.getOffSnail()
+	}
+	g.wait(500*time.Millisecond, 3*time.Second)
+	var typ string
+	switch {
+	case victim.IsQueen():
+		typ = "Queen"
+	case g.warrior[victim.Index()]:
+		typ = "Soldier"
+	default:
+		typ = "Worker"
+	}
+	g.emit("playerKill", "%d,%d,%d,%d,%s", 400+g.rng.Intn(1120), 500, killer, victim, typ)
+	g.warrior[victim.Index()] = false
+	if victim.IsQueen() {
+		g.queenDeaths[victimSide]++
+		if g.queenDeaths[victimSide] >= g.meta.QueenLives {
+			g.endGame(killerSide, MilitaryWin)
+		}
+	}
+}
+
+func (g *gameSynthesizer) getOffSnail() {
+	if g.rider == 0 {
+		return
+	}
+	g.emit("getOffSnail: ", "%d,%d,,%d", g.snailX, g.snailY(), g.rider)
+	g.rider = 0
+}
+
+func (g *gameSynthesizer) rideSnail() {
+	nets := g.meta.Snails[0].Nets
+	if g.rider == 0 {
+		side := g.randomSide()
+		p := g.randomPlayer(side, false)
+		if g.warrior[p.Index()] {
+			return
+		}
+		g.wait(2*time.Second, 6*time.Second)
+		g.rider = p
+		g.emit("getOnSnail: ", "%d,%d,%d", g.snailX, g.snailY(), p)
+		return
+	}
+
+	side := g.rider.Team()
+	dir := 1
+	if side == BlueSide {
+		dir = -1
+	}
+	ride := 2*time.Second + time.Duration(g.rng.Int63n(int64(8*time.Second)))
+	g.wait(ride, ride)
+	g.snailX += dir * int(21*ride.Seconds())
+	if g.snailX <= nets[0].X || g.snailX >= nets[1].X {
+		if g.snailX <= nets[0].X {
+			g.snailX = nets[0].X
+		} else {
+			g.snailX = nets[1].X
+		}
+		g.endGame(side, SnailWin)
+		return
+	}
+
+	switch g.rng.Intn(3) {
+	case 0:
+		// Eat an opposing drone, who may be rescued.
+		other := BlueSide
+		if side == BlueSide {
+			other = GoldSide
+		}
+		snack := g.randomPlayer(other, false)
+		if g.warrior[snack.Index()] {
+			g.getOffSnail()
+			return
+		}
+		g.emit("snailEat", "%d,%d,%d,%d", g.snailX, g.snailY(), g.rider, snack)
+		// Another drone may rescue the snack by knocking off the rider.
+		rescuer, canRescue := g.randomDrone(other, snack)
+		if canRescue && g.rng.Intn(3) == 0 {
+			g.wait(500*time.Millisecond, 3*time.Second)
+			g.emit("snailEscape", "%d,%d,%d", g.snailX+50*dir, g.snailY(), snack)
+			rider := g.rider
+			g.getOffSnail()
+			g.emit("playerKill", "%d,%d,%d,%d,Worker", g.snailX, g.snailY()+9, rescuer, rider)
+		} else {
+			g.wait(3500*time.Millisecond, 3500*time.Millisecond)
+			g.emit("playerKill", "%d,%d,%d,%d,Worker", g.snailX, g.snailY()+9, g.rider, snack)
+		}
+	default:
+		g.getOffSnail()
+	}
+}
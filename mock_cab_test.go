@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kq "github.com/ughoavgfhw/libkq"
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/maps"
+	"github.com/ughoavgfhw/libkq/parser"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// Sends numbered alive messages at a steady pace, forever.
+type countingSource struct {
+	conn, n int
+}
+
+func (s *countingSource) ReadMessageString(out *kqio.MessageString) error {
+	time.Sleep(5 * time.Millisecond)
+	s.n++
+	*out = kqio.MessageString{
+		Time:    time.Now(),
+		Message: []byte(fmt.Sprintf("![k[alive],v[%d.%d]]!", s.conn, s.n)),
+	}
+	return nil
+}
+
+// A listener which remembers its connections, so they can be dropped without
+// a websocket close even after being hijacked.
+type droppingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *droppingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *droppingListener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+func startMockCab(t *testing.T, cab *mockCab, addr string) (*httptest.Server, *droppingListener) {
+	s := httptest.NewUnstartedServer(cab)
+	if addr != "" {
+		s.Listener.Close()
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Listener = l
+	}
+	l := &droppingListener{Listener: s.Listener}
+	s.Listener = l
+	s.Start()
+	return s, l
+}
+
+func TestMockCabReconnect(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	cab := &mockCab{
+		newSource: func() (kqio.MessageStringReader, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			connections++
+			return &countingSource{conn: connections}, nil
+		},
+	}
+	server, listener := startMockCab(t, cab, "")
+	addr := server.Listener.Addr().String()
+	url := "ws://" + addr
+
+	conn := delay(&autoConnector{nil, func() (*kqio.CabConnection, error) {
+		return kqio.Connect(url)
+	}}, 10*time.Millisecond)
+
+	var msg kqio.MessageString
+	// Reads messages until one from the given connection arrives, skipping
+	// any left over from an earlier one.
+	readFrom := func(want int) {
+		prefix := fmt.Sprintf("![k[alive],v[%d.", want)
+		for i := 0; ; i++ {
+			if i > 1000 {
+				t.Fatalf("no messages from connection %d", want)
+			}
+			if err := conn.ReadMessageString(&msg); err != nil {
+				t.Fatalf("read failed before the connection was dropped: %v", err)
+			}
+			if strings.HasPrefix(string(msg.Message), prefix) {
+				return
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		readFrom(1)
+	}
+
+	// Drop the connection without a websocket close, as if the cabinet lost
+	// power. The reader reports the error once, then reconnects.
+	server.Close()
+	listener.dropAll()
+	for i := 0; ; i++ {
+		if i > 1000 {
+			t.Fatal("dropping the connection did not cause a read error")
+		}
+		if err := conn.ReadMessageString(&msg); err != nil {
+			break
+		}
+	}
+	server, listener = startMockCab(t, cab, addr)
+	defer server.Close()
+	defer listener.dropAll()
+	for i := 0; i < 5; i++ {
+		readFrom(2)
+	}
+	conn.Close()
+}
+
+// Plays synthesized games through the real parser and tracker, checking that
+// each one is a game the tracker understands and that its result follows from
+// the state.
+func TestGameSynthesizer(t *testing.T) {
+	endings := make(map[WinType]bool)
+	for seed := int64(1); seed <= 10; seed++ {
+		reader := kq.NewCabinet(newGameSynthesizer(seed))
+		cab := tracking.NewGameTracker()
+		var log bytes.Buffer
+		cab.Log = &log
+		var msg kqio.Message
+		var escaped PlayerId
+		for games := 0; games < 10; {
+			if err := reader.ReadMessage(&msg); err != nil {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+			switch msg.Type {
+			case "snailEscape":
+				escaped = msg.Val.(parser.SnailEscapeEatMessage).Escapee
+			case "playerKill":
+				k := msg.Val.(parser.PlayerKillMessage)
+				players := cab.State().Players
+				victim := players[k.Victim.Index()]
+				if k.Killer.Team() == k.Victim.Team() || victim.Type != k.VictimType {
+					t.Errorf("seed %d: %v killed %v, a %v, as a %v", seed, k.Killer, k.Victim, victim.Type, k.VictimType)
+				}
+				// The drone which escaped the snail is rescued by another
+				// drone knocking off the rider.
+				if escaped != 0 {
+					if players[k.Killer.Index()].Type != Drone || k.Killer == escaped {
+						t.Errorf("seed %d: %v was rescued by %v, a %v", seed, escaped, k.Killer, players[k.Killer.Index()].Type)
+					}
+					escaped = 0
+				}
+			}
+			cab.Apply(msg)
+			state := cab.State()
+			for i, p := range state.Players {
+				if p.OnSnail != 0 && p.Type != Drone {
+					t.Errorf("seed %d: %v is riding the snail as a %v", seed, PlayerId(i+1), p.Type)
+				}
+			}
+			if msg.Type != "victory" {
+				continue
+			}
+			games++
+			endings[state.EndCondition] = true
+			checkSynthesizedResult(t, seed, &state)
+		}
+		for _, line := range strings.Split(log.String(), "\n") {
+			if strings.HasPrefix(line, "Unhandled") {
+				t.Errorf("seed %d: %s", seed, line)
+			}
+		}
+	}
+	for _, w := range []WinType{EconomicWin, MilitaryWin, SnailWin} {
+		if !endings[w] {
+			t.Errorf("no synthesized game ended by %v", w)
+		}
+	}
+}
+
+func checkSynthesizedResult(t *testing.T, seed int64, state *kq.GameState) {
+	t.Helper()
+	known := false
+	for _, m := range synthesizedMaps {
+		known = known || m == state.Map
+	}
+	if !known || state.Start.IsZero() {
+		t.Errorf("seed %d: game on %v started at %v", seed, state.Map, state.Start)
+		return
+	}
+	winner, loser := &state.BlueTeam, &state.GoldTeam
+	if state.Winner == GoldSide {
+		winner, loser = loser, winner
+	}
+	switch state.EndCondition {
+	case EconomicWin:
+		if winner.BerriesIn < 12 {
+			t.Errorf("seed %d: economic win with %d berries", seed, winner.BerriesIn)
+		}
+	case MilitaryWin:
+		if lives := maps.MetadataForMap(state.Map).QueenLives; loser.QueenDeaths < lives {
+			t.Errorf("seed %d: military win after %d of %d queen deaths", seed, loser.QueenDeaths, lives)
+		}
+	case SnailWin:
+		// Snail positions are relative to the center, which is at MaxPos.
+		nets := maps.MetadataForMap(state.Map).Snails[0].Nets
+		if len(state.Snails) != 1 {
+			t.Errorf("seed %d: snail win with %d snails", seed, len(state.Snails))
+		} else if s := state.Snails[0]; s.Pos != nets[0].X-s.MaxPos && s.Pos != nets[1].X-s.MaxPos {
+			t.Errorf("seed %d: snail win with the snail at %d, not at a net", seed, s.Pos)
+		}
+	default:
+		t.Errorf("seed %d: game ended by %v", seed, state.EndCondition)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The models file maps model names to parameters. Each model names a built-in
+// model as its Base, and any other fields override that model's parameters:
+//
+//	{
+//		"heavySnail": {"Base": "multSqrt", "SnailWeight": 300},
+//		"noBonuses": {"Base": "sumLose", "BerryBonuses": [], "SnailBonuses": []}
+//	}
+//
+// Fields are those of ModelParams.
+
+type namedModel struct {
+	name  string
+	score StateScorer
+}
+
+var userModels struct {
+	sync.RWMutex
+	byName map[string]*ModelParams
+	names  []string // Sorted.
+}
+
+func lookupUserModel(name string) *ModelParams {
+	userModels.RLock()
+	defer userModels.RUnlock()
+	return userModels.byName[name]
+}
+
+// Returns the built-in models, then the trained model if one is loaded, then
+// the user-defined models.
+func allModels() []namedModel {
+	models := make([]namedModel, 0, len(builtinModelNames)+1)
+	for _, name := range builtinModelNames {
+		p, _ := builtinModelParams(name)
+		models = append(models, namedModel{name, p.Score})
+	}
+	if m := currentTrainedModel(); m != nil {
+		models = append(models, namedModel{TrainedModelName, m.Score})
+	}
+	userModels.RLock()
+	defer userModels.RUnlock()
+	for _, name := range userModels.names {
+		models = append(models, namedModel{name, userModels.byName[name].Score})
+	}
+	return models
+}
+
+// Returns the names of all models, in the same order as AllStateScores.
+func StateScorerNames() []string {
+	var names []string
+	for _, m := range allModels() {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+func parseModels(r io.Reader) (map[string]*ModelParams, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	models := make(map[string]*ModelParams)
+	for name, data := range raw {
+		if _, ok := builtinModelParams(name); ok || name == TrainedModelName {
+			return nil, fmt.Errorf("model %q has the same name as a built-in model", name)
+		}
+		var base struct{ Base string }
+		if err := json.Unmarshal(data, &base); err != nil {
+			return nil, fmt.Errorf("model %q: %v", name, err)
+		}
+		params, ok := builtinModelParams(base.Base)
+		if !ok {
+			return nil, fmt.Errorf("model %q: unknown base model %q", name, base.Base)
+		}
+		// Unmarshaling over the base parameters only replaces the fields
+		// which are present. Base itself is not a parameter, so it is
+		// ignored here.
+		if err := json.Unmarshal(data, params); err != nil {
+			return nil, fmt.Errorf("model %q: %v", name, err)
+		}
+		if err := params.validate(); err != nil {
+			return nil, fmt.Errorf("model %q: %v", name, err)
+		}
+		models[name] = params
+	}
+	return models, nil
+}
+
+func (p *ModelParams) validate() error {
+	switch p.LoseCombine {
+	case "sum", "mult":
+	default:
+		return fmt.Errorf("unknown LoseCombine %q", p.LoseCombine)
+	}
+	switch p.LoseTransform {
+	case "", "sqrt", "cbrt":
+	default:
+		return fmt.Errorf("unknown LoseTransform %q", p.LoseTransform)
+	}
+	return nil
+}
+
+func setUserModels(models map[string]*ModelParams) {
+	var names []string
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	userModels.Lock()
+	defer userModels.Unlock()
+	userModels.byName = models
+	userModels.names = names
+}
+
+// Replaces the user-defined models with those in f. A nil file clears them.
+// If the file is invalid, the current models are kept.
+func loadModels(f *os.File) error {
+	if f == nil {
+		setUserModels(nil)
+		return nil
+	}
+	models, err := parseModels(f)
+	if err != nil {
+		return err
+	}
+	setUserModels(models)
+	return nil
+}
+
+// Loads the user-defined models from the file at path. A missing file is not
+// an error; there are just no user models.
+func loadModelsFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return loadModels(nil)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := loadModels(f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Loads the user-defined models from the file at path, then watches it for
+// changes.
+func LoadAndWatchModelsFile(path string) (*FileWatcher, error) {
+	if err := loadModelsFile(path); err != nil {
+		return nil, err
+	}
+	return WatchFile(path, func(f *os.File) {
+		if err := loadModels(f); err != nil {
+			fmt.Printf("Invalid %s, keeping the previous models: %v\n", path, err)
+		} else {
+			fmt.Println("Loaded models from", path)
+		}
+	}), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// Statistics summed over games, or averaged per game.
+type StatLine struct {
+	Kills          float64 `json:"kills"`
+	QueenKills     float64 `json:"queenKills"`
+	WarriorKills   float64 `json:"warriorKills"`
+	DroneKills     float64 `json:"droneKills"`
+	Deaths         float64 `json:"deaths"`
+	Berries        float64 `json:"berries"` // Berries run in.
+	BerriesKicked  float64 `json:"berriesKicked"`
+	SnailDistance  float64 `json:"snailDistance"`
+	WarriorSeconds float64 `json:"warriorSeconds"`
+	Assists        float64 `json:"assists"`
+	EatRescues     float64 `json:"eatRescues"`
+}
+
+func (l *StatLine) add(s *tracking.PlayerStat) {
+	l.Kills += float64(s.Kills)
+	l.QueenKills += float64(s.QueenKills)
+	l.WarriorKills += float64(s.WarriorKills)
+	l.DroneKills += float64(s.DroneKills)
+	l.Deaths += float64(s.Deaths)
+	l.Berries += float64(s.BerriesRun)
+	l.BerriesKicked += float64(s.BerriesKicked)
+	l.SnailDistance += float64(s.SnailDist)
+	l.WarriorSeconds += s.WarriorTime.Seconds()
+	l.Assists += float64(s.Assists)
+	l.EatRescues += float64(s.EatRescues)
+}
+
+// The value of the named statistic, using the JSON names. Returns false if
+// there is no such statistic.
+func (l *StatLine) get(name string) (float64, bool) {
+	switch name {
+	case "kills":
+		return l.Kills, true
+	case "queenKills":
+		return l.QueenKills, true
+	case "warriorKills":
+		return l.WarriorKills, true
+	case "droneKills":
+		return l.DroneKills, true
+	case "deaths":
+		return l.Deaths, true
+	case "berries":
+		return l.Berries, true
+	case "berriesKicked":
+		return l.BerriesKicked, true
+	case "snailDistance":
+		return l.SnailDistance, true
+	case "warriorSeconds":
+		return l.WarriorSeconds, true
+	case "assists":
+		return l.Assists, true
+	case "eatRescues":
+		return l.EatRescues, true
+	}
+	return 0, false
+}
+
+// A player's statistics over some set of games.
+type PlayerTotals struct {
+	Name     string   `json:"name"`
+	Team     string   `json:"team"` // The team in the player's latest game.
+	Games    int      `json:"games"`
+	Wins     int      `json:"wins"`
+	Totals   StatLine `json:"totals"`
+	Averages StatLine `json:"averages"` // Per game.
+}
+
+// Sums the statistics of every player over the games. Players are sorted by
+// the named statistic, highest first, then by name.
+func totalPlayerStats(games []GameRecord, sortBy string, perGame bool) []PlayerTotals {
+	byName := make(map[string]*PlayerTotals)
+	for i := range games {
+		g := &games[i]
+		for j := range g.Players {
+			p := &g.Players[j]
+			t := byName[p.Name]
+			if t == nil {
+				t = &PlayerTotals{Name: p.Name}
+				byName[p.Name] = t
+			}
+			t.Team = p.Team
+			t.Games++
+			if p.Side == g.Winner {
+				t.Wins++
+			}
+			t.Totals.add(&p.Stats)
+		}
+	}
+	totals := make([]PlayerTotals, 0, len(byName))
+	for _, t := range byName {
+		t.Averages = t.Totals
+		for _, v := range []*float64{
+			&t.Averages.Kills, &t.Averages.QueenKills, &t.Averages.WarriorKills,
+			&t.Averages.DroneKills, &t.Averages.Deaths, &t.Averages.Berries,
+			&t.Averages.BerriesKicked, &t.Averages.SnailDistance,
+			&t.Averages.WarriorSeconds, &t.Averages.Assists, &t.Averages.EatRescues,
+		} {
+			*v /= float64(t.Games)
+		}
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		a, b := &totals[i].Totals, &totals[j].Totals
+		if perGame {
+			a, b = &totals[i].Averages, &totals[j].Averages
+		}
+		av, _ := a.get(sortBy)
+		bv, _ := b.get(sortBy)
+		if av != bv {
+			return av > bv
+		}
+		return totals[i].Name < totals[j].Name
+	})
+	return totals
+}
+
+// Serves player statistics under /api/stats/players:
+//
+//	GET /api/stats/players?scope=event&sort=kills&perGame=1&limit=10
+//
+// The scope is "career" for every game in the store, "event" for games in the
+// current event (the default), or "match" for the current match of the
+// cabinet chosen by `cab`. Players are sorted by the named statistic from
+// StatLine, by total or per game average. The response is []PlayerTotals.
+type playerStatsAPI struct {
+	store          *gameStore
+	event          string
+	trackers       map[string]gameTracker
+	defaultCabinet string
+}
+
+func (api *playerStatsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	var include func(g *GameRecord) bool
+	switch scope := q.Get("scope"); scope {
+	case "career":
+		include = func(*GameRecord) bool { return true }
+	case "", "event":
+		include = func(g *GameRecord) bool { return g.Event == api.event }
+	case "match":
+		cabinet := q.Get("cab")
+		if cabinet == "" {
+			cabinet = api.defaultCabinet
+		}
+		tracker, ok := api.trackers[cabinet]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown cabinet %q", cabinet), http.StatusNotFound)
+			return
+		}
+		matchId := tracker.MatchId()
+		include = func(g *GameRecord) bool { return matchId != "" && g.MatchId == matchId }
+	default:
+		http.Error(w, fmt.Sprintf("unknown scope %q", scope), http.StatusBadRequest)
+		return
+	}
+	sortBy := q.Get("sort")
+	if sortBy == "" {
+		sortBy = "kills"
+	}
+	if _, ok := new(StatLine).get(sortBy); !ok {
+		http.Error(w, fmt.Sprintf("unknown statistic %q", sortBy), http.StatusBadRequest)
+		return
+	}
+	perGame, _ := strconv.ParseBool(q.Get("perGame"))
+	var games []GameRecord
+	for _, g := range api.store.Games(GameQuery{}) {
+		if include(&g) {
+			games = append(games, g)
+		}
+	}
+	totals := totalPlayerStats(games, sortBy, perGame)
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit >= 0 && limit < len(totals) {
+		totals = totals[:limit]
+	}
+	writeJSON(w, totals)
+}
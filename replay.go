@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/ughoavgfhw/libkq/io"
+)
+
+var replayFlag = flag.String("replay", "", "the path to a recorded cabinet log; if set, messages are read from the file instead of a cabinet")
+var replaySpeedFlag = flag.Float64("replaySpeed", 1, "the playback speed multiplier for -replay; 1 is real time, 0 replays as fast as possible")
+
+// Reads messages from a recorded log, pacing them according to their recorded
+// times. The pace is scaled by speed, so a speed of 2 replays at double speed.
+// A speed of zero or less does not wait at all.
+//
+// The message times are passed through unchanged, so downstream code sees the
+// same timestamps as when the log was recorded.
+type replayReader struct {
+	kqio.MessageStringReader
+	speed float64
+
+	start, first time.Time
+}
+
+func openReplay(path string, speed float64) (*replayReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &replayReader{MessageStringReader: kqio.NewMessageStringReader(f), speed: speed}, nil
+}
+
+func (r *replayReader) ReadMessageString(out *kqio.MessageString) error {
+	if err := r.MessageStringReader.ReadMessageString(out); err != nil {
+		return err
+	}
+	if r.speed <= 0 {
+		return nil
+	}
+	if r.first.IsZero() {
+		r.start = time.Now()
+		r.first = out.Time
+		return nil
+	}
+	offset := time.Duration(float64(out.Time.Sub(r.first)) / r.speed)
+	if wait := time.Until(r.start.Add(offset)); wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+func (r *replayReader) Close() error {
+	if c, ok := r.MessageStringReader.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Decides which messages count as ticks based on message times rather than the
+// wall clock, so that replays produce the same ticks at any speed.
+type messageTimeTicker struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (t *messageTimeTicker) Tick(when time.Time) bool {
+	if when.Sub(t.last) < t.interval {
+		return false
+	}
+	t.last = when
+	return true
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type teamList []string
+type playerData struct {
+	Name     string `json:"name"`
+	PhotoUri string `json:"photoUri,omitempty"`
+	Pronouns string `json:"pronouns,omitempty"`
+	Scene    string `json:"scene,omitempty"`
+	// The player's usual cabinet position, one of rosterPositions, or empty
+	// if not known.
+	Position string `json:"position,omitempty"`
+}
+
+// The cabinet positions on a team, in the order the game numbers them.
+var rosterPositions = []string{"queen", "stripes", "abs", "skulls", "checks"}
+
+// A roster file lists the teams and their players as JSON:
+//
+//	{"teams": [
+//		{"name": "Bees", "seed": 1, "players": [
+//			{"name": "Alice", "pronouns": "she/her", "scene": "Chicago",
+//			 "photo": "alice.jpg", "position": "queen"}
+//		]}
+//	]}
+type Roster struct {
+	Teams []RosterTeam `json:"teams"`
+}
+
+type RosterTeam struct {
+	Name string `json:"name"`
+	// Orders the team list, which is also the default seeding for
+	// tournaments. Teams without a seed come after seeded teams, in file
+	// order.
+	Seed    int            `json:"seed,omitempty"`
+	Players []RosterPlayer `json:"players"`
+}
+
+type RosterPlayer struct {
+	Name     string `json:"name"`
+	Pronouns string `json:"pronouns,omitempty"`
+	Scene    string `json:"scene,omitempty"`
+	// A file in the photos directory, or a URL. Defaults to the photo named
+	// after the player, if there is one.
+	Photo    string `json:"photo,omitempty"`
+	Position string `json:"position,omitempty"`
+}
+
+// The teams and players loaded from a roster file, along with any problems
+// found in it. Invalid entries are skipped, so the rest of the roster is still
+// usable.
+type loadedRoster struct {
+	teams   teamList
+	players map[string][]playerData
+	errors  []string
+}
+
+func (r *loadedRoster) errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// Parses a JSON roster.
+func parseRoster(data []byte) *loadedRoster {
+	r := &loadedRoster{players: make(map[string][]playerData)}
+	var roster Roster
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&roster); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(data[:se.Offset], []byte("\n"))
+			r.errorf("line %d: %v", line, err)
+		} else if te, ok := err.(*json.UnmarshalTypeError); ok {
+			line := 1 + bytes.Count(data[:te.Offset], []byte("\n"))
+			r.errorf("line %d: %s should be %v, not %s", line, te.Field, te.Type, te.Value)
+		} else {
+			r.errorf("%v", err)
+		}
+		return r
+	}
+
+	seeds := make(map[int]string)
+	var teams []RosterTeam
+	for i, t := range roster.Teams {
+		switch {
+		case t.Name == "":
+			r.errorf("team %d: missing name", i+1)
+			continue
+		case r.players[t.Name] != nil:
+			r.errorf("team %q: listed more than once", t.Name)
+			continue
+		case t.Seed < 0:
+			r.errorf("team %q: invalid seed %d", t.Name, t.Seed)
+			t.Seed = 0
+		case t.Seed > 0 && seeds[t.Seed] != "":
+			r.errorf("team %q: seed %d is already taken by %q", t.Name, t.Seed, seeds[t.Seed])
+			t.Seed = 0
+		case t.Seed > 0:
+			seeds[t.Seed] = t.Name
+		}
+		teams = append(teams, t)
+
+		players := make([]playerData, 0, len(t.Players))
+		positions := make(map[string]string)
+		for j, p := range t.Players {
+			if p.Name == "" {
+				r.errorf("team %q, player %d: missing name", t.Name, j+1)
+				continue
+			}
+			pd := playerData{
+				Name:     p.Name,
+				Pronouns: p.Pronouns,
+				Scene:    p.Scene,
+				PhotoUri: getPlayerPhotoUri(p.Name),
+			}
+			if p.Photo != "" {
+				if uri, err := rosterPhotoUri(p.Photo); err != nil {
+					r.errorf("team %q, player %q: %v", t.Name, p.Name, err)
+				} else {
+					pd.PhotoUri = uri
+				}
+			}
+			if p.Position != "" {
+				switch pos := strings.ToLower(p.Position); {
+				case !isRosterPosition(pos):
+					r.errorf("team %q, player %q: unknown position %q; expected one of %s", t.Name, p.Name, p.Position, strings.Join(rosterPositions, ", "))
+				case positions[pos] != "":
+					r.errorf("team %q, player %q: %s is already %q", t.Name, p.Name, pos, positions[pos])
+				default:
+					positions[pos] = p.Name
+					pd.Position = pos
+				}
+			}
+			players = append(players, pd)
+		}
+		r.players[t.Name] = players
+	}
+
+	sort.SliceStable(teams, func(i, j int) bool {
+		a, b := teams[i].Seed, teams[j].Seed
+		return a > 0 && (b == 0 || a < b)
+	})
+	for _, t := range teams {
+		r.teams = append(r.teams, t.Name)
+	}
+	return r
+}
+
+func isRosterPosition(pos string) bool {
+	for _, p := range rosterPositions {
+		if p == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the URI for a roster photo, which is either a URL or a file in the
+// photos directory.
+func rosterPhotoUri(photo string) (string, error) {
+	if strings.HasPrefix(photo, "http://") || strings.HasPrefix(photo, "https://") || strings.HasPrefix(photo, "/") {
+		return photo, nil
+	}
+	f, err := playerPhotoDir.Open(photo)
+	if err != nil {
+		return "", fmt.Errorf("photo %q is not in the photos directory", photo)
+	}
+	f.Close()
+	return "/teamPictures/photo/" + url.PathEscape(photo), nil
+}
+
+// Parses the legacy teams.conf format. Each line names a team, followed by
+// its players on lines starting with a tab, as `name,scene,pronouns`.
+func parseLegacyTeams(f io.Reader) *loadedRoster {
+	r := &loadedRoster{players: make(map[string][]playerData)}
+	s := bufio.NewScanner(f)
+	var currTeamName string
+	for line := 1; s.Scan(); line++ {
+		str := s.Text()
+		if len(str) == 0 {
+			continue
+		}
+		if str[0] == '\t' {
+			if currTeamName == "" {
+				r.errorf("line %d: player data outside a team", line)
+			} else {
+				var pd playerData
+				switch parts := strings.Split(str[1:], ","); true {
+				case len(parts) >= 3:
+					pd.Pronouns = parts[2]
+					fallthrough
+				case len(parts) == 2:
+					pd.Scene = parts[1]
+					fallthrough
+				default:
+					pd.Name = parts[0]
+					pd.PhotoUri = getPlayerPhotoUri(parts[0])
+				}
+				r.players[currTeamName] = append(r.players[currTeamName], pd)
+			}
+		} else if r.players[str] != nil {
+			r.errorf("line %d: team %q is listed more than once", line, str)
+			currTeamName = ""
+		} else {
+			r.teams = append(r.teams, str)
+			currTeamName = str
+			// Preallocate the memory, and make sure there is an entry in
+			// the map even if there is no player info for the team.
+			r.players[currTeamName] = make([]playerData, 0, 5)
+		}
+	}
+	if err := s.Err(); err != nil {
+		r.errorf("%v", err)
+	}
+	return r
+}
+
+// Watches the roster file and teams.conf, sending the teams, players and any
+// problems to the server whenever either changes. The roster file takes
+// precedence when it exists.
+type rosterWatcher struct {
+	roster, legacy *FileWatcher
+
+	mu sync.Mutex
+	// The contents of each file, or nil if it does not exist.
+	rosterLoaded, legacyLoaded *loadedRoster
+	// Whether each file has been loaded yet. Files missing at startup count
+	// as loaded, since the watcher only reports them once they appear.
+	rosterSeen, legacySeen bool
+}
+
+func watchRosterFiles(rosterPath string, eventOutput EventStream) *rosterWatcher {
+	missing := func(path string) bool {
+		_, err := os.Stat(path)
+		return os.IsNotExist(err)
+	}
+	w := &rosterWatcher{
+		rosterSeen: rosterPath == "" || missing(rosterPath),
+		legacySeen: missing("teams.conf"),
+	}
+	// Must be called with the mutex held.
+	update := func() {
+		if !w.rosterSeen || !w.legacySeen {
+			return // Wait for both, to avoid loading teams.conf first.
+		}
+		r, name := w.rosterLoaded, rosterPath
+		if r == nil {
+			r, name = w.legacyLoaded, "teams.conf"
+		}
+		errors := []string{}
+		if r == nil {
+			fmt.Printf("No %s or teams.conf file\n", rosterPath)
+			r = &loadedRoster{players: make(map[string][]playerData)}
+		} else if len(r.errors) > 0 {
+			fmt.Printf("Loaded %v teams from %s, with %d problems; see the control page\n", len(r.teams), name, len(r.errors))
+			for _, e := range r.errors {
+				errors = append(errors, name+": "+e)
+			}
+		} else {
+			fmt.Printf("Loaded %v teams from %s\n", len(r.teams), name)
+		}
+		eventOutput.AddEvent(NewControlEvent("", []ControlCommand{
+			{Type: SetTeamList, Data: r.teams},
+			{Type: SetPlayerData, Data: r.players},
+			{Type: SetRosterErrors, Data: errors},
+		}))
+	}
+	if rosterPath != "" {
+		w.roster = WatchFile(rosterPath, func(f *os.File) {
+			var r *loadedRoster
+			if f != nil {
+				if data, err := io.ReadAll(f); err != nil {
+					r = &loadedRoster{players: make(map[string][]playerData)}
+					r.errorf("%v", err)
+				} else {
+					r = parseRoster(data)
+				}
+			}
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.rosterLoaded, w.rosterSeen = r, true
+			update()
+		})
+	}
+	w.legacy = WatchFile("teams.conf", func(f *os.File) {
+		var r *loadedRoster
+		if f != nil {
+			r = parseLegacyTeams(f)
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.legacyLoaded, w.legacySeen = r, true
+		update()
+	})
+	return w
+}
+
+func (w *rosterWatcher) Close() error {
+	if w.roster != nil {
+		w.roster.Close()
+	}
+	return w.legacy.Close()
+}
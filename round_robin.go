@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	kq "github.com/ughoavgfhw/libkq/common"
+)
+
+// The tiebreakers used when a round robin does not choose any.
+var defaultTiebreakers = []string{"headToHead", "gameDifferential"}
+
+// Points for each match result. Teams are ranked by points before any
+// tiebreakers.
+const (
+	pointsPerWin  = 2
+	pointsPerDraw = 1
+)
+
+// The known tiebreakers. Each gives a value for a team, where higher ranks
+// first, computed over the matches among the tied teams for headToHead and
+// over all of a team's matches otherwise.
+var tiebreakers = map[string]func(s *TeamStanding) int{
+	"headToHead":       func(s *TeamStanding) int { return s.Points },
+	"gameDifferential": func(s *TeamStanding) int { return s.GameWins - s.GameLosses },
+	"gameWins":         func(s *TeamStanding) int { return s.GameWins },
+	"berryWins":        func(s *TeamStanding) int { return s.BerryWins },
+	"snailWins":        func(s *TeamStanding) int { return s.SnailWins },
+	"militaryWins":     func(s *TeamStanding) int { return s.MilitaryWins },
+}
+
+type roundRobinMatch struct {
+	group  int
+	round  int // Starting from 1.
+	scores *MatchScores
+	// Set once the match has been played and advanced past.
+	done bool
+}
+
+// A round robin, where every team plays every other team in its group once.
+// Teams are split into groups in snake order, so each group gets a similar
+// mix of seeds. Matches are played round by round, with each group's matches
+// for a round together.
+//
+// A match counts once it is advanced past with at least one game won. Matches
+// advanced past without any are skipped, and played once the rest of the
+// schedule is done. Tied matches count as draws.
+type RoundRobin struct {
+	// The teams as given, to recreate the round robin on restart.
+	teams       []string
+	groups      [][]string
+	tiebreakers []string
+	matches     []*roundRobinMatch
+	// The index of the current match, or -1 once every match is played.
+	currentIndex int
+	current      ActiveMatch
+}
+
+// Creates a round robin for the given teams, listed from the first seed down.
+// Ties in the standings are broken by the named tiebreakers, in order.
+func StartRoundRobin(teams []string, groups int, tiebreakerNames []string, victoryRule MatchVictoryRule) (*RoundRobin, error) {
+	if groups < 1 {
+		groups = 1
+	}
+	if len(teams) < 2*groups {
+		return nil, fmt.Errorf("%d groups need at least %d teams", groups, 2*groups)
+	}
+	seen := make(map[string]bool)
+	for _, t := range teams {
+		if t == "" {
+			return nil, fmt.Errorf("team names must not be empty")
+		}
+		if seen[t] {
+			return nil, fmt.Errorf("duplicate team %q", t)
+		}
+		seen[t] = true
+	}
+	if tiebreakerNames == nil {
+		tiebreakerNames = defaultTiebreakers
+	}
+	for _, name := range tiebreakerNames {
+		if _, ok := tiebreakers[name]; !ok {
+			return nil, fmt.Errorf("unknown tiebreaker %q", name)
+		}
+	}
+
+	rr := &RoundRobin{teams: teams, groups: make([][]string, groups), tiebreakers: tiebreakerNames}
+	for i, t := range teams {
+		g := i % (2 * groups)
+		if g >= groups {
+			g = 2*groups - 1 - g
+		}
+		rr.groups[g] = append(rr.groups[g], t)
+	}
+
+	// Schedule each group with the circle method: one team stays put while
+	// the others rotate around it. An odd group gets a bye slot.
+	schedules := make([][][2]string, groups)
+	for g, members := range rr.groups {
+		slots := append([]string(nil), members...)
+		if len(slots)%2 == 1 {
+			slots = append(slots, "")
+		}
+		n := len(slots)
+		for r := 0; r < n-1; r++ {
+			var pairs [][2]string
+			for i := 0; i < n/2; i++ {
+				a, b := slots[i], slots[n-1-i]
+				if a == "" || b == "" {
+					continue
+				}
+				// Alternate which team is listed first, so no team is always
+				// team A.
+				if (r+i)%2 == 1 {
+					a, b = b, a
+				}
+				pairs = append(pairs, [2]string{a, b})
+			}
+			schedules[g] = append(schedules[g], pairs...)
+			schedules[g] = append(schedules[g], [2]string{}) // Marks the end of the round.
+			last := slots[n-1]
+			copy(slots[2:], slots[1:n-1])
+			slots[1] = last
+		}
+	}
+	for r, done := 1, false; !done; r++ {
+		done = true
+		for g := range schedules {
+			for len(schedules[g]) > 0 {
+				pair := schedules[g][0]
+				schedules[g] = schedules[g][1:]
+				if pair[0] == "" {
+					break
+				}
+				done = false
+				rr.matches = append(rr.matches, &roundRobinMatch{
+					group:  g,
+					round:  r,
+					scores: &MatchScores{TeamA: pair[0], TeamB: pair[1]},
+				})
+			}
+			if len(schedules[g]) > 0 {
+				done = false
+			}
+		}
+	}
+
+	rr.current.MatchVictoryRule = victoryRule
+	rr.currentIndex = -1
+	rr.moveToNextMatch()
+	return rr, nil
+}
+
+// Makes the next unplayed match after the current one current, wrapping
+// around to pick up skipped matches. If every match is played, an empty match
+// is current.
+func (rr *RoundRobin) moveToNextMatch() {
+	for i := 1; i <= len(rr.matches); i++ {
+		next := (rr.currentIndex + i) % len(rr.matches)
+		if next < 0 {
+			next += len(rr.matches)
+		}
+		if !rr.matches[next].done {
+			rr.currentIndex = next
+			rr.current.Reset(rr.matches[next].scores)
+			return
+		}
+	}
+	rr.currentIndex = -1
+	rr.current.Reset(new(MatchScores))
+}
+
+func (rr *RoundRobin) CurrentMatch() *MatchScores {
+	return rr.current.MatchScores
+}
+
+// Returns an upcoming unplayed match in schedule order. Beyond the end of the
+// schedule, returns an empty match which is never played.
+func (rr *RoundRobin) UpcomingMatch(distance int) *MatchScores {
+	for i := 1; i < len(rr.matches); i++ {
+		next := (rr.currentIndex + i) % len(rr.matches)
+		if next < 0 || next == rr.currentIndex || rr.matches[next].done {
+			continue
+		}
+		if distance == 0 {
+			return rr.matches[next].scores
+		}
+		distance--
+	}
+	return new(MatchScores)
+}
+
+// Finishes the current match if any games were won, then moves to the next
+// unplayed match.
+func (rr *RoundRobin) AdvanceMatch() {
+	if rr.currentIndex >= 0 {
+		m := rr.matches[rr.currentIndex]
+		if m.scores.ScoreA+m.scores.ScoreB > 0 {
+			m.done = true
+		}
+	}
+	rr.moveToNextMatch()
+}
+
+func (rr *RoundRobin) TeamASide() kq.Side {
+	return rr.current.TeamASide
+}
+
+func (rr *RoundRobin) SetTeamASide(side kq.Side) {
+	rr.current.TeamASide = side
+}
+
+func (rr *RoundRobin) SwapSides() {
+	rr.current.SwapSides()
+}
+
+func (rr *RoundRobin) RecordGame(winner kq.Side, winType kq.WinType) {
+	rr.current.RecordGame(winner, winType)
+}
+
+func (rr *RoundRobin) ClearPreviousGame() {
+	rr.current.ClearPreviousGame()
+}
+
+func (rr *RoundRobin) VictoryRule() MatchVictoryRule {
+	return rr.current.MatchVictoryRule
+}
+
+func (rr *RoundRobin) SetVictoryRule(rule MatchVictoryRule) {
+	rr.current.MatchVictoryRule = rule
+}
+
+func (rr *RoundRobin) CurrentMatchIsComplete() bool {
+	return rr.current.IsComplete()
+}
+
+// A team's record in a round robin, as sent to clients.
+type TeamStanding struct {
+	Rank         int    `json:"rank"`
+	Team         string `json:"team"`
+	Played       int    `json:"played"`
+	MatchWins    int    `json:"matchWins"`
+	MatchLosses  int    `json:"matchLosses"`
+	MatchDraws   int    `json:"matchDraws"`
+	Points       int    `json:"points"`
+	GameWins     int    `json:"gameWins"`
+	GameLosses   int    `json:"gameLosses"`
+	BerryWins    int    `json:"berryWins"`
+	SnailWins    int    `json:"snailWins"`
+	MilitaryWins int    `json:"militaryWins"`
+}
+
+// A completed match in a round robin, as sent to clients.
+type RoundRobinMatchView struct {
+	Round  int    `json:"round"`
+	TeamA  string `json:"teamA"`
+	TeamB  string `json:"teamB"`
+	ScoreA int    `json:"scoreA"`
+	ScoreB int    `json:"scoreB"`
+}
+
+type GroupStandings struct {
+	Name      string                `json:"name"`
+	Standings []TeamStanding        `json:"standings"`
+	Results   []RoundRobinMatchView `json:"results"`
+}
+
+// The standings of a round robin, as sent to clients.
+type StandingsView struct {
+	Tiebreakers []string         `json:"tiebreakers"`
+	Groups      []GroupStandings `json:"groups"`
+}
+
+// Adds a match's result to the records of the teams in it.
+func addResult(records map[string]*TeamStanding, scores *MatchScores) {
+	a, b := records[scores.TeamA], records[scores.TeamB]
+	if a == nil || b == nil {
+		return // A team was renamed; the match no longer counts.
+	}
+	a.Played++
+	b.Played++
+	switch {
+	case scores.ScoreA > scores.ScoreB:
+		a.MatchWins++
+		a.Points += pointsPerWin
+		b.MatchLosses++
+	case scores.ScoreA < scores.ScoreB:
+		b.MatchWins++
+		b.Points += pointsPerWin
+		a.MatchLosses++
+	default:
+		a.MatchDraws++
+		a.Points += pointsPerDraw
+		b.MatchDraws++
+		b.Points += pointsPerDraw
+	}
+	a.GameWins += scores.ScoreA
+	a.GameLosses += scores.ScoreB
+	b.GameWins += scores.ScoreB
+	b.GameLosses += scores.ScoreA
+	for _, g := range scores.Games {
+		winner := b
+		if g.Winner == g.TeamASide {
+			winner = a
+		}
+		switch g.WinType {
+		case kq.EconomicWin:
+			winner.BerryWins++
+		case kq.SnailWin:
+			winner.SnailWins++
+		case kq.MilitaryWin:
+			winner.MilitaryWins++
+		}
+	}
+}
+
+// Orders tied teams by the remaining tiebreakers. results holds the matches
+// used for head to head records. When head to head only separates some of the
+// teams, it is applied again to each smaller tie, counting only the matches
+// among those teams, before moving on to the next tiebreaker.
+func (rr *RoundRobin) breakTies(tied []*TeamStanding, names []string, results []*MatchScores) {
+	if len(tied) < 2 || len(names) == 0 {
+		return
+	}
+	value := tiebreakers[names[0]]
+	values := make(map[string]int)
+	if names[0] == "headToHead" {
+		records := make(map[string]*TeamStanding)
+		for _, s := range tied {
+			records[s.Team] = &TeamStanding{Team: s.Team}
+		}
+		for _, m := range results {
+			addResult(records, m)
+		}
+		for _, s := range tied {
+			values[s.Team] = value(records[s.Team])
+		}
+	} else {
+		for _, s := range tied {
+			values[s.Team] = value(s)
+		}
+	}
+	sort.SliceStable(tied, func(i, j int) bool {
+		return values[tied[i].Team] > values[tied[j].Team]
+	})
+	for start := 0; start < len(tied); {
+		end := start + 1
+		for end < len(tied) && values[tied[end].Team] == values[tied[start].Team] {
+			end++
+		}
+		next := names[1:]
+		if names[0] == "headToHead" && end-start < len(tied) {
+			next = names
+		}
+		rr.breakTies(tied[start:end], next, results)
+		start = end
+	}
+}
+
+// Computes the standings of every group from the completed matches.
+func (rr *RoundRobin) Standings() *StandingsView {
+	v := &StandingsView{Tiebreakers: rr.tiebreakers}
+	for g, members := range rr.groups {
+		records := make(map[string]*TeamStanding)
+		var order []*TeamStanding
+		for _, t := range members {
+			s := &TeamStanding{Team: t}
+			records[t] = s
+			order = append(order, s)
+		}
+		group := GroupStandings{Name: string(rune('A' + g))}
+		var results []*MatchScores
+		for _, m := range rr.matches {
+			if m.group != g || !m.done {
+				continue
+			}
+			addResult(records, m.scores)
+			results = append(results, m.scores)
+			group.Results = append(group.Results, RoundRobinMatchView{
+				Round:  m.round,
+				TeamA:  m.scores.TeamA,
+				TeamB:  m.scores.TeamB,
+				ScoreA: m.scores.ScoreA,
+				ScoreB: m.scores.ScoreB,
+			})
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].Points > order[j].Points
+		})
+		for start := 0; start < len(order); {
+			end := start + 1
+			for end < len(order) && order[end].Points == order[start].Points {
+				end++
+			}
+			rr.breakTies(order[start:end], rr.tiebreakers, results)
+			start = end
+		}
+		for i, s := range order {
+			s.Rank = i + 1
+			group.Standings = append(group.Standings, *s)
+		}
+		v.Groups = append(v.Groups, group)
+	}
+	return v
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRoundRobinSchedule(t *testing.T) {
+	for _, tc := range []struct{ teams, groups int }{
+		{2, 1}, {3, 1}, {4, 1}, {5, 1}, {6, 1}, {7, 1}, {8, 2}, {7, 3},
+	} {
+		t.Run(fmt.Sprintf("%d teams in %d groups", tc.teams, tc.groups), func(t *testing.T) {
+			rr, err := StartRoundRobin(seedNames(tc.teams), tc.groups, nil, BestOfN(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			groupOf := make(map[string]int)
+			for g, members := range rr.groups {
+				for _, team := range members {
+					groupOf[team] = g
+				}
+			}
+			type pair struct{ a, b string }
+			seen := make(map[pair]bool)
+			// The rounds each team plays in.
+			rounds := make(map[string]map[int]bool)
+			lastRound := 0
+			for _, m := range rr.matches {
+				a, b := m.scores.TeamA, m.scores.TeamB
+				if groupOf[a] != m.group || groupOf[b] != m.group {
+					t.Errorf("%s vs %s is scheduled in group %d", a, b, m.group)
+				}
+				if a > b {
+					a, b = b, a
+				}
+				if seen[pair{a, b}] {
+					t.Errorf("%s vs %s is scheduled twice", a, b)
+				}
+				seen[pair{a, b}] = true
+				if m.round < lastRound {
+					t.Errorf("round %d is scheduled after round %d", m.round, lastRound)
+				}
+				lastRound = m.round
+				for _, team := range []string{a, b} {
+					if rounds[team] == nil {
+						rounds[team] = make(map[int]bool)
+					}
+					if rounds[team][m.round] {
+						t.Errorf("%s plays twice in round %d", team, m.round)
+					}
+					rounds[team][m.round] = true
+				}
+			}
+			for _, members := range rr.groups {
+				for i, a := range members {
+					for _, b := range members[i+1:] {
+						if a > b {
+							a, b = b, a
+						}
+						if !seen[pair{a, b}] {
+							t.Errorf("%s vs %s is not scheduled", a, b)
+						}
+					}
+				}
+				// An odd group has one more round than it has matches for
+				// each team, so each team gets a bye.
+				wantRounds := len(members) - 1
+				if len(members)%2 == 1 {
+					wantRounds++
+				}
+				for _, team := range members {
+					if len(rounds[team]) != len(members)-1 {
+						t.Errorf("%s plays in %d rounds, want %d", team, len(rounds[team]), len(members)-1)
+					}
+					for r := range rounds[team] {
+						if r < 1 || r > wantRounds {
+							t.Errorf("%s plays in round %d of %d", team, r, wantRounds)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSnakeGroups(t *testing.T) {
+	for _, tc := range []struct {
+		teams, groups int
+		want          [][]string
+	}{
+		{8, 2, [][]string{{"seed1", "seed4", "seed5", "seed8"}, {"seed2", "seed3", "seed6", "seed7"}}},
+		{7, 3, [][]string{{"seed1", "seed6", "seed7"}, {"seed2", "seed5"}, {"seed3", "seed4"}}},
+	} {
+		rr, err := StartRoundRobin(seedNames(tc.teams), tc.groups, nil, BestOfN(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rr.groups, tc.want) {
+			t.Errorf("%d teams in %d groups: got %v, want %v", tc.teams, tc.groups, rr.groups, tc.want)
+		}
+	}
+}
+
+// Records the result of the match between two teams, as if it was played and
+// advanced past.
+func setResult(t *testing.T, rr *RoundRobin, a, b string, scoreA, scoreB int) {
+	for _, m := range rr.matches {
+		s := m.scores
+		switch {
+		case s.TeamA == a && s.TeamB == b:
+			s.ScoreA, s.ScoreB = scoreA, scoreB
+		case s.TeamA == b && s.TeamB == a:
+			s.ScoreA, s.ScoreB = scoreB, scoreA
+		default:
+			continue
+		}
+		m.done = true
+		return
+	}
+	t.Fatalf("%s vs %s is not scheduled", a, b)
+}
+
+func rankedTeams(v *StandingsView) []string {
+	var teams []string
+	for _, s := range v.Groups[0].Standings {
+		teams = append(teams, s.Team)
+	}
+	return teams
+}
+
+func TestRoundRobinStandings(t *testing.T) {
+	type result struct {
+		a, b           string
+		scoreA, scoreB int
+	}
+	for _, tc := range []struct {
+		name        string
+		teams       []string
+		tiebreakers []string
+		results     []result
+		want        []string
+	}{
+		{
+			// Three draws are worth more than a win.
+			name:    "points",
+			teams:   []string{"a", "b", "c", "d", "e"},
+			results: []result{{"a", "b", 2, 0}, {"c", "b", 1, 1}, {"c", "d", 1, 1}, {"c", "e", 1, 1}},
+			want:    []string{"c", "a", "d", "e", "b"},
+		},
+		{
+			// Each team beat one of the others, so head to head can't
+			// separate them.
+			name:    "three way head to head cycle",
+			teams:   []string{"a", "b", "c"},
+			results: []result{{"a", "b", 1, 0}, {"b", "c", 3, 0}, {"c", "a", 3, 0}},
+			want:    []string{"b", "c", "a"},
+		},
+		{
+			// a, b and c are tied on points. a beat both others, and b and
+			// c drew, so game differential decides between them.
+			name:  "three way head to head with a draw",
+			teams: []string{"a", "b", "c", "d", "e"},
+			results: []result{
+				{"a", "b", 1, 0}, {"a", "c", 1, 0}, {"b", "c", 1, 1},
+				{"d", "a", 1, 0}, {"e", "a", 1, 0}, {"b", "d", 1, 0}, {"b", "e", 1, 1}, {"c", "e", 3, 0}, {"c", "d", 1, 1},
+			},
+			want: []string{"a", "c", "b", "d", "e"},
+		},
+		{
+			// a, b, c and d are tied on points. Head to head among them
+			// puts a and d ahead of b and c, then is applied again to each
+			// pair, where a beat d and b beat c despite worse game
+			// differentials.
+			name:  "head to head applied again to the remaining ties",
+			teams: []string{"a", "b", "c", "d", "e", "f"},
+			results: []result{
+				{"a", "d", 1, 0}, {"a", "b", 1, 0}, {"c", "a", 3, 0}, {"d", "b", 3, 0}, {"d", "c", 1, 0}, {"b", "c", 1, 0},
+				{"a", "e", 1, 1}, {"f", "a", 1, 0}, {"d", "e", 1, 1}, {"f", "d", 1, 0},
+				{"b", "e", 1, 0}, {"b", "f", 1, 1}, {"c", "e", 1, 0}, {"c", "f", 1, 1}, {"f", "e", 1, 0},
+			},
+			want: []string{"f", "a", "d", "b", "c", "e"},
+		},
+		{
+			name:        "later tiebreakers",
+			teams:       []string{"a", "b", "c"},
+			tiebreakers: []string{"gameWins"},
+			results:     []result{{"a", "b", 1, 2}, {"b", "c", 0, 1}, {"c", "a", 1, 3}},
+			want:        []string{"a", "b", "c"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rr, err := StartRoundRobin(tc.teams, 1, tc.tiebreakers, BestOfN(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tc.results {
+				setResult(t, rr, r.a, r.b, r.scoreA, r.scoreB)
+			}
+			v := rr.Standings()
+			if got := rankedTeams(v); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			for i, s := range v.Groups[0].Standings {
+				if s.Rank != i+1 {
+					t.Errorf("%s has rank %d, want %d", s.Team, s.Rank, i+1)
+				}
+				if want := pointsPerWin*s.MatchWins + pointsPerDraw*s.MatchDraws; s.Points != want {
+					t.Errorf("%s has %d points, want %d", s.Team, s.Points, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSkippedMatchesArePlayedLast(t *testing.T) {
+	rr, err := StartRoundRobin(seedNames(4), 1, nil, BestOfN(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := rr.CurrentMatch()
+	rr.AdvanceMatch()
+	for i := 0; i < len(rr.matches)-1; i++ {
+		if rr.CurrentMatch() == skipped {
+			t.Fatalf("skipped match came back after %d matches", i)
+		}
+		winGame(rr, rr.CurrentMatch().TeamA)
+		rr.AdvanceMatch()
+	}
+	if rr.CurrentMatch() != skipped {
+		t.Fatal("skipped match was not played last")
+	}
+	winGame(rr, skipped.TeamB)
+	rr.AdvanceMatch()
+	if rr.currentIndex != -1 {
+		t.Errorf("round robin is not finished")
+	}
+}
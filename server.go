@@ -1,21 +1,27 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	kq "github.com/ughoavgfhw/libkq/common"
+	kqio "github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/parser"
 
 	"github.com/ughoavgfhw/kq-live/assets"
+	"github.com/ughoavgfhw/kq-live/tracking"
 )
 
 func requireTemplate(name string, configFS http.FileSystem) *template.Template {
@@ -43,7 +49,7 @@ type dataPoint struct {
 	vals  []float64
 	event string
 
-	stats               []playerStat
+	stats               []tracking.PlayerStat
 	status              []struct{ Speed, Warrior bool }
 	mp, winner, winType string
 	dur                 time.Duration
@@ -57,18 +63,79 @@ const (
 	VictoryRuleKey
 	TeamListKey
 	PlayerDataKey
+	// Data is a chan struct{}, which is closed once the server has applied the
+	// event's control commands. Lets the sender wait for its changes.
+	ControlDoneKey
+	// Data is errorData describing a problem with a client's request. These
+	// events are only sent to that client.
+	ClientErrorKey
+	// Data is []GameResult, the games recorded so far in the current match.
+	GameListKey
+	// Data is MatchComplete, sent once when the current match ends.
+	MatchCompleteKey
+	// Data is *BracketView, or nil if the cabinet is not playing a bracket.
+	BracketKey
+	// Data is *StandingsView, or nil if the cabinet is not playing a round
+	// robin.
+	StandingsKey
+	// Data is an error, set when a control command could not be applied.
+	ControlErrorKey
+	// Data is []string, the problems found in the roster. Empty if there are
+	// none.
+	RosterErrorsKey
+	// Data is map[string]LineupView, keyed by cabinet, for each cabinet the
+	// event applies to.
+	LineupKey
+	// Data is teamSidesJSON, sent when the cabinet's team sides change.
+	TeamSidesKey
+	// Data is predictionHistory, the cabinet's predictions so far in the
+	// current or last game. Attached to start requests for the prediction
+	// section, and only used by the client which sent the request.
+	PredictionHistoryKey
 )
 
+type predictionHistory struct {
+	start  time.Time
+	points []dataPoint
+}
+
+// Reported for an UndoLastGame command when the current match has no games.
+var errNoGameToUndo = errors.New("no game to undo")
+
 type ScoreUpdate struct {
 	Blue int
 	Gold int
 }
 
+// Checks that neither score is negative.
+func (u ScoreUpdate) validate() error {
+	if u.Blue < 0 || u.Gold < 0 {
+		return errors.New("scores must not be negative")
+	}
+	return nil
+}
+
 type TeamUpdate struct {
 	Blue string
 	Gold string
 }
 
+// A game recorded in the current match.
+type GameResult struct {
+	Winner  string `json:"winner"` // The side which won, "blue" or "gold".
+	WinType string `json:"winType"`
+}
+
+// The result of a match which just ended.
+type MatchComplete struct {
+	Teams  TeamUpdate
+	Scores ScoreUpdate
+	Winner string // The side of the winning team, "blue" or "gold".
+	// How long until the on deck match starts automatically, or 0 if it
+	// will not.
+	AdvanceDelay time.Duration
+}
+
 type ControlCommandType int
 
 type ControlCommand struct {
@@ -86,41 +153,86 @@ const (
 	SetScores          // Data is ScoreUpdate
 	SetTeamList        // Data is teamList
 	SetPlayerData      // Data is map[string][]playerData
+	SwapSides          // Data is nil
+	SetOnDeckTeams     // Data is TeamUpdate
+	UndoLastGame       // Data is nil
+	// Sent by the server itself after a match ends. Data is the token of the
+	// scheduled advance, so nothing happens if it has since been rescheduled
+	// or cancelled.
+	AutoAdvanceMatch
+	SetTournament   // Data is TournamentSetup
+	SetRosterErrors // Data is []string
+	SetLineup       // Data is LineupUpdate
+	SetTeamSides    // Data is string, the LeftTeam setting from CabinetConfig
 )
 
+var controlCommandNames = [...]string{
+	InvalidControlCommand: "InvalidControlCommand",
+	ClientStartRequest:    "ClientStartRequest",
+	AdvanceMatch:          "AdvanceMatch",
+	SetVictoryRule:        "SetVictoryRule",
+	SetCurrentTeams:       "SetCurrentTeams",
+	SetScores:             "SetScores",
+	SetTeamList:           "SetTeamList",
+	SetPlayerData:         "SetPlayerData",
+	SwapSides:             "SwapSides",
+	SetOnDeckTeams:        "SetOnDeckTeams",
+	UndoLastGame:          "UndoLastGame",
+	AutoAdvanceMatch:      "AutoAdvanceMatch",
+	SetTournament:         "SetTournament",
+	SetRosterErrors:       "SetRosterErrors",
+	SetLineup:             "SetLineup",
+	SetTeamSides:          "SetTeamSides",
+}
+
+func (t ControlCommandType) String() string {
+	if int(t) < len(controlCommandNames) {
+		return controlCommandNames[t]
+	}
+	return fmt.Sprintf("ControlCommandType(%d)", int(t))
+}
+
 type ClientStartOptions struct {
 	ClientIdentifier *chan<- *Event // The registration token.
 	Sections         map[string]bool
+	Version          int // The protocol version agreed with the client.
+	// Whether the server is resending the snapshot because the client lost
+	// events.
+	Resync bool
 }
 
-func runRegistry(in <-chan *Event, reg <-chan *chan<- *Event, unreg <-chan *chan<- *Event) {
-	singleRecipient := func(e *Event) *chan<- *Event {
-		// Currently only client start request events have single recipients.
-		cmd, ok := e.Data[ControlCommandKey].([]ControlCommand)
-		if e.Type == ControlEvent && ok && len(cmd) == 1 && cmd[0].Type == ClientStartRequest {
-			return cmd[0].Data.(ClientStartOptions).ClientIdentifier
-		}
-		return nil
-	}
-
-	registry := make(map[*chan<- *Event]struct{})
+// Sends events to registered clients. Each client has a feed which queues its
+// events, so a slow client falls behind on its own instead of holding up the
+// server or the other clients.
+func runRegistry(in <-chan *Event, reg <-chan *clientRegistration, unreg <-chan *chan<- *Event, metrics <-chan chan<- []clientMetrics, eventOutput EventStream) {
+	registry := make(map[*chan<- *Event]*clientFeed)
 	for {
 		select {
-		case c := <-reg:
-			registry[c] = struct{}{}
+		case r := <-reg:
+			f := newClientFeed(r)
+			registry[r.token] = f
+			go f.run(eventOutput)
 		case c := <-unreg:
-			delete(registry, c)
+			if f, ok := registry[c]; ok {
+				f.close()
+				delete(registry, c)
+			}
+		case reply := <-metrics:
+			m := make([]clientMetrics, 0, len(registry))
+			for _, f := range registry {
+				m = append(m, f.metrics())
+			}
+			sort.Slice(m, func(i, j int) bool { return m[i].Connected.Before(m[j].Connected) })
+			reply <- m
 		case e := <-in:
-			if r := singleRecipient(e); r == nil {
-				for c, _ := range registry {
-					select {
-					case *c <- e:
-					default: // Drop packets to a client instead of blocking the entire server
-					}
+			// Currently only client start request events have single
+			// recipients.
+			if opts, ok := clientStartOptions(e); !ok {
+				for _, f := range registry {
+					f.push(e)
 				}
-			} else if _, ok := registry[r]; ok {
-				// This event should only be sent to a single recipient. It should not be dropped unless that recipient is unregistered.
-				*r <- e // Blocking
+			} else if f, ok := registry[opts.ClientIdentifier]; ok {
+				f.push(e)
 			}
 		}
 	}
@@ -138,11 +250,66 @@ type gameTracker struct {
 	SetScores       func(blue, gold int, event *Event)
 	OnDeckTeams     func() (blueTeam string, goldTeam string)
 	SetOnDeckTeams  func(blue, gold string)
+	// Removes the last game recorded in the current match. Returns false if
+	// there are no games to remove.
+	UndoLastGame func(event *Event) bool
+	// Records a game won by the given side in the current match.
+	RecordGame func(winner kq.Side, winType kq.WinType, event *Event)
+	Games      func() []GameResult
+	// Marks the current match final if it is complete and was not already,
+	// or not final if it is incomplete. Returns a number identifying the
+	// match, whether it is complete, and whether it was just finished.
+	// advanceDelay is only reported to clients.
+	FinishMatch func(advanceDelay time.Duration, event *Event) (matchNumber int, complete, finished bool)
+	// Advances to the next match if the given match is still current and
+	// complete. Returns whether it advanced.
+	AdvanceFinishedMatch func(matchNumber int, event *Event) bool
+	// Replaces the tournament, discarding every match. The victory rule is
+	// kept.
+	StartTournament func(setup TournamentSetup, event *Event) error
+	// Returns the structure of the bracket being played, or nil if the
+	// tournament is not a bracket.
+	Bracket func() *BracketView
+	// Returns the standings of the round robin being played, or nil if the
+	// tournament is not a round robin.
+	Standings func() *StandingsView
+	// Returns the players assigned to each position for the current match.
+	Lineup func() LineupUpdate
+	// Assigns players to positions for the current match. They stay with
+	// their team if it switches sides.
+	SetLineup func(update LineupUpdate)
+	// Returns the id of the current match, or "" if it has no games yet.
+	MatchId func() string
+	// Returns the format of the tournament, as in TournamentSetup.
+	Format func() string
 }
 
-func startGameTracker() gameTracker {
+// Starts tracking a cabinet's matches, resuming the tournament saved in state
+// if there is one. Every change is saved back to state.
+func startGameTracker(cabinet string, state *stateFile) gameTracker {
 	type teams struct{ blue, gold string }
 	type scores struct{ blue, gold int }
+	type game struct {
+		winner  kq.Side
+		winType kq.WinType
+		event   *Event
+	}
+	type finish struct {
+		advanceDelay time.Duration
+		event        *Event
+	}
+	type finishReply struct {
+		matchNumber        int
+		complete, finished bool
+	}
+	type advanceFinished struct {
+		matchNumber int
+		event       *Event
+	}
+	type start struct {
+		setup TournamentSetup
+		event *Event
+	}
 	type command struct {
 		cmd  int
 		data interface{}
@@ -152,7 +319,84 @@ func startGameTracker() gameTracker {
 
 	go func() {
 		defer close(reply)
-		tracker := StartUnstructuredPlay(BestOfN(0))
+		var tracker Tournament = StartUnstructuredPlay(BestOfN(0))
+		if saved, err := state.Saved(cabinet); err != nil {
+			fmt.Printf("Cannot resume the tournament for %s: %v\n", cabinet, err)
+		} else if saved != nil {
+			if t, err := saved.restore(); err != nil {
+				fmt.Printf("Cannot resume the tournament for %s: %v\n", cabinet, err)
+			} else {
+				tracker = t
+				fmt.Printf("Resumed the tournament for %s\n", cabinet)
+			}
+		}
+		var lastSaved []byte
+		persist := func() {
+			data, err := json.Marshal(saveTournament(tracker))
+			if err != nil {
+				fmt.Println("Failed to save tournament state:", err)
+				return
+			}
+			if bytes.Equal(data, lastSaved) {
+				return
+			}
+			lastSaved = data
+			state.Save(cabinet, data)
+		}
+		persist()
+		games := func() []GameResult {
+			match := tracker.CurrentMatch()
+			results := make([]GameResult, len(match.Games))
+			for i, g := range match.Games {
+				results[i] = GameResult{g.Winner.String(), g.WinType.String()}
+			}
+			return results
+		}
+		// Counts the matches played, to tell whether a delayed command is
+		// still about the current match.
+		matchNumber := 0
+		// Moves to the next match, filling in the event with its state.
+		advance := func(event *Event) {
+			prev := tracker.CurrentMatch()
+			tracker.AdvanceMatch()
+			matchNumber++
+			next := tracker.CurrentMatch()
+			if event != nil {
+				event.Data[VictoryRuleKey] = tracker.VictoryRule()
+				event.Data[GameListKey] = games()
+				if tracker.TeamASide() == kq.BlueSide {
+					event.Data[TeamUpdateKey] = TeamUpdate{
+						Blue: next.TeamA,
+						Gold: next.TeamB,
+					}
+					event.Data[ScoreUpdateKey] = ScoreUpdate{
+						Blue: next.ScoreA,
+						Gold: next.ScoreB,
+					}
+				} else {
+					event.Data[TeamUpdateKey] = TeamUpdate{
+						Blue: next.TeamB,
+						Gold: next.TeamA,
+					}
+					event.Data[ScoreUpdateKey] = ScoreUpdate{
+						Blue: next.ScoreB,
+						Gold: next.ScoreA,
+					}
+				}
+			}
+
+			switch true {
+			case prev.ScoreA > prev.ScoreB:
+				fmt.Printf("%s defeats %s, %d-%d\n", prev.TeamA, prev.TeamB, prev.ScoreA, prev.ScoreB)
+			case prev.ScoreA < prev.ScoreB:
+				fmt.Printf("%s defeats %s, %d-%d\n", prev.TeamB, prev.TeamA, prev.ScoreB, prev.ScoreA)
+			default:
+				fmt.Printf("%s and %s tie, %d-%d\n", prev.TeamA, prev.TeamB, prev.ScoreA, prev.ScoreB)
+			}
+			if next.TeamA != "" || next.TeamB != "" {
+				fmt.Printf("Up next: %s vs %s\n", next.TeamA, next.TeamB)
+			}
+		}
 		for cmd := range send {
 			switch cmd.cmd {
 			case 0:
@@ -187,44 +431,11 @@ func startGameTracker() gameTracker {
 					reply <- event // Just to indicate we are done with the synchronized section.
 				}
 			case 2:
-				prev := tracker.CurrentMatch()
-				tracker.AdvanceMatch()
-				next := tracker.CurrentMatch()
-				if event := cmd.data.(*Event); event != nil {
-					event.Data[VictoryRuleKey] = tracker.VictoryRule()
-					if tracker.TeamASide() == kq.BlueSide {
-						event.Data[TeamUpdateKey] = TeamUpdate{
-							Blue: next.TeamA,
-							Gold: next.TeamB,
-						}
-						event.Data[ScoreUpdateKey] = ScoreUpdate{
-							Blue: next.ScoreA,
-							Gold: next.ScoreB,
-						}
-					} else {
-						event.Data[TeamUpdateKey] = TeamUpdate{
-							Blue: next.TeamB,
-							Gold: next.TeamA,
-						}
-						event.Data[ScoreUpdateKey] = ScoreUpdate{
-							Blue: next.ScoreB,
-							Gold: next.ScoreA,
-						}
-					}
+				event := cmd.data.(*Event)
+				advance(event)
+				if event != nil {
 					reply <- event // Just to indicate we are done with the synchronized section.
 				}
-
-				switch true {
-				case prev.ScoreA > prev.ScoreB:
-					fmt.Printf("%s defeats %s, %d-%d\n", prev.TeamA, prev.TeamB, prev.ScoreA, prev.ScoreB)
-				case prev.ScoreA < prev.ScoreB:
-					fmt.Printf("%s defeats %s, %d-%d\n", prev.TeamB, prev.TeamA, prev.ScoreB, prev.ScoreA)
-				default:
-					fmt.Printf("%s and %s tie, %d-%d\n", prev.TeamA, prev.TeamB, prev.ScoreA, prev.ScoreB)
-				}
-				if next.TeamA != "" || next.TeamB != "" {
-					fmt.Printf("Up next: %s vs %s\n", next.TeamA, next.TeamB)
-				}
 			case 3:
 				ms := tracker.CurrentMatch()
 				if cmd.data == nil {
@@ -235,11 +446,18 @@ func startGameTracker() gameTracker {
 					}
 				} else {
 					t := cmd.data.(teams)
-					if tracker.TeamASide() == kq.BlueSide {
-						ms.TeamA, ms.TeamB = t.blue, t.gold
-					} else {
-						ms.TeamB, ms.TeamA = t.blue, t.gold
+					a, b := t.blue, t.gold
+					if tracker.TeamASide() != kq.BlueSide {
+						a, b = b, a
+					}
+					// A lineup belongs to the team it was assigned for.
+					if ms.TeamA != a {
+						ms.LineupA = nil
+					}
+					if ms.TeamB != b {
+						ms.LineupB = nil
 					}
+					ms.TeamA, ms.TeamB = a, b
 				}
 			case 4:
 				ms := tracker.CurrentMatch()
@@ -273,7 +491,164 @@ func startGameTracker() gameTracker {
 						ms.TeamB, ms.TeamA = t.blue, t.gold
 					}
 				}
+			case 6:
+				match := tracker.CurrentMatch()
+				if len(match.Games) == 0 {
+					reply <- false
+					break
+				}
+				tracker.ClearPreviousGame()
+				if event := cmd.data.(*Event); event != nil {
+					if tracker.TeamASide() == kq.BlueSide {
+						event.Data[ScoreUpdateKey] = ScoreUpdate{
+							Blue: match.ScoreA,
+							Gold: match.ScoreB,
+						}
+					} else {
+						event.Data[ScoreUpdateKey] = ScoreUpdate{
+							Blue: match.ScoreB,
+							Gold: match.ScoreA,
+						}
+					}
+					event.Data[GameListKey] = games()
+				}
+				reply <- true
+			case 7:
+				g := cmd.data.(game)
+				match := tracker.CurrentMatch()
+				if match.Id == "" {
+					// Matches are named like their first game, from the
+					// time in its messages.
+					start := time.Now()
+					if g.event != nil {
+						start = g.event.When
+						if dp, ok := g.event.Data[StatsUpdateKey].(dataPoint); ok {
+							start = dp.when.Add(-dp.dur)
+						}
+					}
+					match.Id = newGameId(cabinet, start)
+				}
+				tracker.RecordGame(g.winner, g.winType)
+				if g.event != nil {
+					if tracker.TeamASide() == kq.BlueSide {
+						g.event.Data[ScoreUpdateKey] = ScoreUpdate{
+							Blue: match.ScoreA,
+							Gold: match.ScoreB,
+						}
+					} else {
+						g.event.Data[ScoreUpdateKey] = ScoreUpdate{
+							Blue: match.ScoreB,
+							Gold: match.ScoreA,
+						}
+					}
+					g.event.Data[GameListKey] = games()
+				}
+				reply <- nil // Just to indicate we are done with the synchronized section.
+			case 8:
+				reply <- games()
+			case 9:
+				f := cmd.data.(finish)
+				match := tracker.CurrentMatch()
+				if !tracker.CurrentMatchIsComplete() {
+					// A final match can be reopened by changing its scores
+					// or victory rule.
+					match.Final = false
+					reply <- finishReply{matchNumber, false, false}
+					break
+				} else if match.Final {
+					reply <- finishReply{matchNumber, true, false}
+					break
+				}
+				match.Final = true
+				if f.event != nil {
+					var mc MatchComplete
+					mc.AdvanceDelay = f.advanceDelay
+					if tracker.TeamASide() == kq.BlueSide {
+						mc.Teams = TeamUpdate{match.TeamA, match.TeamB}
+						mc.Scores = ScoreUpdate{match.ScoreA, match.ScoreB}
+					} else {
+						mc.Teams = TeamUpdate{match.TeamB, match.TeamA}
+						mc.Scores = ScoreUpdate{match.ScoreB, match.ScoreA}
+					}
+					if mc.Scores.Blue > mc.Scores.Gold {
+						mc.Winner = "blue"
+					} else if mc.Scores.Gold > mc.Scores.Blue {
+						mc.Winner = "gold"
+					}
+					f.event.Data[MatchCompleteKey] = mc
+				}
+				reply <- finishReply{matchNumber, true, true}
+			case 10:
+				a := cmd.data.(advanceFinished)
+				match := tracker.CurrentMatch()
+				if a.matchNumber != matchNumber || !match.Final || !tracker.CurrentMatchIsComplete() {
+					reply <- false
+					break
+				}
+				advance(a.event)
+				reply <- true
+			case 11:
+				st := cmd.data.(start)
+				t, err := StartTournament(st.setup, tracker.VictoryRule())
+				if err != nil {
+					reply <- err
+					break
+				}
+				// The teams stay on the sides they were on.
+				t.SetTeamASide(tracker.TeamASide())
+				tracker = t
+				matchNumber++
+				match := tracker.CurrentMatch()
+				if st.event != nil {
+					st.event.Data[VictoryRuleKey] = tracker.VictoryRule()
+					if tracker.TeamASide() == kq.BlueSide {
+						st.event.Data[TeamUpdateKey] = TeamUpdate{match.TeamA, match.TeamB}
+						st.event.Data[ScoreUpdateKey] = ScoreUpdate{match.ScoreA, match.ScoreB}
+					} else {
+						st.event.Data[TeamUpdateKey] = TeamUpdate{match.TeamB, match.TeamA}
+						st.event.Data[ScoreUpdateKey] = ScoreUpdate{match.ScoreB, match.ScoreA}
+					}
+					st.event.Data[GameListKey] = games()
+				}
+				reply <- nil
+			case 12:
+				if b, ok := tracker.(*Bracket); ok {
+					reply <- b.View()
+				} else {
+					reply <- (*BracketView)(nil)
+				}
+			case 13:
+				if rr, ok := tracker.(*RoundRobin); ok {
+					reply <- rr.Standings()
+				} else {
+					reply <- (*StandingsView)(nil)
+				}
+			case 14:
+				ms := tracker.CurrentMatch()
+				if tracker.TeamASide() == kq.BlueSide {
+					reply <- LineupUpdate{ms.LineupA, ms.LineupB}
+				} else {
+					reply <- LineupUpdate{ms.LineupB, ms.LineupA}
+				}
+			case 15:
+				u := cmd.data.(LineupUpdate)
+				ms := tracker.CurrentMatch()
+				blue, gold := &ms.LineupA, &ms.LineupB
+				if tracker.TeamASide() != kq.BlueSide {
+					blue, gold = gold, blue
+				}
+				if u.Blue != nil {
+					*blue = u.Blue
+				}
+				if u.Gold != nil {
+					*gold = u.Gold
+				}
+			case 16:
+				reply <- tracker.CurrentMatch().Id
+			case 17:
+				reply <- tournamentFormat(tracker)
 			}
+			persist()
 		}
 	}()
 
@@ -334,6 +709,55 @@ func startGameTracker() gameTracker {
 		SetOnDeckTeams: func(blue, gold string) {
 			send <- command{5, teams{blue, gold}}
 		},
+		UndoLastGame: func(event *Event) bool {
+			send <- command{6, event}
+			return (<-reply).(bool)
+		},
+		RecordGame: func(winner kq.Side, winType kq.WinType, event *Event) {
+			send <- command{7, game{winner, winType, event}}
+			<-reply
+		},
+		Games: func() []GameResult {
+			send <- command{8, nil}
+			return (<-reply).([]GameResult)
+		},
+		FinishMatch: func(advanceDelay time.Duration, event *Event) (int, bool, bool) {
+			send <- command{9, finish{advanceDelay, event}}
+			r := (<-reply).(finishReply)
+			return r.matchNumber, r.complete, r.finished
+		},
+		AdvanceFinishedMatch: func(matchNumber int, event *Event) bool {
+			send <- command{10, advanceFinished{matchNumber, event}}
+			return (<-reply).(bool)
+		},
+		StartTournament: func(setup TournamentSetup, event *Event) error {
+			send <- command{11, start{setup, event}}
+			err, _ := (<-reply).(error)
+			return err
+		},
+		Bracket: func() *BracketView {
+			send <- command{12, nil}
+			return (<-reply).(*BracketView)
+		},
+		Standings: func() *StandingsView {
+			send <- command{13, nil}
+			return (<-reply).(*StandingsView)
+		},
+		Lineup: func() LineupUpdate {
+			send <- command{14, nil}
+			return (<-reply).(LineupUpdate)
+		},
+		SetLineup: func(update LineupUpdate) {
+			send <- command{15, update}
+		},
+		MatchId: func() string {
+			send <- command{16, nil}
+			return (<-reply).(string)
+		},
+		Format: func() string {
+			send <- command{17, nil}
+			return (<-reply).(string)
+		},
 	}
 }
 
@@ -371,240 +795,472 @@ func getPlayerPhotoUri(name string) string {
 	return defaultPhotoUri
 }
 
-type teamList []string
-type playerData struct {
-	Name     string `json:"name"`
-	PhotoUri string `json:"photoUri,omitempty"`
-	Pronouns string `json:"pronouns,omitempty"`
-	Scene    string `json:"scene,omitempty"`
+// Per-connection state for a websocket client, owned by the goroutine reading
+// from the connection.
+type wsClient struct {
+	registration *chan<- *Event
+	// The cabinet the client is watching. Chosen by the client in client_start,
+	// or the default cabinet if it doesn't specify.
+	cabinet string
+
+	// Who the client is, as determined when it connected.
+	user   string
+	role   Role
+	remote string
+	// Sends an error packet to the client. Request is the type of the message
+	// at fault.
+	reportError func(request, message string)
 }
 
-func watchTeamsFile(eventOutput EventStream) *FileWatcher {
-	return WatchFile("teams.conf", func(f *os.File) {
-		var teams teamList
-		var players = make(map[string][]playerData)
-		defer func() {
-			eventOutput.AddEvent(NewControlEvent([]ControlCommand{
-				{Type: SetTeamList, Data: teams},
-				{Type: SetPlayerData, Data: players},
-			}))
-		}()
-		if f == nil {
-			fmt.Println("No teams.conf file")
-			return
+// Which sections of the server's data a client receives, and for which
+// cabinet. Both are chosen by the client's start request, and the client
+// receives nothing until then.
+type clientSubscription struct {
+	registration *chan<- *Event
+	cabinet      string
+	sections     map[string]bool
+	timeBuff     []byte
+}
+
+func newClientSubscription(registration *chan<- *Event) *clientSubscription {
+	return &clientSubscription{registration: registration, sections: make(map[string]bool)}
+}
+
+func (sub *clientSubscription) formatTime(t time.Time) string {
+	sub.timeBuff = t.AppendFormat(sub.timeBuff[:0], time.RFC3339Nano)
+	return string(sub.timeBuff)
+}
+
+// Returns the "next" part of the prediction section for a data point.
+func (sub *clientSubscription) predictionNext(dp dataPoint) dataPart {
+	d := make(map[string]interface{})
+	d["time"] = sub.formatTime(dp.when)
+	if dp.event != "" {
+		d["event"] = dp.event
+	}
+	d["scores"] = dp.vals
+	return dataPart{Tag: "next", Data: d}
+}
+
+// Returns the "stats" part of the prediction section for a data point.
+func predictionStats(dp dataPoint) dataPart {
+	s := make(map[string]interface{})
+	s["stats"] = dp.stats
+	s["status"] = dp.status
+	s["map"] = dp.mp
+	s["duration"] = dp.dur
+	if dp.winner != "" {
+		s["winner"] = dp.winner
+		s["winType"] = dp.winType
+	}
+	return dataPart{Tag: "stats", Data: s}
+}
+
+// Calls send with each packet the client should receive for an event, in
+// order. If the event is the client's start request, the subscription is
+// updated first. The packet may be reused once send returns.
+func (sub *clientSubscription) packets(event *Event, send func(p interface{})) {
+	opts, ownStart := clientStartOptions(event)
+	ownStart = ownStart && opts.ClientIdentifier == sub.registration
+	if ownStart {
+		sub.cabinet = event.Cabinet
+		for section := range opts.Sections {
+			sub.sections[section] = true
 		}
-		s := bufio.NewScanner(f)
-		var currTeamName string
-		for s.Scan() {
-			str := s.Text()
-			if len(str) == 0 {
-				continue
+		send(newClientStartPacket(opts.Version, sub.cabinet, sub.sections, opts.Resync))
+	}
+	if !event.AppliesTo(sub.cabinet) {
+		return
+	}
+
+	if ed, ok := event.Data[ClientErrorKey].(errorData); ok {
+		send(errorPacket{"error", ed})
+		return
+	}
+	if err, ok := event.Data[ControlErrorKey].(error); ok && sub.sections["control"] {
+		send(errorPacket{"error", errorData{Message: err.Error()}})
+	}
+	p := packet{Type: "data"}
+	if sub.sections["prediction"] {
+		p.Data.Section = "prediction"
+		if h, ok := event.Data[PredictionHistoryKey].(predictionHistory); ok && ownStart {
+			// Replaces whatever the client had, including anything it lost
+			// while falling behind. Only the latest stats matter.
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "reset", Data: sub.formatTime(h.start)})
+			for _, dp := range h.points {
+				p.Data.Parts = append(p.Data.Parts, sub.predictionNext(dp))
 			}
-			if str[0] == '\t' {
-				if currTeamName == "" {
-					fmt.Println("Invalid teams.conf: player data outside a team")
-				} else {
-					var pd playerData
-					switch parts := strings.Split(str[1:], ","); true {
-					case len(parts) >= 3:
-						pd.Pronouns = parts[2]
-						fallthrough
-					case len(parts) == 2:
-						pd.Scene = parts[1]
-						fallthrough
-					default:
-						pd.Name = parts[0]
-						pd.PhotoUri = getPlayerPhotoUri(parts[0])
-					}
-					players[currTeamName] = append(players[currTeamName], pd)
+			if n := len(h.points); n > 0 {
+				p.Data.Parts = append(p.Data.Parts, predictionStats(h.points[n-1]))
+			}
+		}
+		if t, ok := event.Data[GameStartTimeKey].(time.Time); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "reset", Data: sub.formatTime(t)})
+		}
+		if dp, ok := event.Data[StatsUpdateKey].(dataPoint); ok {
+			p.Data.Parts = append(p.Data.Parts, sub.predictionNext(dp), predictionStats(dp))
+		}
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
+		}
+	}
+
+	if sub.sections["famineTracker"] {
+		p.Data.Section = "famineTracker"
+		if fu, ok := event.Data[FamineUpdateKey].(FamineUpdate); ok {
+			d := map[string]interface{}{
+				"berriesLeft": fu.BerriesLeft,
+				"inFamine":    !fu.FamineStart.IsZero(),
+			}
+			if !fu.FamineStart.IsZero() {
+				dur := 90*time.Second - fu.CurrTime.Sub(fu.FamineStart)
+				if dur < 0 {
+					dur = 0
 				}
-			} else {
-				teams = append(teams, str)
-				currTeamName = str
-				// Preallocate the memory, and make sure there is an entry in
-				// the map even if there is no player info for the team.
-				players[currTeamName] = make([]playerData, 0, 5)
+				d["famineLeftSeconds"] = float64(dur) / float64(time.Second)
 			}
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "update", Data: d})
 		}
-		if err := s.Err(); err != nil {
-			fmt.Printf("Error reading teams: %v\n", err)
-			return
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
 		}
-		fmt.Printf("Loaded %v teams\n", len(teams))
-	})
-}
+	}
 
-func handleWSIncoming(r io.Reader, registration *chan<- *Event, eventOutput EventStream) {
-	dec := json.NewDecoder(r)
-	dec.DisallowUnknownFields()
-	var tok json.Token
-	var err error
-	// TODO: Send back an error on parse error, handle inputs.
-	if tok, err = dec.Token(); err != nil {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v, ok := tok.(json.Delim); !ok {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v != '{' {
-		fmt.Println("failed to parse message;", err)
-		return
+	if sub.sections["control"] {
+		p.Data.Section = "control"
+		if vr, ok := event.Data[VictoryRuleKey].(MatchVictoryRule); ok {
+			d := map[string]interface{}{"victoryRule": victoryRuleToJSON(vr)}
+			p.Data.Parts = []dataPart{{Tag: "matchSettings", Data: d}}
+		}
+		if tu, ok := event.Data[TeamUpdateKey].(TeamUpdate); ok {
+			t := make(map[string]interface{})
+			t["blue"] = tu.Blue
+			t["gold"] = tu.Gold
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "currentTeams", Data: t})
+		}
+		if su, ok := event.Data[ScoreUpdateKey].(ScoreUpdate); ok {
+			s := make(map[string]interface{})
+			s["blue"] = su.Blue
+			s["gold"] = su.Gold
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "currentScores", Data: s})
+		}
+		if gl, ok := event.Data[GameListKey].([]GameResult); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "currentGames", Data: gl})
+		}
+		if mc, ok := event.Data[MatchCompleteKey].(MatchComplete); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "matchComplete", Data: matchCompleteJSON(mc)})
+		}
+		if tl, ok := event.Data[TeamListKey].(teamList); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teamList", Data: tl})
+		}
+		if re, ok := event.Data[RosterErrorsKey].([]string); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "rosterErrors", Data: re})
+		}
+		lineups, _ := event.Data[LineupKey].(map[string]LineupView)
+		if lv, ok := lineups[sub.cabinet]; ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "currentLineup", Data: lv.Assigned})
+		}
+		if ts, ok := event.Data[TeamSidesKey].(teamSidesJSON); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teamSides", Data: ts})
+		}
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
+		}
 	}
-	if tok, err = dec.Token(); err != nil {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v, ok := tok.(string); !ok {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v != "type" {
-		fmt.Println("failed to parse message;", err)
-		return
+
+	if sub.sections["currentMatch"] {
+		p.Data.Section = "currentMatch"
+		if vr, ok := event.Data[VictoryRuleKey].(MatchVictoryRule); ok {
+			d := map[string]interface{}{"victoryRule": victoryRuleToJSON(vr)}
+			p.Data.Parts = []dataPart{{Tag: "settings", Data: d}}
+		}
+		if tu, ok := event.Data[TeamUpdateKey].(TeamUpdate); ok {
+			t := make(map[string]interface{})
+			t["blue"] = tu.Blue
+			t["gold"] = tu.Gold
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teams", Data: t})
+		}
+		if su, ok := event.Data[ScoreUpdateKey].(ScoreUpdate); ok {
+			s := make(map[string]interface{})
+			s["blue"] = su.Blue
+			s["gold"] = su.Gold
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "scores", Data: s})
+		}
+		if gl, ok := event.Data[GameListKey].([]GameResult); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "games", Data: gl})
+		}
+		if mc, ok := event.Data[MatchCompleteKey].(MatchComplete); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "matchComplete", Data: matchCompleteJSON(mc)})
+		}
+		lineups, _ := event.Data[LineupKey].(map[string]LineupView)
+		if lv, ok := lineups[sub.cabinet]; ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "lineup", Data: lv.Players})
+		}
+		if ts, ok := event.Data[TeamSidesKey].(teamSidesJSON); ok {
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teamSides", Data: ts})
+		}
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
+		}
 	}
-	var typ string
-	if tok, err = dec.Token(); err != nil {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v, ok := tok.(string); !ok {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else {
-		typ = v
+
+	if sub.sections["bracket"] {
+		if bv, ok := event.Data[BracketKey].(*BracketView); ok {
+			p.Data.Section = "bracket"
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "bracket", Data: bv})
+		}
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
+		}
 	}
-	if tok, err = dec.Token(); err != nil {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v, ok := tok.(string); !ok {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v != "data" {
-		fmt.Println("failed to parse message;", err)
-		return
+
+	if sub.sections["standings"] {
+		if sv, ok := event.Data[StandingsKey].(*StandingsView); ok {
+			p.Data.Section = "standings"
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "standings", Data: sv})
+		}
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
+		}
 	}
-	// TODO: Parse an expected structure based on type.
-	var data interface{}
-	if err = dec.Decode(&data); err != nil {
-		fmt.Println("failed to parse message;", err)
-		return
+
+	if sub.sections["tournamentData"] {
+		if pd, ok := event.Data[PlayerDataKey].(map[string][]playerData); ok {
+			p.Data.Section = "tournamentData"
+			p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teams", Data: pd})
+		}
+		if len(p.Data.Parts) > 0 {
+			send(&p)
+			p.Data.Parts = p.Data.Parts[:0]
+		}
 	}
-	if tok, err = dec.Token(); err != nil {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v, ok := tok.(json.Delim); !ok {
-		fmt.Println("failed to parse message;", err)
-		return
-	} else if v != '}' {
+}
+
+// Handles a message from a websocket client. The first of the cabinets is used
+// by clients which do not pick one.
+func handleWSIncoming(r io.Reader, client *wsClient, cabinets []string, audit *auditLog, eventOutput EventStream) {
+	var msg wsMessage
+	if err := decodeStrict(r, &msg); err != nil {
 		fmt.Println("failed to parse message;", err)
+		client.reportError("", fmt.Sprintf("invalid message: %v", err))
 		return
 	}
-	if tok, err = dec.Token(); err != io.EOF {
-		fmt.Println("failed to parse message; expected EOF; got", tok)
+	if client.cabinet == "" {
+		client.cabinet = cabinets[0]
 	}
-	switch typ {
+	knownCabinet := func(name string) bool {
+		for _, cab := range cabinets {
+			if cab == name {
+				return true
+			}
+		}
+		return false
+	}
+	switch msg.Type {
 	case "client_start":
-		s := data.(map[string]interface{})["sections"].([]interface{})
-		sections := make(map[string]bool)
-		for _, v := range s {
-			sections[v.(string)] = true
+		var data clientStartRequest
+		if err := decodeData(msg.Data, &data); err != nil {
+			client.reportError(msg.Type, fmt.Sprintf("invalid client_start: %v", err))
+			return
+		}
+		version, ok := negotiateVersion(data.Versions)
+		if !ok {
+			client.reportError(msg.Type, fmt.Sprintf("no common protocol version; the server speaks %v", wsProtocolVersions))
+			return
+		}
+		sections, err := parseSections(data.Sections)
+		if err != nil {
+			client.reportError(msg.Type, err.Error())
+			return
+		}
+		if data.Cabinet != "" {
+			if !knownCabinet(data.Cabinet) {
+				client.reportError(msg.Type, fmt.Sprintf("unknown cabinet %q", data.Cabinet))
+				return
+			}
+			client.cabinet = data.Cabinet
 		}
-		eventOutput.AddEvent(NewControlEvent([]ControlCommand{{
+		eventOutput.AddEvent(NewControlEvent(client.cabinet, []ControlCommand{{
 			Type: ClientStartRequest,
 			Data: ClientStartOptions{
-				ClientIdentifier: registration,
+				ClientIdentifier: client.registration,
 				Sections:         sections,
+				Version:          version,
 			},
 		}}))
 	case "data":
-		m := data.(map[string]interface{})
-		if m["section"].(string) != "control" {
-			break
+		var data dataRequest
+		if err := decodeData(msg.Data, &data); err != nil {
+			client.reportError(msg.Type, fmt.Sprintf("invalid data: %v", err))
+			return
+		}
+		if data.Section != "control" {
+			client.reportError(msg.Type, fmt.Sprintf("section %q does not accept data", data.Section))
+			return
+		}
+		if !knownCabinet(client.cabinet) {
+			client.reportError(msg.Type, fmt.Sprintf("unknown cabinet %q", client.cabinet))
+			return
 		}
 		var commands []ControlCommand
-		for _, part := range m["parts"].([]interface{}) {
-			tag := part.(map[string]interface{})["tag"]
-			d := part.(map[string]interface{})["data"]
-			switch tag {
-			case "advanceMatch":
-				commands = append(commands, ControlCommand{AdvanceMatch, nil})
-			case "reset":
-				for _, p := range d.([]interface{}) {
-					switch p {
-					case "matchSettings":
-						commands = append(commands, ControlCommand{SetVictoryRule, BestOfN(0)})
-					case "currentTeams":
-						commands = append(commands, ControlCommand{SetCurrentTeams, TeamUpdate{"", ""}})
-					case "currentScores":
-						commands = append(commands, ControlCommand{SetScores, ScoreUpdate{0, 0}})
-					}
-				}
-			case "matchSettings":
-				vr := d.(map[string]interface{})["victoryRule"]
-				if vr == nil {
-					commands = append(commands, ControlCommand{SetVictoryRule, BestOfN(0)})
-					break
-				}
-				var rule MatchVictoryRule
-				switch vr.(map[string]interface{})["rule"] {
-				case "BestOfN":
-					rule = BestOfN(vr.(map[string]interface{})["length"].(float64))
-				case "StraightN":
-					rule = StraightN(vr.(map[string]interface{})["length"].(float64))
-				}
-				if rule == nil {
-					break
-				}
-				commands = append(commands, ControlCommand{SetVictoryRule, rule})
-			case "currentTeams":
-				commands = append(commands, ControlCommand{SetCurrentTeams, TeamUpdate{
-					d.(map[string]interface{})["blue"].(string),
-					d.(map[string]interface{})["gold"].(string),
-				}})
-			case "currentScores":
-				commands = append(commands, ControlCommand{SetScores, ScoreUpdate{
-					int(d.(map[string]interface{})["blue"].(float64)),
-					int(d.(map[string]interface{})["gold"].(float64)),
-				}})
+		for _, part := range data.Parts {
+			c, err := part.controlCommands()
+			if err != nil {
+				client.reportError(msg.Type, fmt.Sprintf("invalid %q part: %v", part.Tag, err))
+				return
 			}
+			commands = append(commands, c...)
 		}
-		if len(commands) > 0 {
-			eventOutput.AddEvent(NewControlEvent(commands))
+		if len(commands) == 0 {
+			break
 		}
+		if client.role < OperatorRole {
+			fmt.Printf("Rejected control commands from %s (%s); not an operator\n", client.remote, client.role)
+			client.reportError(msg.Type, "not authorized to control the match")
+			break
+		}
+		audit.Record(client.user, client.role, client.remote, "ws", client.cabinet, commands)
+		eventOutput.AddEvent(NewControlEvent(client.cabinet, commands))
+	default:
+		client.reportError(msg.Type, fmt.Sprintf("unknown message type %q", msg.Type))
 	}
 }
 
-func startWebServer(bindAddr string, eventStream EventStream) {
+// Runs the web server for the named cabinets. The first cabinet is used by
+// clients which do not pick one.
+func startWebServer(bindAddr string, cabinets []string, sides map[string]*tracking.TeamSides, automation MatchAutomation, state *stateFile, rosterFile string, games *gameStore, eventName string, auth *authenticator, audit *auditLog, eventStream EventStream) {
 	outgoingEvents := make(chan *Event)
-	tracker := startGameTracker()
+	trackers := make(map[string]gameTracker)
+	for _, cab := range cabinets {
+		trackers[cab] = startGameTracker(cab, state)
+	}
+	defaultCabinet := cabinets[0]
+	automator := newMatchAutomator(automation, eventStream)
+	for _, cab := range cabinets {
+		automator.resumed(cab, trackers[cab])
+	}
 	go func() {
 		var currTeams teamList
 		var currPlayers map[string][]playerData
+		currRosterErrors := []string{}
+		lineupView := func(t gameTracker) LineupView {
+			assigned := t.Lineup()
+			blueTeam, goldTeam := t.CurrentTeams()
+			return LineupView{assigned, Lineup{
+				Blue: fillLineup(assigned.Blue, currPlayers[blueTeam]),
+				Gold: fillLineup(assigned.Gold, currPlayers[goldTeam]),
+			}}
+		}
+		// Attaches the lineup of every cabinet the event applies to.
+		attachLineups := func(e *Event) {
+			lineups := make(map[string]LineupView)
+			for cab, t := range trackers {
+				if e.AppliesTo(cab) {
+					lineups[cab] = lineupView(t)
+				}
+			}
+			e.Data[LineupKey] = lineups
+		}
+		// Each cabinet's predictions in its current or last game, so
+		// prediction clients can catch up.
+		histories := make(map[string]*predictionHistory)
 		var e *Event
 		for e = eventStream.Next(); e != nil; e = eventStream.Next() {
+			tracker, hasTracker := trackers[e.Cabinet]
+			if e.Cabinet != "" && !hasTracker {
+				fmt.Printf("Dropping event for unknown cabinet %q\n", e.Cabinet)
+				continue
+			}
 			switch e.Type {
 			case CabMessageEvent:
-				if dp := e.Data[StatsUpdateKey]; dp != nil {
-					switch dp.(dataPoint).winner {
-					case "blue":
-						b, g := tracker.Scores()
-						tracker.SetScores(b+1, g, e)
-					case "gold":
-						b, g := tracker.Scores()
-						tracker.SetScores(b, g+1, e)
+				if t, ok := e.Data[GameStartTimeKey].(time.Time); ok {
+					histories[e.Cabinet] = &predictionHistory{start: t}
+				}
+				if dp, ok := e.Data[StatsUpdateKey].(dataPoint); ok {
+					h := histories[e.Cabinet]
+					if h == nil {
+						// The game started before the server did.
+						h = &predictionHistory{start: dp.when.Add(-dp.dur)}
+						histories[e.Cabinet] = h
+					}
+					h.points = append(h.points, dp)
+				}
+				// Only count victories which also produced a stats update, so
+				// games from before the server started are not recorded.
+				msg := e.Data[CabMessageKey].(*kqio.Message)
+				if dp, ok := e.Data[StatsUpdateKey].(dataPoint); ok && msg.Type == "victory" {
+					result := msg.Val.(parser.GameResultMessage)
+					automator.beforeGame(e.Cabinet, tracker, e)
+					tracker.RecordGame(result.Winner, result.EndCondition, e)
+					blueTeam, goldTeam := tracker.CurrentTeams()
+					fg, _ := e.Data[FinishedGameKey].(*finishedGame)
+					g := newStoredGame(e.Cabinet, eventName, &dp, fg, TeamUpdate{blueTeam, goldTeam}, lineupView(tracker).Players)
+					g.MatchId, g.GameNumber, g.Tournament = tracker.MatchId(), len(tracker.Games()), tracker.Format()
+					var messages []kqio.MessageString
+					if fg != nil {
+						messages = fg.messages
+					}
+					if err := games.Add(g, messages); err != nil {
+						fmt.Println("Failed to store game:", err)
+					}
+					automator.gameRecorded(e.Cabinet, tracker, e)
+					e.Data[BracketKey] = tracker.Bracket()
+					e.Data[StandingsKey] = tracker.Standings()
+					if _, ok := e.Data[TeamUpdateKey]; ok {
+						attachLineups(e)
 					}
 				}
 
 			case ControlEvent:
+				lineupChanged := false
 				for _, command := range e.Data[ControlCommandKey].([]ControlCommand) {
 					switch command.Type {
 					case AdvanceMatch:
+						automator.cancel(e.Cabinet)
 						tracker.AdvanceMatch(e)
 					case SetVictoryRule:
 						tracker.SetVictoryRule(command.Data.(MatchVictoryRule), e)
+						automator.matchChanged(e.Cabinet, tracker, e)
 					case SetCurrentTeams:
 						update := command.Data.(TeamUpdate)
 						tracker.SetCurrentTeams(update.Blue, update.Gold, e)
 					case SetScores:
 						update := command.Data.(ScoreUpdate)
+						if err := update.validate(); err != nil {
+							e.Data[ControlErrorKey] = fmt.Errorf("cannot set scores: %v", err)
+							break
+						}
 						tracker.SetScores(update.Blue, update.Gold, e)
+						automator.matchChanged(e.Cabinet, tracker, e)
+					case SwapSides:
+						tracker.SwapSides(e)
+					case SetOnDeckTeams:
+						update := command.Data.(TeamUpdate)
+						tracker.SetOnDeckTeams(update.Blue, update.Gold)
+					case UndoLastGame:
+						if !tracker.UndoLastGame(e) {
+							e.Data[ControlErrorKey] = errNoGameToUndo
+							break
+						}
+						// Undoing a game can reopen a finished match.
+						automator.matchChanged(e.Cabinet, tracker, e)
+					case AutoAdvanceMatch:
+						automator.scheduledAdvance(e.Cabinet, tracker, command.Data.(int), e)
+					case SetTournament:
+						setup := command.Data.(TournamentSetup)
+						if len(setup.Teams) == 0 {
+							setup.Teams = currTeams
+						}
+						if err := tracker.StartTournament(setup, e); err != nil {
+							fmt.Println("Cannot start tournament:", err)
+							e.Data[ControlErrorKey] = fmt.Errorf("cannot start tournament: %v", err)
+						}
 
 					case SetTeamList:
 						currTeams = command.Data.(teamList)
@@ -613,8 +1269,31 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 					case SetPlayerData:
 						currPlayers = command.Data.(map[string][]playerData)
 						e.Data[PlayerDataKey] = currPlayers
+						lineupChanged = true
+
+					case SetRosterErrors:
+						currRosterErrors = command.Data.([]string)
+						e.Data[RosterErrorsKey] = currRosterErrors
+
+					case SetLineup:
+						update := command.Data.(LineupUpdate)
+						if err := update.validate(); err != nil {
+							e.Data[ControlErrorKey] = fmt.Errorf("cannot set lineup: %v", err)
+							break
+						}
+						tracker.SetLineup(update)
+						lineupChanged = true
+
+					case SetTeamSides:
+						if err := setLeftTeam(sides[e.Cabinet], command.Data.(string)); err != nil {
+							e.Data[ControlErrorKey] = fmt.Errorf("cannot set team sides: %v", err)
+							break
+						}
+						e.Data[TeamSidesKey] = teamSidesToJSON(sides[e.Cabinet])
 
 					case ClientStartRequest:
+						// Client start requests always name a cabinet, so the
+						// tracker is valid.
 						sections := command.Data.(ClientStartOptions).Sections
 						// Attach current state.
 						if sections["control"] || sections["currentMatch"] {
@@ -623,25 +1302,61 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 							e.Data[TeamUpdateKey] = TeamUpdate{blueTeam, goldTeam}
 							blueScore, goldScore := tracker.Scores()
 							e.Data[ScoreUpdateKey] = ScoreUpdate{blueScore, goldScore}
+							e.Data[GameListKey] = tracker.Games()
 						}
 						if sections["control"] {
 							e.Data[TeamListKey] = currTeams
+							e.Data[RosterErrorsKey] = currRosterErrors
 						}
 						if sections["tournamentData"] {
 							e.Data[PlayerDataKey] = currPlayers
 						}
+						if sections["control"] || sections["currentMatch"] {
+							lineupChanged = true
+							e.Data[TeamSidesKey] = teamSidesToJSON(sides[e.Cabinet])
+						}
+						if h := histories[e.Cabinet]; h != nil && sections["prediction"] {
+							// The history keeps growing, but the client only
+							// sees the points so far.
+							e.Data[PredictionHistoryKey] = predictionHistory{h.start, h.points[:len(h.points):len(h.points)]}
+						}
 					}
 				}
+				if _, ok := e.Data[TeamUpdateKey]; ok || lineupChanged {
+					attachLineups(e)
+				}
+				if hasTracker {
+					e.Data[BracketKey] = tracker.Bracket()
+					e.Data[StandingsKey] = tracker.Standings()
+				}
+				if done, ok := e.Data[ControlDoneKey].(chan struct{}); ok {
+					close(done)
+				}
 			}
 			outgoingEvents <- e
 		}
 	}()
 
-	defer watchTeamsFile(eventStream).Close()
+	defer watchRosterFiles(rosterFile, eventStream).Close()
+
+	matchAPI := &matchAPI{trackers, sides, defaultCabinet, auth, audit, eventStream}
+	http.Handle("/api/match", matchAPI)
+	http.Handle("/api/match/", matchAPI)
+	statsAPI := &playerStatsAPI{games, eventName, trackers, defaultCabinet}
+	http.Handle("/api/stats/players", auth.require(OverlayRole, statsAPI.ServeHTTP))
+	gamesAPI := &gameStoreAPI{games}
+	http.Handle("/api/games", auth.require(OverlayRole, gamesAPI.ServeHTTP))
+	http.Handle("/api/games/", auth.require(OverlayRole, gamesAPI.ServeHTTP))
 
-	reg := make(chan *chan<- *Event, 1)
+	reg := make(chan *clientRegistration, 1)
 	unreg := make(chan *chan<- *Event)
-	go runRegistry(outgoingEvents, reg, unreg)
+	clientMetricsRequests := make(chan chan<- []clientMetrics)
+	go runRegistry(outgoingEvents, reg, unreg, clientMetricsRequests, eventStream)
+	http.Handle("/api/clients", auth.require(OperatorRole, func(w http.ResponseWriter, req *http.Request) {
+		reply := make(chan []clientMetrics, 1)
+		clientMetricsRequests <- reply
+		writeJSON(w, <-reply)
+	}))
 	http.Handle("/static/", http.FileServer(assets.FS))
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		var content http.File
@@ -672,7 +1387,7 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 		}
 		http.ServeContent(w, req, "index.html", modtime, content)
 	})
-	http.HandleFunc("/control/scores", func(w http.ResponseWriter, req *http.Request) {
+	http.Handle("/control/scores", auth.require(OperatorRole, func(w http.ResponseWriter, req *http.Request) {
 		// TODO: Serve the gzip-encoded form if available.
 		content, err := assets.FS.Open("/score_control.html")
 		if err != nil {
@@ -683,10 +1398,20 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 			modtime = info.ModTime()
 		}
 		http.ServeContent(w, req, "score_control.html", modtime, content)
-	})
+	}))
+	// Whether gold is on the left of the cabinet a page is for, for pages
+	// laid out by side.
+	goldOnLeft := func(req *http.Request) bool {
+		cabinet := req.FormValue("cab")
+		if cabinet == "" {
+			cabinet = defaultCabinet
+		}
+		s, ok := sides[cabinet]
+		return ok && s.GoldOnLeft()
+	}
 	scoreboardTpl := requireTemplate("scoreboard", http.Dir("config"))
-	http.HandleFunc("/scoreboard", func(w http.ResponseWriter, rep *http.Request) {
-		err := scoreboardTpl.Execute(w, map[string]interface{}{"GoldOnLeft": false})
+	http.HandleFunc("/scoreboard", func(w http.ResponseWriter, req *http.Request) {
+		err := scoreboardTpl.Execute(w, map[string]interface{}{"GoldOnLeft": goldOnLeft(req)})
 		if err != nil {
 			panic(err)
 		}
@@ -723,21 +1448,42 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 	})
 	teamPicsTpl := requireTemplate("team_pictures", assets.FS)
 	http.HandleFunc("/teamPictures", func(w http.ResponseWriter, req *http.Request) {
-		err := teamPicsTpl.Execute(w, map[string]interface{}{"GoldOnLeft": false, "DefaultPlayerPhoto": nil})
+		err := teamPicsTpl.Execute(w, map[string]interface{}{"GoldOnLeft": goldOnLeft(req), "DefaultPlayerPhoto": nil})
 		if err != nil {
 			panic(err)
 		}
 	})
 	postGameStatsTpl := requireTemplate("post_game_stats", assets.FS)
 	http.HandleFunc("/postGameStats", func(w http.ResponseWriter, req *http.Request) {
-		err := postGameStatsTpl.Execute(w, map[string]interface{}{"GoldOnLeft": false})
+		err := postGameStatsTpl.Execute(w, map[string]interface{}{"GoldOnLeft": goldOnLeft(req)})
+		if err != nil {
+			panic(err)
+		}
+	})
+	bracketTpl := requireTemplate("bracket", assets.FS)
+	http.HandleFunc("/bracket", func(w http.ResponseWriter, req *http.Request) {
+		err := bracketTpl.Execute(w, nil)
+		if err != nil {
+			panic(err)
+		}
+	})
+	standingsTpl := requireTemplate("standings", assets.FS)
+	http.HandleFunc("/standings", func(w http.ResponseWriter, req *http.Request) {
+		err := standingsTpl.Execute(w, nil)
+		if err != nil {
+			panic(err)
+		}
+	})
+	leaderboardTpl := requireTemplate("leaderboard", assets.FS)
+	http.HandleFunc("/leaderboard", func(w http.ResponseWriter, req *http.Request) {
+		err := leaderboardTpl.Execute(w, nil)
 		if err != nil {
 			panic(err)
 		}
 	})
 	statusTpl := requireTemplate("status", assets.FS)
 	http.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
-		err := statusTpl.Execute(w, map[string]interface{}{"GoldOnLeft": false, "DefaultPlayerPhoto": nil})
+		err := statusTpl.Execute(w, map[string]interface{}{"GoldOnLeft": goldOnLeft(req), "DefaultPlayerPhoto": nil})
 		if err != nil {
 			panic(err)
 		}
@@ -756,7 +1502,7 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 		http.ServeContent(w, req, fn, modtime, f)
 	})
 	var upgrader websocket.Upgrader
-	http.HandleFunc("/predictions", func(w http.ResponseWriter, req *http.Request) {
+	http.Handle("/predictions", auth.require(OverlayRole, func(w http.ResponseWriter, req *http.Request) {
 		conn, err := upgrader.Upgrade(w, req, nil)
 		if err != nil {
 			fmt.Println(err)
@@ -770,48 +1516,87 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 				}
 			}
 		}()
+		cabinet := req.FormValue("cab")
+		if cabinet == "" {
+			cabinet = defaultCabinet
+		}
+		user, _ := auth.identify(req)
 		c := make(chan *Event, 256)
 		var writeEnd chan<- *Event = c
-		reg <- &writeEnd
+		reg <- &clientRegistration{token: &writeEnd, endpoint: "/predictions", remote: req.RemoteAddr, user: user, cabinet: cabinet}
+		// Subscribing gets the predictions so far, and lets the client be
+		// resynced if it falls behind.
+		eventStream.AddEvent(NewControlEvent(cabinet, []ControlCommand{{
+			Type: ClientStartRequest,
+			Data: ClientStartOptions{
+				ClientIdentifier: &writeEnd,
+				Sections:         map[string]bool{"prediction": true},
+			},
+		}}))
 		go func() {
-			var timeBuff []byte
+			var line []byte
+			send := func() bool {
+				if e := conn.WriteMessage(websocket.TextMessage, line); e != nil {
+					fmt.Println(e)
+					return false
+				}
+				return true
+			}
+			// The number of traces in the last reset, or -1 before the
+			// first. A reset is resent whenever the number of models
+			// changes, so every line has one value per trace.
+			traces := -1
+			reset := func(start time.Time, n int) bool {
+				traces = n
+				line = append(line[:0], "reset,"...)
+				line = start.AppendFormat(line, time.RFC3339Nano)
+				line = append(line, ',')
+				line = strconv.AppendInt(line, int64(n), 10)
+				return send()
+			}
+			next := func(dp dataPoint) bool {
+				if len(dp.vals) != traces && !reset(dp.when.Add(-dp.dur), len(dp.vals)) {
+					return false
+				}
+				line = append(line[:0], "next,"...)
+				line = dp.when.AppendFormat(line, time.RFC3339Nano)
+				line = append(line, ',')
+				line = append(line, dp.event...)
+				for _, val := range dp.vals {
+					line = append(line, fmt.Sprintf(",%v", val)...)
+				}
+				return send()
+			}
+		events:
 			for ev := range c {
-				if t, ok := ev.Data[GameStartTimeKey].(time.Time); ok {
-					w, e := conn.NextWriter(websocket.TextMessage)
-					if e != nil {
-						fmt.Println(e)
-						break
-					}
-					timeBuff = t.AppendFormat(timeBuff[:0], time.RFC3339Nano)
-					_, e = fmt.Fprintf(w, "reset,%s,6", timeBuff)
-					ce := w.Close()
-					if e != nil {
-						fmt.Println(e)
-						break
+				if !ev.AppliesTo(cabinet) {
+					continue
+				}
+				if opts, ok := clientStartOptions(ev); ok && opts.ClientIdentifier == &writeEnd {
+					// Replaces whatever the client had, including anything
+					// it lost while falling behind.
+					if h, ok := ev.Data[PredictionHistoryKey].(predictionHistory); ok {
+						n := len(StateScorerNames())
+						if len(h.points) > 0 {
+							n = len(h.points[0].vals)
+						}
+						if !reset(h.start, n) {
+							break
+						}
+						for _, dp := range h.points {
+							if !next(dp) {
+								break events
+							}
+						}
 					}
-					if ce != nil {
-						fmt.Println(ce)
+				}
+				if t, ok := ev.Data[GameStartTimeKey].(time.Time); ok {
+					if !reset(t, len(StateScorerNames())) {
 						break
 					}
 				}
 				if dp, ok := ev.Data[StatsUpdateKey].(dataPoint); ok {
-					w, e := conn.NextWriter(websocket.TextMessage)
-					if e != nil {
-						fmt.Println(e)
-						break
-					}
-					timeBuff = dp.when.AppendFormat(timeBuff[:0], time.RFC3339Nano)
-					_, e = fmt.Fprintf(w, "next,%s,%s", timeBuff, dp.event)
-					for _, val := range dp.vals {
-						_, e = fmt.Fprintf(w, ",%v", val)
-					}
-					ce := w.Close()
-					if e != nil {
-						fmt.Println(e)
-						break
-					}
-					if ce != nil {
-						fmt.Println(ce)
+					if !next(dp) {
 						break
 					}
 				}
@@ -819,8 +1604,12 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 			unreg <- &writeEnd
 			conn.Close()
 		}()
-	})
+	}))
 	http.HandleFunc("/ws", func(w http.ResponseWriter, req *http.Request) {
+		user, role, ok := auth.authorize(w, req, OverlayRole)
+		if !ok {
+			return
+		}
 		conn, err := upgrader.Upgrade(w, req, nil)
 		if err != nil {
 			fmt.Println(err)
@@ -829,8 +1618,21 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 		shutdown := make(chan struct{})
 		c := make(chan *Event, 256)
 		var writeEnd chan<- *Event = c
-		reg <- &writeEnd
+		reg <- &clientRegistration{token: &writeEnd, endpoint: "/ws", remote: req.RemoteAddr, user: user}
 		go func() {
+			client := &wsClient{
+				registration: &writeEnd,
+				user:         user,
+				role:         role,
+				remote:       req.RemoteAddr,
+				reportError: func(request, message string) {
+					e := &Event{When: time.Now(), Type: ControlEvent, Data: map[interface{}]interface{}{ClientErrorKey: errorData{message, request}}}
+					select {
+					case c <- e:
+					default: // The client is too far behind to notice anyway.
+					}
+				},
+			}
 			for {
 				_, r, err := conn.NextReader()
 				if err != nil {
@@ -838,7 +1640,7 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 					close(shutdown)
 					break
 				}
-				handleWSIncoming(r, &writeEnd, eventStream)
+				handleWSIncoming(r, client, cabinets, audit, eventStream)
 			}
 		}()
 		go func() {
@@ -846,12 +1648,26 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 				unreg <- &writeEnd
 				conn.Close()
 			}()
-			var timeBuff []byte
-			doPredictions := false
-			doControl := false
-			doCurrentMatch := false
-			doFamineUpdates := false
-			doTournamentData := false
+			sub := newClientSubscription(&writeEnd)
+			send := func(p interface{}) {
+				w, e := conn.NextWriter(websocket.TextMessage)
+				if e != nil {
+					fmt.Println(e)
+					return
+				}
+				enc := json.NewEncoder(w)
+				enc.SetEscapeHTML(false)
+				e = enc.Encode(p)
+				ce := w.Close()
+				if e != nil {
+					fmt.Println(e)
+					return
+				}
+				if ce != nil {
+					fmt.Println(ce)
+					return
+				}
+			}
 			for {
 				var event *Event
 				select {
@@ -862,198 +1678,112 @@ func startWebServer(bindAddr string, eventStream EventStream) {
 					}
 					continue
 				}
-				if cmd, ok := event.Data[ControlCommandKey].([]ControlCommand); event.Type == ControlEvent && ok && len(cmd) == 1 && cmd[0].Type == ClientStartRequest && cmd[0].Data.(ClientStartOptions).ClientIdentifier == &writeEnd {
-					for s := range cmd[0].Data.(ClientStartOptions).Sections {
-						switch s {
-						case "prediction":
-							doPredictions = true
-						case "control":
-							doControl = true
-						case "currentMatch":
-							doCurrentMatch = true
-						case "famineTracker":
-							doFamineUpdates = true
-						case "tournamentData":
-							doTournamentData = true
-						}
-					}
-				}
-
-				type dataPart struct {
-					Tag  string      `json:"tag"`
-					Data interface{} `json:"data,omitempty"`
-				}
-				type packetData struct {
-					Section string     `json:"section"`
-					Parts   []dataPart `json:"parts"`
-				}
-				type packet struct {
-					// Assume the encoder processes fields in declared order.
-					Type string     `json:"type"`
-					Data packetData `json:"data"`
-				}
-				send := func(p *packet) {
-					defer func() { p.Data.Parts = p.Data.Parts[:0] }()
-					w, e := conn.NextWriter(websocket.TextMessage)
-					if e != nil {
-						fmt.Println(e)
-						return
-					}
-					enc := json.NewEncoder(w)
-					enc.SetEscapeHTML(false)
-					e = enc.Encode(p)
-					ce := w.Close()
-					if e != nil {
-						fmt.Println(e)
-						return
-					}
-					if ce != nil {
-						fmt.Println(ce)
-						return
-					}
-				}
-				p := packet{Type: "data"}
-				if doPredictions {
-					p.Data.Section = "prediction"
-					if t, ok := event.Data[GameStartTimeKey].(time.Time); ok {
-						timeBuff = t.AppendFormat(timeBuff[:0], time.RFC3339Nano)
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "reset", Data: string(timeBuff)})
-					}
-					if dp, ok := event.Data[StatsUpdateKey].(dataPoint); ok {
-						timeBuff = dp.when.AppendFormat(timeBuff[:0], time.RFC3339Nano)
-						d := make(map[string]interface{})
-						d["time"] = string(timeBuff)
-						if dp.event != "" {
-							d["event"] = dp.event
-						}
-						d["scores"] = dp.vals
-						s := make(map[string]interface{})
-						s["stats"] = dp.stats
-						s["status"] = dp.status
-						s["map"] = dp.mp
-						s["duration"] = dp.dur
-						if dp.winner != "" {
-							s["winner"] = dp.winner
-							s["winType"] = dp.winType
-						}
-						p.Data.Parts = append(p.Data.Parts,
-							dataPart{Tag: "next", Data: d},
-							dataPart{Tag: "stats", Data: s})
-					}
-					if len(p.Data.Parts) > 0 {
-						send(&p)
-					}
+				sub.packets(event, send)
+			}
+		}()
+	})
+	// The same packets as /ws, as server-sent events, for overlays which only
+	// listen. The client start request is made from the query parameters, e.g.
+	// /events?sections=prediction,currentMatch&cab=left.
+	http.Handle("/events", auth.require(OverlayRole, func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		cabinet := req.FormValue("cab")
+		if cabinet == "" {
+			cabinet = defaultCabinet
+		}
+		if _, ok := trackers[cabinet]; !ok {
+			http.Error(w, fmt.Sprintf("unknown cabinet %q", cabinet), http.StatusNotFound)
+			return
+		}
+		var names []string
+		for _, list := range req.URL.Query()["sections"] {
+			for _, section := range strings.Split(list, ",") {
+				if section != "" {
+					names = append(names, section)
 				}
-
-				if doFamineUpdates {
-					p.Data.Section = "famineTracker"
-					if fu, ok := event.Data[FamineUpdateKey].(FamineUpdate); ok {
-						d := map[string]interface{}{
-							"berriesLeft": fu.BerriesLeft,
-							"inFamine":    !fu.FamineStart.IsZero(),
-						}
-						if !fu.FamineStart.IsZero() {
-							dur := 90*time.Second - fu.CurrTime.Sub(fu.FamineStart)
-							if dur < 0 {
-								dur = 0
-							}
-							d["famineLeftSeconds"] = float64(dur) / float64(time.Second)
-						}
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "update", Data: d})
-					}
-					if len(p.Data.Parts) > 0 {
-						send(&p)
-					}
+			}
+		}
+		sections, err := parseSections(names)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var versions []int
+		for _, list := range req.URL.Query()["versions"] {
+			for _, v := range strings.Split(list, ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid version %q", v), http.StatusBadRequest)
+					return
 				}
+				versions = append(versions, n)
+			}
+		}
+		version, ok := negotiateVersion(versions)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no common protocol version; the server speaks %v", wsProtocolVersions), http.StatusBadRequest)
+			return
+		}
 
-				if doControl {
-					p.Data.Section = "control"
-					if vr, ok := event.Data[VictoryRuleKey].(MatchVictoryRule); ok {
-						type ds struct {
-							VictoryRule struct {
-								Rule   string `json:"rule"`
-								Length int    `json:"length"`
-							} `json:"victoryRule"`
-						}
-						var d ds
-						switch vr := vr.(type) {
-						case BestOfN:
-							d.VictoryRule.Rule = "BestOfN"
-							d.VictoryRule.Length = int(vr)
-						case StraightN:
-							d.VictoryRule.Rule = "StraightN"
-							d.VictoryRule.Length = int(vr)
-						}
-						p.Data.Parts = []dataPart{{Tag: "matchSettings", Data: d}}
-					}
-					if tu, ok := event.Data[TeamUpdateKey].(TeamUpdate); ok {
-						t := make(map[string]interface{})
-						t["blue"] = tu.Blue
-						t["gold"] = tu.Gold
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "currentTeams", Data: t})
-					}
-					if su, ok := event.Data[ScoreUpdateKey].(ScoreUpdate); ok {
-						s := make(map[string]interface{})
-						s["blue"] = su.Blue
-						s["gold"] = su.Gold
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "currentScores", Data: s})
-					}
-					if tl, ok := event.Data[TeamListKey].(teamList); ok {
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teamList", Data: tl})
-					}
-					if len(p.Data.Parts) > 0 {
-						send(&p)
-					}
-				}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
 
-				if doCurrentMatch {
-					p.Data.Section = "currentMatch"
-					if vr, ok := event.Data[VictoryRuleKey].(MatchVictoryRule); ok {
-						type ds struct {
-							VictoryRule struct {
-								Rule   string `json:"rule"`
-								Length int    `json:"length"`
-							} `json:"victoryRule"`
-						}
-						var d ds
-						switch vr := vr.(type) {
-						case BestOfN:
-							d.VictoryRule.Rule = "BestOfN"
-							d.VictoryRule.Length = int(vr)
-						case StraightN:
-							d.VictoryRule.Rule = "StraightN"
-							d.VictoryRule.Length = int(vr)
-						}
-						p.Data.Parts = []dataPart{{Tag: "settings", Data: d}}
-					}
-					if tu, ok := event.Data[TeamUpdateKey].(TeamUpdate); ok {
-						t := make(map[string]interface{})
-						t["blue"] = tu.Blue
-						t["gold"] = tu.Gold
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teams", Data: t})
-					}
-					if su, ok := event.Data[ScoreUpdateKey].(ScoreUpdate); ok {
-						s := make(map[string]interface{})
-						s["blue"] = su.Blue
-						s["gold"] = su.Gold
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "scores", Data: s})
-					}
-					if len(p.Data.Parts) > 0 {
-						send(&p)
-					}
-				}
+		user, _ := auth.identify(req)
+		c := make(chan *Event, 256)
+		var writeEnd chan<- *Event = c
+		reg <- &clientRegistration{token: &writeEnd, endpoint: "/events", remote: req.RemoteAddr, user: user, cabinet: cabinet}
+		defer func() { unreg <- &writeEnd }()
+		eventStream.AddEvent(NewControlEvent(cabinet, []ControlCommand{{
+			Type: ClientStartRequest,
+			Data: ClientStartOptions{
+				ClientIdentifier: &writeEnd,
+				Sections:         sections,
+				Version:          version,
+			},
+		}}))
 
-				if doTournamentData {
-					if pd, ok := event.Data[PlayerDataKey].(map[string][]playerData); ok {
-						p.Data.Section = "tournamentData"
-						p.Data.Parts = append(p.Data.Parts, dataPart{Tag: "teams", Data: pd})
-					}
-					if len(p.Data.Parts) > 0 {
-						send(&p)
-					}
-				}
+		sub := newClientSubscription(&writeEnd)
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		var writeErr error
+		send := func(p interface{}) {
+			buf.Reset()
+			buf.WriteString("data: ")
+			if e := enc.Encode(p); e != nil {
+				fmt.Println(e)
+				return
 			}
-		}()
-	})
+			// The encoder ends the line, and a blank line ends the event.
+			buf.WriteByte('\n')
+			if _, e := w.Write(buf.Bytes()); e != nil && writeErr == nil {
+				writeErr = e
+			}
+		}
+		// Comments keep proxies from closing an idle connection.
+		keepAlive := time.NewTicker(30 * time.Second)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event := <-c:
+				sub.packets(event, send)
+			case <-keepAlive.C:
+				_, writeErr = io.WriteString(w, ": keepalive\n\n")
+			case <-req.Context().Done():
+				return
+			}
+			if writeErr != nil {
+				fmt.Println(writeErr)
+				return
+			}
+			flusher.Flush()
+		}
+	}))
 	panic(http.ListenAndServe(bindAddr, nil))
 }
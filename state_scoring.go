@@ -4,87 +4,179 @@ import (
 	"math"
 	"time"
 
-	kq "github.com/ughoavgfhw/libkq"
 	"github.com/ughoavgfhw/libkq/maps"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
 )
 
-type StateScorer func(*kq.GameState, time.Time) float64
+type StateScorer func(*tracking.GameTracker, time.Time) float64
 
-func AllStateScores(state *kq.GameState, when time.Time) []float64 {
-	return []float64{
-		modelSumLose(state, when),
-		modelMultLose(state, when),
-		modelMultCbrt(state, when),
-		modelMultSqrt(state, when),
-		modelMultQueenSqrt(state, when),
+// Scores the state with every known model: the built-in models first, in a
+// fixed order, then the trained model if there is one, followed by any
+// user-defined models sorted by name.
+func AllStateScores(cab *tracking.GameTracker, when time.Time) []float64 {
+	models := allModels()
+	scores := make([]float64, len(models))
+	for i, m := range models {
+		scores[i] = m.score(cab, when)
 	}
+	return scores
 }
 
+// Returns the scorer for a built-in, trained or user-defined model, or nil if
+// there is no such model. Scorers for trained and user-defined models always
+// use the model's current parameters, so they follow reloads of the files. If
+// the model is removed, the scorer returns NaN until it is added back.
 func GetStateScorerByName(name string) StateScorer {
-	switch name {
-	case "sumLose":
-		return modelSumLose
-	case "multLose":
-		return modelMultLose
-	case "multCbrt":
-		return modelMultCbrt
-	case "multSqrt":
-		return modelMultSqrt
-	case "multQSqrt":
-		return modelMultQueenSqrt
-	default:
+	if p, ok := builtinModelParams(name); ok {
+		return p.Score
+	}
+	if name == TrainedModelName {
+		if currentTrainedModel() == nil {
+			return nil
+		}
+		return func(cab *tracking.GameTracker, when time.Time) float64 {
+			m := currentTrainedModel()
+			if m == nil {
+				return math.NaN()
+			}
+			return m.Score(cab, when)
+		}
+	}
+	if lookupUserModel(name) == nil {
 		return nil
 	}
+	return func(cab *tracking.GameTracker, when time.Time) float64 {
+		p := lookupUserModel(name)
+		if p == nil {
+			return math.NaN()
+		}
+		return p.Score(cab, when)
+	}
 }
 
 // -----------------------------
 // Models implemented below. WARNING: This code is a mess.
 
-const (
-	berryWeight        = 100. / 12.
-	snailWeight        = 200.
-	lifeWeight         = 100. / 3.
-	warriorWeight      = 100. / 4.
-	speedWarriorWeight = warriorWeight * 4. / 3. // Matches a queen right now.
-
-	berryBonus1At, berryBonus1Rate, berryBonus1 = 4, 1., 37.5  // 25
-	berryBonus2At, berryBonus2Rate, berryBonus2 = 8, 1., 75    // 50
-	berryBonus3At, berryBonus3Rate, berryBonus3 = 10, 2.5, 100 // 1.5,  100
-	berryBonus4At, berryBonus4Rate, berryBonus4 = 11, 3., 250
-	snailBonusMinEligible                       = 0.55
-	snailBonus1At, snailBonus1Rate, snailBonus1 = 0.7, 25, 25
-	snailBonus2At, snailBonus2Rate, snailBonus2 = 0.8, 15, 50   // 25,  50
-	snailBonus3At, snailBonus3Rate, snailBonus3 = 0.9, 25, 100  // 50,  100
-	snailBonus4At, snailBonus4Rate, snailBonus4 = 0.95, 75, 200 // 100, 200
-	warriorBonus1At, warriorBonus1              = 2, 100
-	queenBonus1At, queenBonus1                  = 2, 100
+// A single tier of a bonus which ramps up logistically around At. The tier is
+// worth Bonus at At, approaching twice that well past it. Rate controls how
+// sharp the ramp is.
+type BonusTier struct {
+	At, Rate, Bonus float64
+}
 
-	objectiveBonusFactorAtFullMil = 0.5
-	faminePeakWarriorWeightFactor = 2.5
-	famineDuration                = 90 * time.Second
+// The tunable parameters of the hand-written models. Each side gets "win"
+// points for progress toward its own objectives and "lose" points for how far
+// the other team is from theirs; the prediction is the share of points going
+// to gold.
+//
+// The built-in models are presets of these parameters. User-defined models in
+// the models file start from one of those presets and override some fields.
+type ModelParams struct {
+	// How the lose points for each objective are combined. "sum" adds the
+	// points remaining for each objective, and "mult" multiplies the fraction
+	// remaining.
+	LoseCombine string
+	// Applied to the combined lose points before weighting. One of "",
+	// "sqrt", or "cbrt".
+	LoseTransform string
+	// Uses the square root of the queen lives fraction in "mult" models, so
+	// that queen deaths matter less than the other objectives.
+	SqrtQueenLives bool
+
+	BerryWeight        float64
+	SnailWeight        float64
+	LifeWeight         float64
+	WarriorWeight      float64
+	SpeedWarriorWeight float64
+
+	BerryBonuses          []BonusTier
+	SnailBonusMinEligible float64
+	SnailBonuses          []BonusTier
+	WarriorBonusAt        int
+	WarriorBonus          float64
+	QueenBonusAt          int
+	QueenBonus            float64
+
+	ObjectiveBonusFactorAtFullMil float64
+	FaminePeakWarriorWeightFactor float64
+
+	WinPointsWeight, LosePointsWeight float64
+}
 
-	winPointsWeight, losePointsWeight = 1, 1
-)
+const famineDuration = tracking.FamineDuration
+
+// The names of the built-in models, in the order they are reported.
+var builtinModelNames = []string{"sumLose", "multLose", "multCbrt", "multSqrt", "multQSqrt"}
+
+func builtinModelParams(name string) (*ModelParams, bool) {
+	base := ModelParams{
+		LoseCombine:        "mult",
+		BerryWeight:        100. / 12.,
+		SnailWeight:        200.,
+		LifeWeight:         100. / 3.,
+		WarriorWeight:      100. / 4.,
+		SpeedWarriorWeight: 100. / 3., // Matches a queen right now.
+
+		BerryBonuses: []BonusTier{
+			{4, 1., 37.5},  // 25
+			{8, 1., 75},    // 50
+			{10, 2.5, 100}, // 1.5,  100
+			{11, 3., 250},
+		},
+		SnailBonusMinEligible: 0.55,
+		SnailBonuses: []BonusTier{
+			{0.7, 25, 25},
+			{0.8, 15, 50},   // 25,  50
+			{0.9, 25, 100},  // 50,  100
+			{0.95, 75, 200}, // 100, 200
+		},
+		WarriorBonusAt: 2,
+		WarriorBonus:   100,
+		QueenBonusAt:   2,
+		QueenBonus:     100,
+
+		ObjectiveBonusFactorAtFullMil: 0.5,
+		FaminePeakWarriorWeightFactor: 2.5,
+
+		WinPointsWeight:  1,
+		LosePointsWeight: 500,
+	}
+	switch name {
+	case "sumLose":
+		base.LoseCombine = "sum"
+		base.LosePointsWeight = 1
+	case "multLose":
+	case "multCbrt":
+		base.LoseTransform = "cbrt"
+	case "multSqrt":
+		base.LoseTransform = "sqrt"
+	case "multQSqrt":
+		base.SqrtQueenLives = true
+	default:
+		return nil, false
+	}
+	return &base, true
+}
 
 func logistic(value, half_amplitude, rate, center float64) float64 {
 	return half_amplitude * 2 / (1 + math.Exp(rate*(center-value)))
 }
 
-func modelSumLose(game *kq.GameState, when time.Time) float64 {
-	snailEst := snailEstimate(when, game)
+func (p *ModelParams) Score(cab *tracking.GameTracker, when time.Time) float64 {
+	game := cab.State()
 	meta := maps.MetadataForMap(game.Map)
-	snailLim := (meta.Snails[0].Nets[1].X - meta.Snails[0].Nets[0].X) / 2
 	maxBerries := meta.BerriesAvailable
 	queenStartLives := meta.QueenLives
 
-	snailPos := (float64(snailEst)/float64(snailLim) + 1) / 2
+	snailPos := cab.SnailProgress(when)
 	if snailPos < -1 {
 		snailPos = -1
 	} else if snailPos > 1 {
 		snailPos = 1
 	}
 	var blueSnail, goldSnail float64
-	if teamSidesSwapped {
+	if cab.GoldOnLeft() {
 		goldSnail = 1 - snailPos
 		blueSnail = snailPos
 	} else {
@@ -96,11 +188,11 @@ func modelSumLose(game *kq.GameState, when time.Time) float64 {
 	if game.InFamine() {
 		progress := float64(when.Sub(game.FamineStart)) / float64(famineDuration)
 		famineBerryBonusFactor = 0
-		famineWarriorWeightFactor = faminePeakWarriorWeightFactor
+		famineWarriorWeightFactor = p.FaminePeakWarriorWeightFactor
 		if progress > 0.6 {
 			famineBerryBonusFactor = logistic(progress, 0.5, 30, 0.85)
 			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., -30, 0.85)
+				1 + logistic(progress, (p.FaminePeakWarriorWeightFactor-1.)/2., -30, 0.85)
 		}
 	} else {
 		progress := float64(game.BerriesUsed) / float64(maxBerries)
@@ -109,570 +201,99 @@ func modelSumLose(game *kq.GameState, when time.Time) float64 {
 		if progress > 0.6 {
 			famineBerryBonusFactor = logistic(progress, 0.5, -30, 0.85)
 			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., 30, 0.85)
+				1 + logistic(progress, (p.FaminePeakWarriorWeightFactor-1.)/2., 30, 0.85)
 		}
 	}
 
 	var blueWin, blueLose, goldWin, goldLose float64
-	blueLose += 100 - float64(game.GoldTeam.BerriesIn)*berryWeight
-	goldLose += 100 - float64(game.BlueTeam.BerriesIn)*berryWeight
-	blueLose += 100 - float64(game.BlueTeam.QueenDeaths)*lifeWeight
-	goldLose += 100 - float64(game.GoldTeam.QueenDeaths)*lifeWeight
-	blueWin += (float64(game.BlueTeam.Warriors-game.BlueTeam.SpeedWarriors)*warriorWeight +
-		float64(game.BlueTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	goldWin += (float64(game.GoldTeam.Warriors-game.GoldTeam.SpeedWarriors)*warriorWeight +
-		float64(game.GoldTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	if goldSnail <= 0.5 {
-		blueLose += snailWeight / 2
-	} else {
-		blueLose += (1 - goldSnail) * snailWeight
-	}
-	if blueSnail <= 0.5 {
-		goldLose += snailWeight / 2
-	} else {
-		goldLose += (1 - blueSnail) * snailWeight
-	}
-
-	blueFullMilFactor, goldFullMilFactor := 1., 1.
-	if game.BlueTeam.Warriors == 4 {
-		blueFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-	if game.GoldTeam.Warriors == 4 {
-		goldFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-
-	if game.BlueTeam.BerriesIn > 0 {
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * blueFullMilFactor * famineBerryBonusFactor
-	}
-	if game.GoldTeam.BerriesIn > 0 {
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * goldFullMilFactor * famineBerryBonusFactor
-	}
-	if blueSnail >= snailBonusMinEligible {
-		blueWin += logistic(blueSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * blueFullMilFactor
-	}
-	if goldSnail >= snailBonusMinEligible {
-		goldWin += logistic(goldSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * goldFullMilFactor
-	}
-	if game.BlueTeam.Warriors-game.GoldTeam.Warriors >= warriorBonus1At {
-		blueWin += warriorBonus1
-	}
-	if game.GoldTeam.Warriors-game.BlueTeam.Warriors >= warriorBonus1At {
-		goldWin += warriorBonus1
-	}
-	if queenStartLives-game.BlueTeam.QueenDeaths >= queenBonus1At {
-		blueWin += queenBonus1
-	}
-	if queenStartLives-game.GoldTeam.QueenDeaths >= queenBonus1At {
-		goldWin += queenBonus1
-	}
-
-	blue := blueWin*winPointsWeight + blueLose*losePointsWeight
-	gold := goldWin*winPointsWeight + goldLose*losePointsWeight
-
-	total := blue + gold
-	if teamSidesSwapped {
-		return blue / total
-	} else {
-		return gold / total
-	}
-}
-
-func modelMultLose(game *kq.GameState, when time.Time) float64 {
-	snailEst := snailEstimate(when, game)
-	meta := maps.MetadataForMap(game.Map)
-	snailLim := (meta.Snails[0].Nets[1].X - meta.Snails[0].Nets[0].X) / 2
-	maxBerries := meta.BerriesAvailable
-	queenStartLives := meta.QueenLives
-
-	snailPos := (float64(snailEst)/float64(snailLim) + 1) / 2
-	if snailPos < -1 {
-		snailPos = -1
-	} else if snailPos > 1 {
-		snailPos = 1
-	}
-	var blueSnail, goldSnail float64
-	if teamSidesSwapped {
-		goldSnail = 1 - snailPos
-		blueSnail = snailPos
-	} else {
-		blueSnail = 1 - snailPos
-		goldSnail = snailPos
-	}
-
-	var famineBerryBonusFactor, famineWarriorWeightFactor float64
-	if game.InFamine() {
-		progress := float64(when.Sub(game.FamineStart)) / float64(famineDuration)
-		famineBerryBonusFactor = 0
-		famineWarriorWeightFactor = faminePeakWarriorWeightFactor
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, 30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., -30, 0.85)
+	if p.LoseCombine == "sum" {
+		blueLose += 100 - float64(game.GoldTeam.BerriesIn)*p.BerryWeight
+		goldLose += 100 - float64(game.BlueTeam.BerriesIn)*p.BerryWeight
+		blueLose += 100 - float64(game.BlueTeam.QueenDeaths)*p.LifeWeight
+		goldLose += 100 - float64(game.GoldTeam.QueenDeaths)*p.LifeWeight
+		if goldSnail <= 0.5 {
+			blueLose += p.SnailWeight / 2
+		} else {
+			blueLose += (1 - goldSnail) * p.SnailWeight
 		}
-	} else {
-		progress := float64(game.BerriesUsed) / float64(maxBerries)
-		famineBerryBonusFactor = 1
-		famineWarriorWeightFactor = 1
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, -30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., 30, 0.85)
+		if blueSnail <= 0.5 {
+			goldLose += p.SnailWeight / 2
+		} else {
+			goldLose += (1 - blueSnail) * p.SnailWeight
 		}
-	}
-
-	blueWin, blueLose, goldWin, goldLose := 0., 1., 0., 1.
-	blueLose *= 1 - float64(game.GoldTeam.BerriesIn)*(berryWeight/100)
-	goldLose *= 1 - float64(game.BlueTeam.BerriesIn)*(berryWeight/100)
-	blueLose *= 1 - float64(game.BlueTeam.QueenDeaths)*(lifeWeight/100)
-	goldLose *= 1 - float64(game.GoldTeam.QueenDeaths)*(lifeWeight/100)
-	blueWin += (float64(game.BlueTeam.Warriors-game.BlueTeam.SpeedWarriors)*warriorWeight +
-		float64(game.BlueTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	goldWin += (float64(game.GoldTeam.Warriors-game.GoldTeam.SpeedWarriors)*warriorWeight +
-		float64(game.GoldTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	if goldSnail <= 0.5 {
-		blueLose *= 1
 	} else {
-		blueLose *= (1 - goldSnail) * (snailWeight / 100)
-	}
-	if blueSnail <= 0.5 {
-		goldLose *= 1
-	} else {
-		goldLose *= (1 - blueSnail) * (snailWeight / 100)
-	}
-
-	blueFullMilFactor, goldFullMilFactor := 1., 1.
-	if game.BlueTeam.Warriors == 4 {
-		blueFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-	if game.GoldTeam.Warriors == 4 {
-		goldFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-
-	if game.BlueTeam.BerriesIn > 0 {
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * blueFullMilFactor * famineBerryBonusFactor
-	}
-	if game.GoldTeam.BerriesIn > 0 {
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * goldFullMilFactor * famineBerryBonusFactor
-	}
-	if blueSnail >= snailBonusMinEligible {
-		blueWin += logistic(blueSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * blueFullMilFactor
-	}
-	if goldSnail >= snailBonusMinEligible {
-		goldWin += logistic(goldSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * goldFullMilFactor
-	}
-	if game.BlueTeam.Warriors-game.GoldTeam.Warriors >= warriorBonus1At {
-		blueWin += warriorBonus1
-	}
-	if game.GoldTeam.Warriors-game.BlueTeam.Warriors >= warriorBonus1At {
-		goldWin += warriorBonus1
-	}
-	if queenStartLives-game.BlueTeam.QueenDeaths >= queenBonus1At {
-		blueWin += queenBonus1
-	}
-	if queenStartLives-game.GoldTeam.QueenDeaths >= queenBonus1At {
-		goldWin += queenBonus1
-	}
-
-	const myLosePointsWeight = 500
-	blue := blueWin*winPointsWeight + blueLose*myLosePointsWeight
-	gold := goldWin*winPointsWeight + goldLose*myLosePointsWeight
-
-	total := blue + gold
-	if teamSidesSwapped {
-		return blue / total
-	} else {
-		return gold / total
-	}
-}
-
-func modelMultCbrt(game *kq.GameState, when time.Time) float64 {
-	snailEst := snailEstimate(when, game)
-	meta := maps.MetadataForMap(game.Map)
-	snailLim := (meta.Snails[0].Nets[1].X - meta.Snails[0].Nets[0].X) / 2
-	maxBerries := meta.BerriesAvailable
-	queenStartLives := meta.QueenLives
-
-	snailPos := (float64(snailEst)/float64(snailLim) + 1) / 2
-	if snailPos < -1 {
-		snailPos = -1
-	} else if snailPos > 1 {
-		snailPos = 1
-	}
-	var blueSnail, goldSnail float64
-	if teamSidesSwapped {
-		goldSnail = 1 - snailPos
-		blueSnail = snailPos
-	} else {
-		blueSnail = 1 - snailPos
-		goldSnail = snailPos
-	}
-
-	var famineBerryBonusFactor, famineWarriorWeightFactor float64
-	if game.InFamine() {
-		progress := float64(when.Sub(game.FamineStart)) / float64(famineDuration)
-		famineBerryBonusFactor = 0
-		famineWarriorWeightFactor = faminePeakWarriorWeightFactor
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, 30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., -30, 0.85)
+		blueLose, goldLose = 1, 1
+		blueLose *= 1 - float64(game.GoldTeam.BerriesIn)*(p.BerryWeight/100)
+		goldLose *= 1 - float64(game.BlueTeam.BerriesIn)*(p.BerryWeight/100)
+		if p.SqrtQueenLives {
+			blueLose *= math.Sqrt(1 - float64(game.BlueTeam.QueenDeaths)*(p.LifeWeight/100))
+			goldLose *= math.Sqrt(1 - float64(game.GoldTeam.QueenDeaths)*(p.LifeWeight/100))
+		} else {
+			blueLose *= 1 - float64(game.BlueTeam.QueenDeaths)*(p.LifeWeight/100)
+			goldLose *= 1 - float64(game.GoldTeam.QueenDeaths)*(p.LifeWeight/100)
 		}
-	} else {
-		progress := float64(game.BerriesUsed) / float64(maxBerries)
-		famineBerryBonusFactor = 1
-		famineWarriorWeightFactor = 1
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, -30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., 30, 0.85)
+		if goldSnail > 0.5 {
+			blueLose *= (1 - goldSnail) * (p.SnailWeight / 100)
+		}
+		if blueSnail > 0.5 {
+			goldLose *= (1 - blueSnail) * (p.SnailWeight / 100)
 		}
 	}
-
-	blueWin, blueLose, goldWin, goldLose := 0., 1., 0., 1.
-	blueLose *= 1 - float64(game.GoldTeam.BerriesIn)*(berryWeight/100)
-	goldLose *= 1 - float64(game.BlueTeam.BerriesIn)*(berryWeight/100)
-	blueLose *= 1 - float64(game.BlueTeam.QueenDeaths)*(lifeWeight/100)
-	goldLose *= 1 - float64(game.GoldTeam.QueenDeaths)*(lifeWeight/100)
-	blueWin += (float64(game.BlueTeam.Warriors-game.BlueTeam.SpeedWarriors)*warriorWeight +
-		float64(game.BlueTeam.SpeedWarriors)*speedWarriorWeight) *
+	blueWin += (float64(game.BlueTeam.Warriors-game.BlueTeam.SpeedWarriors)*p.WarriorWeight +
+		float64(game.BlueTeam.SpeedWarriors)*p.SpeedWarriorWeight) *
 		famineWarriorWeightFactor
-	goldWin += (float64(game.GoldTeam.Warriors-game.GoldTeam.SpeedWarriors)*warriorWeight +
-		float64(game.GoldTeam.SpeedWarriors)*speedWarriorWeight) *
+	goldWin += (float64(game.GoldTeam.Warriors-game.GoldTeam.SpeedWarriors)*p.WarriorWeight +
+		float64(game.GoldTeam.SpeedWarriors)*p.SpeedWarriorWeight) *
 		famineWarriorWeightFactor
-	if goldSnail <= 0.5 {
-		blueLose *= 1
-	} else {
-		blueLose *= (1 - goldSnail) * (snailWeight / 100)
-	}
-	if blueSnail <= 0.5 {
-		goldLose *= 1
-	} else {
-		goldLose *= (1 - blueSnail) * (snailWeight / 100)
-	}
 
 	blueFullMilFactor, goldFullMilFactor := 1., 1.
 	if game.BlueTeam.Warriors == 4 {
-		blueFullMilFactor = objectiveBonusFactorAtFullMil
+		blueFullMilFactor = p.ObjectiveBonusFactorAtFullMil
 	}
 	if game.GoldTeam.Warriors == 4 {
-		goldFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-
-	if game.BlueTeam.BerriesIn > 0 {
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * blueFullMilFactor * famineBerryBonusFactor
-	}
-	if game.GoldTeam.BerriesIn > 0 {
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * goldFullMilFactor * famineBerryBonusFactor
+		goldFullMilFactor = p.ObjectiveBonusFactorAtFullMil
 	}
-	if blueSnail >= snailBonusMinEligible {
-		blueWin += logistic(blueSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * blueFullMilFactor
-	}
-	if goldSnail >= snailBonusMinEligible {
-		goldWin += logistic(goldSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * goldFullMilFactor
-	}
-	if game.BlueTeam.Warriors-game.GoldTeam.Warriors >= warriorBonus1At {
-		blueWin += warriorBonus1
-	}
-	if game.GoldTeam.Warriors-game.BlueTeam.Warriors >= warriorBonus1At {
-		goldWin += warriorBonus1
-	}
-	if queenStartLives-game.BlueTeam.QueenDeaths >= queenBonus1At {
-		blueWin += queenBonus1
-	}
-	if queenStartLives-game.GoldTeam.QueenDeaths >= queenBonus1At {
-		goldWin += queenBonus1
-	}
-
-	const myLosePointsWeight = 500
-	blue := blueWin*winPointsWeight + math.Cbrt(blueLose)*myLosePointsWeight
-	gold := goldWin*winPointsWeight + math.Cbrt(goldLose)*myLosePointsWeight
-
-	total := blue + gold
-	if teamSidesSwapped {
-		return blue / total
-	} else {
-		return gold / total
-	}
-}
-
-func modelMultSqrt(game *kq.GameState, when time.Time) float64 {
-	snailEst := snailEstimate(when, game)
-	meta := maps.MetadataForMap(game.Map)
-	snailLim := (meta.Snails[0].Nets[1].X - meta.Snails[0].Nets[0].X) / 2
-	maxBerries := meta.BerriesAvailable
-	queenStartLives := meta.QueenLives
 
-	snailPos := (float64(snailEst)/float64(snailLim) + 1) / 2
-	if snailPos < -1 {
-		snailPos = -1
-	} else if snailPos > 1 {
-		snailPos = 1
-	}
-	var blueSnail, goldSnail float64
-	if teamSidesSwapped {
-		goldSnail = 1 - snailPos
-		blueSnail = snailPos
-	} else {
-		blueSnail = 1 - snailPos
-		goldSnail = snailPos
-	}
-
-	var famineBerryBonusFactor, famineWarriorWeightFactor float64
-	if game.InFamine() {
-		progress := float64(when.Sub(game.FamineStart)) / float64(famineDuration)
-		famineBerryBonusFactor = 0
-		famineWarriorWeightFactor = faminePeakWarriorWeightFactor
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, 30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., -30, 0.85)
+	for _, b := range p.BerryBonuses {
+		if game.BlueTeam.BerriesIn > 0 {
+			blueWin += logistic(float64(game.BlueTeam.BerriesIn), b.Bonus, b.Rate, b.At) * blueFullMilFactor * famineBerryBonusFactor
 		}
-	} else {
-		progress := float64(game.BerriesUsed) / float64(maxBerries)
-		famineBerryBonusFactor = 1
-		famineWarriorWeightFactor = 1
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, -30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., 30, 0.85)
+		if game.GoldTeam.BerriesIn > 0 {
+			goldWin += logistic(float64(game.GoldTeam.BerriesIn), b.Bonus, b.Rate, b.At) * goldFullMilFactor * famineBerryBonusFactor
 		}
 	}
-
-	blueWin, blueLose, goldWin, goldLose := 0., 1., 0., 1.
-	blueLose *= 1 - float64(game.GoldTeam.BerriesIn)*(berryWeight/100)
-	goldLose *= 1 - float64(game.BlueTeam.BerriesIn)*(berryWeight/100)
-	blueLose *= 1 - float64(game.BlueTeam.QueenDeaths)*(lifeWeight/100)
-	goldLose *= 1 - float64(game.GoldTeam.QueenDeaths)*(lifeWeight/100)
-	blueWin += (float64(game.BlueTeam.Warriors-game.BlueTeam.SpeedWarriors)*warriorWeight +
-		float64(game.BlueTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	goldWin += (float64(game.GoldTeam.Warriors-game.GoldTeam.SpeedWarriors)*warriorWeight +
-		float64(game.GoldTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	if goldSnail <= 0.5 {
-		blueLose *= 1
-	} else {
-		blueLose *= (1 - goldSnail) * (snailWeight / 100)
-	}
-	if blueSnail <= 0.5 {
-		goldLose *= 1
-	} else {
-		goldLose *= (1 - blueSnail) * (snailWeight / 100)
-	}
-
-	blueFullMilFactor, goldFullMilFactor := 1., 1.
-	if game.BlueTeam.Warriors == 4 {
-		blueFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-	if game.GoldTeam.Warriors == 4 {
-		goldFullMilFactor = objectiveBonusFactorAtFullMil
-	}
-
-	if game.BlueTeam.BerriesIn > 0 {
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * blueFullMilFactor * famineBerryBonusFactor
-	}
-	if game.GoldTeam.BerriesIn > 0 {
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * goldFullMilFactor * famineBerryBonusFactor
-	}
-	if blueSnail >= snailBonusMinEligible {
-		blueWin += logistic(blueSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * blueFullMilFactor
-	}
-	if goldSnail >= snailBonusMinEligible {
-		goldWin += logistic(goldSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * goldFullMilFactor
-	}
-	if game.BlueTeam.Warriors-game.GoldTeam.Warriors >= warriorBonus1At {
-		blueWin += warriorBonus1
-	}
-	if game.GoldTeam.Warriors-game.BlueTeam.Warriors >= warriorBonus1At {
-		goldWin += warriorBonus1
-	}
-	if queenStartLives-game.BlueTeam.QueenDeaths >= queenBonus1At {
-		blueWin += queenBonus1
-	}
-	if queenStartLives-game.GoldTeam.QueenDeaths >= queenBonus1At {
-		goldWin += queenBonus1
-	}
-
-	const myLosePointsWeight = 500
-	blue := blueWin*winPointsWeight + math.Sqrt(blueLose)*myLosePointsWeight
-	gold := goldWin*winPointsWeight + math.Sqrt(goldLose)*myLosePointsWeight
-
-	total := blue + gold
-	if teamSidesSwapped {
-		return blue / total
-	} else {
-		return gold / total
-	}
-}
-
-func modelMultQueenSqrt(game *kq.GameState, when time.Time) float64 {
-	snailEst := snailEstimate(when, game)
-	meta := maps.MetadataForMap(game.Map)
-	snailLim := (meta.Snails[0].Nets[1].X - meta.Snails[0].Nets[0].X) / 2
-	maxBerries := meta.BerriesAvailable
-	queenStartLives := meta.QueenLives
-
-	snailPos := (float64(snailEst)/float64(snailLim) + 1) / 2
-	if snailPos < -1 {
-		snailPos = -1
-	} else if snailPos > 1 {
-		snailPos = 1
-	}
-	var blueSnail, goldSnail float64
-	if teamSidesSwapped {
-		goldSnail = 1 - snailPos
-		blueSnail = snailPos
-	} else {
-		blueSnail = 1 - snailPos
-		goldSnail = snailPos
-	}
-
-	var famineBerryBonusFactor, famineWarriorWeightFactor float64
-	if game.InFamine() {
-		progress := float64(when.Sub(game.FamineStart)) / float64(famineDuration)
-		famineBerryBonusFactor = 0
-		famineWarriorWeightFactor = faminePeakWarriorWeightFactor
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, 30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., -30, 0.85)
+	for _, b := range p.SnailBonuses {
+		if blueSnail >= p.SnailBonusMinEligible {
+			blueWin += logistic(blueSnail, b.Bonus, b.Rate, b.At) * blueFullMilFactor
 		}
-	} else {
-		progress := float64(game.BerriesUsed) / float64(maxBerries)
-		famineBerryBonusFactor = 1
-		famineWarriorWeightFactor = 1
-		if progress > 0.6 {
-			famineBerryBonusFactor = logistic(progress, 0.5, -30, 0.85)
-			famineWarriorWeightFactor =
-				1 + logistic(progress, (faminePeakWarriorWeightFactor-1.)/2., 30, 0.85)
+		if goldSnail >= p.SnailBonusMinEligible {
+			goldWin += logistic(goldSnail, b.Bonus, b.Rate, b.At) * goldFullMilFactor
 		}
 	}
-
-	blueWin, blueLose, goldWin, goldLose := 0., 1., 0., 1.
-	blueLose *= 1 - float64(game.GoldTeam.BerriesIn)*(berryWeight/100)
-	goldLose *= 1 - float64(game.BlueTeam.BerriesIn)*(berryWeight/100)
-	blueLose *= math.Sqrt(1 - float64(game.BlueTeam.QueenDeaths)*(lifeWeight/100))
-	goldLose *= math.Sqrt(1 - float64(game.GoldTeam.QueenDeaths)*(lifeWeight/100))
-	blueWin += (float64(game.BlueTeam.Warriors-game.BlueTeam.SpeedWarriors)*warriorWeight +
-		float64(game.BlueTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	goldWin += (float64(game.GoldTeam.Warriors-game.GoldTeam.SpeedWarriors)*warriorWeight +
-		float64(game.GoldTeam.SpeedWarriors)*speedWarriorWeight) *
-		famineWarriorWeightFactor
-	if goldSnail <= 0.5 {
-		blueLose *= 1
-	} else {
-		blueLose *= (1 - goldSnail) * (snailWeight / 100)
+	if game.BlueTeam.Warriors-game.GoldTeam.Warriors >= p.WarriorBonusAt {
+		blueWin += p.WarriorBonus
 	}
-	if blueSnail <= 0.5 {
-		goldLose *= 1
-	} else {
-		goldLose *= (1 - blueSnail) * (snailWeight / 100)
+	if game.GoldTeam.Warriors-game.BlueTeam.Warriors >= p.WarriorBonusAt {
+		goldWin += p.WarriorBonus
 	}
-
-	blueFullMilFactor, goldFullMilFactor := 1., 1.
-	if game.BlueTeam.Warriors == 4 {
-		blueFullMilFactor = objectiveBonusFactorAtFullMil
+	if queenStartLives-game.BlueTeam.QueenDeaths >= p.QueenBonusAt {
+		blueWin += p.QueenBonus
 	}
-	if game.GoldTeam.Warriors == 4 {
-		goldFullMilFactor = objectiveBonusFactorAtFullMil
+	if queenStartLives-game.GoldTeam.QueenDeaths >= p.QueenBonusAt {
+		goldWin += p.QueenBonus
 	}
 
-	if game.BlueTeam.BerriesIn > 0 {
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * blueFullMilFactor * famineBerryBonusFactor
-		blueWin += logistic(float64(game.BlueTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * blueFullMilFactor * famineBerryBonusFactor
+	switch p.LoseTransform {
+	case "sqrt":
+		blueLose, goldLose = math.Sqrt(blueLose), math.Sqrt(goldLose)
+	case "cbrt":
+		blueLose, goldLose = math.Cbrt(blueLose), math.Cbrt(goldLose)
 	}
-	if game.GoldTeam.BerriesIn > 0 {
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus1, berryBonus1Rate, berryBonus1At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus2, berryBonus2Rate, berryBonus2At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus3, berryBonus3Rate, berryBonus3At) * goldFullMilFactor * famineBerryBonusFactor
-		goldWin += logistic(float64(game.GoldTeam.BerriesIn), berryBonus4, berryBonus4Rate, berryBonus4At) * goldFullMilFactor * famineBerryBonusFactor
-	}
-	if blueSnail >= snailBonusMinEligible {
-		blueWin += logistic(blueSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * blueFullMilFactor
-		blueWin += logistic(blueSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * blueFullMilFactor
-	}
-	if goldSnail >= snailBonusMinEligible {
-		goldWin += logistic(goldSnail, snailBonus1, snailBonus1Rate, snailBonus1At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus2, snailBonus2Rate, snailBonus2At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus3, snailBonus3Rate, snailBonus3At) * goldFullMilFactor
-		goldWin += logistic(goldSnail, snailBonus4, snailBonus4Rate, snailBonus4At) * goldFullMilFactor
-	}
-	if game.BlueTeam.Warriors-game.GoldTeam.Warriors >= warriorBonus1At {
-		blueWin += warriorBonus1
-	}
-	if game.GoldTeam.Warriors-game.BlueTeam.Warriors >= warriorBonus1At {
-		goldWin += warriorBonus1
-	}
-	if queenStartLives-game.BlueTeam.QueenDeaths >= queenBonus1At {
-		blueWin += queenBonus1
-	}
-	if queenStartLives-game.GoldTeam.QueenDeaths >= queenBonus1At {
-		goldWin += queenBonus1
-	}
-
-	const myLosePointsWeight = 500
-	blue := blueWin*winPointsWeight + blueLose*myLosePointsWeight
-	gold := goldWin*winPointsWeight + goldLose*myLosePointsWeight
+	blue := blueWin*p.WinPointsWeight + blueLose*p.LosePointsWeight
+	gold := goldWin*p.WinPointsWeight + goldLose*p.LosePointsWeight
 
 	total := blue + gold
-	if teamSidesSwapped {
+	if cab.GoldOnLeft() {
 		return blue / total
 	} else {
 		return gold / total
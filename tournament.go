@@ -9,10 +9,18 @@ type GameScore struct {
 }
 
 type MatchScores struct {
+	// Identifies the match in player statistics. Set when its first game is
+	// recorded.
+	Id     string `json:",omitempty"`
 	TeamA  string
 	TeamB  string
 	ScoreA int
 	ScoreB int
+	// Set once the match is complete and its result has been announced.
+	Final bool
+	// The players assigned to each cabinet position on each team, in
+	// rosterPositions order. Unassigned positions are filled from the roster.
+	LineupA, LineupB []string `json:",omitempty"`
 
 	Games []*GameScore
 }
@@ -62,7 +70,8 @@ func (m *ActiveMatch) RecordGame(winner kq.Side, winType kq.WinType) {
 	}
 }
 
-// Clears the previous game from a match, updating the scores as needed.
+// Clears the previous game from a match, updating the scores as needed. A
+// final match which is no longer complete is no longer final.
 func (m *ActiveMatch) ClearPreviousGame() {
 	last := len(m.Games) - 1
 	if m.Games[last].TeamASide == m.Games[last].Winner {
@@ -72,12 +81,35 @@ func (m *ActiveMatch) ClearPreviousGame() {
 	}
 	m.Games[last] = nil
 	m.Games = m.Games[:last]
+	if !m.IsComplete() {
+		m.Final = false
+	}
 }
 
 func (m *ActiveMatch) IsComplete() bool {
 	return m.MatchVictoryRule.MatchIsComplete(m.ScoreA, m.ScoreB)
 }
 
+// A format for running a series of matches. The current match is where games
+// are recorded.
+type Tournament interface {
+	// Returns the current match's scores.
+	CurrentMatch() *MatchScores
+	// Returns the scores object for an upcoming match. `UpcomingMatch(0)` is
+	// next, `UpcomingMatch(1)` is after that, and so on.
+	UpcomingMatch(distance int) *MatchScores
+	// Finishes the current match and moves to the next one.
+	AdvanceMatch()
+	TeamASide() kq.Side
+	SetTeamASide(side kq.Side)
+	SwapSides()
+	RecordGame(winner kq.Side, winType kq.WinType)
+	ClearPreviousGame()
+	VictoryRule() MatchVictoryRule
+	SetVictoryRule(rule MatchVictoryRule)
+	CurrentMatchIsComplete() bool
+}
+
 type UnstructuredPlay struct {
 	current  ActiveMatch
 	upcoming []*MatchScores
@@ -153,6 +185,8 @@ func (p *UnstructuredPlay) CurrentMatchIsComplete() bool {
 	return p.current.IsComplete()
 }
 
+// Decides when a match is over. A rule with length 0 has no limit, so the
+// match is never complete.
 type MatchVictoryRule interface {
 	MaxPossibleWins() int
 	MatchIsComplete(scoreA, scoreB int) bool
@@ -163,12 +197,12 @@ type BestOfN int
 func (bo BestOfN) MaxPossibleWins() int { return int(bo+1) / 2 }
 func (bo BestOfN) MatchIsComplete(scoreA, scoreB int) bool {
 	winsNeeded := bo.MaxPossibleWins()
-	return scoreA >= winsNeeded || scoreB >= winsNeeded
+	return winsNeeded > 0 && (scoreA >= winsNeeded || scoreB >= winsNeeded)
 }
 
 type StraightN int
 
 func (n StraightN) MaxPossibleWins() int { return int(n) }
 func (n StraightN) MatchIsComplete(scoreA, scoreB int) bool {
-	return scoreA+scoreB >= int(n)
+	return n > 0 && scoreA+scoreB >= int(n)
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	kq "github.com/ughoavgfhw/libkq/common"
+)
+
+// A snapshot of a cabinet's tournament, saved so that a restarted server can
+// carry on where it left off.
+type savedTournament struct {
+	// Brackets and round robins are recreated from their setup, and then
+	// their matches are filled in.
+	Setup       TournamentSetup
+	VictoryRule victoryRuleJSON
+	TeamASide   kq.Side
+	// The current match. Brackets and round robins only use this once every
+	// match has been played.
+	Current *MatchScores
+	// The matches on deck in unstructured play.
+	Upcoming []*MatchScores `json:",omitempty"`
+	// Every match of a bracket or round robin, in the order they were
+	// created, and the index of the current one.
+	Matches      []savedMatch `json:",omitempty"`
+	CurrentIndex int
+}
+
+type savedMatch struct {
+	Scores *MatchScores
+	Done   bool
+}
+
+// Returns the format of a tournament, as in TournamentSetup.
+func tournamentFormat(t Tournament) string {
+	switch t := t.(type) {
+	case *Bracket:
+		if t.double {
+			return "doubleElimination"
+		}
+		return "singleElimination"
+	case *RoundRobin:
+		return "roundRobin"
+	}
+	return "unstructured"
+}
+
+func saveTournament(t Tournament) *savedTournament {
+	s := &savedTournament{
+		VictoryRule: victoryRuleToJSON(t.VictoryRule()),
+		TeamASide:   t.TeamASide(),
+		Current:     t.CurrentMatch(),
+	}
+	switch t := t.(type) {
+	case *UnstructuredPlay:
+		s.Setup.Format = tournamentFormat(t)
+		s.Upcoming = t.upcoming
+	case *Bracket:
+		s.Setup = TournamentSetup{Format: tournamentFormat(t), Teams: t.seeds}
+		for _, m := range t.matches {
+			s.Matches = append(s.Matches, savedMatch{m.scores, m.done})
+		}
+		s.CurrentIndex = t.currentIndex
+	case *RoundRobin:
+		s.Setup = TournamentSetup{
+			Format:      tournamentFormat(t),
+			Teams:       t.teams,
+			Groups:      len(t.groups),
+			Tiebreakers: t.tiebreakers,
+		}
+		for _, m := range t.matches {
+			s.Matches = append(s.Matches, savedMatch{m.scores, m.done})
+		}
+		s.CurrentIndex = t.currentIndex
+	}
+	return s
+}
+
+// Recreates the saved tournament.
+func (s *savedTournament) restore() (Tournament, error) {
+	rule, err := s.VictoryRule.rule()
+	if err != nil {
+		return nil, err
+	}
+	if s.Current == nil {
+		return nil, fmt.Errorf("missing current match")
+	}
+	t, err := StartTournament(s.Setup, rule)
+	if err != nil {
+		return nil, err
+	}
+	// Checks that the saved matches fit the recreated schedule.
+	checkMatches := func(count int) error {
+		if len(s.Matches) != count || s.CurrentIndex < -1 || s.CurrentIndex >= count {
+			return fmt.Errorf("saved %d matches, current %d, but the schedule has %d", len(s.Matches), s.CurrentIndex, count)
+		}
+		for _, m := range s.Matches {
+			if m.Scores == nil {
+				return fmt.Errorf("missing match scores")
+			}
+		}
+		return nil
+	}
+	var current *ActiveMatch
+	switch t := t.(type) {
+	case *UnstructuredPlay:
+		for _, m := range s.Upcoming {
+			if m == nil {
+				return nil, fmt.Errorf("missing upcoming match")
+			}
+		}
+		t.upcoming = s.Upcoming
+		t.current.Reset(s.Current)
+		current = &t.current
+	case *Bracket:
+		if err := checkMatches(len(t.matches)); err != nil {
+			return nil, err
+		}
+		for i, m := range s.Matches {
+			t.matches[i].scores, t.matches[i].done = m.Scores, m.Done
+		}
+		t.currentIndex = s.CurrentIndex
+		if t.currentIndex >= 0 {
+			t.current.Reset(t.matches[t.currentIndex].scores)
+		} else {
+			t.current.Reset(s.Current)
+		}
+		current = &t.current
+	case *RoundRobin:
+		if err := checkMatches(len(t.matches)); err != nil {
+			return nil, err
+		}
+		for i, m := range s.Matches {
+			t.matches[i].scores, t.matches[i].done = m.Scores, m.Done
+		}
+		t.currentIndex = s.CurrentIndex
+		if t.currentIndex >= 0 {
+			t.current.Reset(t.matches[t.currentIndex].scores)
+		} else {
+			t.current.Reset(s.Current)
+		}
+		current = &t.current
+	}
+	current.TeamASide = s.TeamASide
+	return t, nil
+}
+
+// The file holding the saved tournament of every cabinet. It is rewritten
+// whenever any cabinet's tournament changes.
+type stateFile struct {
+	path string
+
+	mu       sync.Mutex
+	cabinets map[string]json.RawMessage
+}
+
+// Opens the state file at path, loading the saved tournaments unless fresh is
+// set. It is not an error if the file does not exist. An empty path disables
+// saving.
+func openStateFile(path string, fresh bool) (*stateFile, error) {
+	f := &stateFile{path: path, cabinets: make(map[string]json.RawMessage)}
+	if path == "" || fresh {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.cabinets); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Returns the tournament saved for a cabinet, or nil if there is none.
+func (f *stateFile) Saved(cabinet string) (*savedTournament, error) {
+	f.mu.Lock()
+	data := f.cabinets[cabinet]
+	f.mu.Unlock()
+	if data == nil {
+		return nil, nil
+	}
+	s := new(savedTournament)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Saves a cabinet's tournament, encoded as a savedTournament. The file is
+// replaced in one step, so a crash leaves either the old or new state.
+func (f *stateFile) Save(cabinet string, state []byte) {
+	if f.path == "" {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cabinets[cabinet] = state
+	data, err := json.MarshalIndent(f.cabinets, "", "\t")
+	if err == nil {
+		tmp := f.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, f.path)
+		}
+	}
+	if err != nil {
+		fmt.Println("Failed to save tournament state:", err)
+	}
+}
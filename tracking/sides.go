@@ -0,0 +1,66 @@
+package tracking
+
+import (
+	"sync"
+
+	. "github.com/ughoavgfhw/libkq/common"
+)
+
+// Which side of the cabinet each team is on. Most cabinets have blue on the
+// left, but some are set up with gold on the left. The sides can be set, or
+// detected from where berries are deposited, since each team's hive is on its
+// own side.
+//
+// TeamSides is safe for concurrent use, so the sides can be changed while a
+// tracker is using them.
+type TeamSides struct {
+	mu         sync.Mutex
+	goldOnLeft bool
+	detect     bool
+}
+
+func NewTeamSides(goldOnLeft, detect bool) *TeamSides {
+	return &TeamSides{goldOnLeft: goldOnLeft, detect: detect}
+}
+
+// Whether the gold team is on the left side of the cabinet.
+func (s *TeamSides) GoldOnLeft() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.goldOnLeft
+}
+
+// Whether the sides are detected from games, rather than fixed.
+func (s *TeamSides) Detecting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.detect
+}
+
+// Returns the team on the left side of the cabinet.
+func (s *TeamSides) LeftTeam() Side {
+	if s.GoldOnLeft() {
+		return GoldSide
+	}
+	return BlueSide
+}
+
+// Sets which team is on the left. If detect is true, goldOnLeft is only the
+// starting point, and games can still change it.
+func (s *TeamSides) Set(goldOnLeft, detect bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.goldOnLeft, s.detect = goldOnLeft, detect
+}
+
+// Records the sides seen in a game, if they are being detected. Returns
+// whether they changed.
+func (s *TeamSides) observe(goldOnLeft bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.detect || s.goldOnLeft == goldOnLeft {
+		return false
+	}
+	s.goldOnLeft = goldOnLeft
+	return true
+}
@@ -0,0 +1,527 @@
+package tracking
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	kq "github.com/ughoavgfhw/libkq"
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/maps"
+	"github.com/ughoavgfhw/libkq/parser"
+)
+
+type gateData struct {
+	index int
+	typ   GateType
+}
+
+// How a snail is moving, for estimating its position between messages.
+type snailMotion struct {
+	time  time.Time
+	speed float64
+	// The Y position of the snail's track, or -1 until one is known.
+	trackY int
+}
+
+const mapCenter = 960
+
+// How far from a snail's track a message can be and still refer to that snail.
+const snailTrackTolerance = 50
+
+// How long a famine lasts before berries are restored.
+const FamineDuration = 90 * time.Second
+
+// Tracks the state of games on a single cabinet, given the messages it sends.
+// This includes the game state, statistics for each player, and enough
+// information to estimate where the snail is between messages.
+//
+// A GameTracker is not safe for concurrent use. The accessors return copies,
+// so their results can be retained and shared.
+type GameTracker struct {
+	// If non-nil, notable events and unhandled messages are logged here.
+	Log io.Writer
+	// Which side of the cabinet each team is on. NewGameTracker starts with
+	// blue on the left, detecting the sides from games.
+	Sides *TeamSides
+
+	game    kq.GameState
+	gateMap map[Position]gateData
+	// Claims of gates whose type is not known yet, because the map metadata
+	// does not have their positions. Applied once the gate is used.
+	unknownGateClaims map[Position]Side
+
+	snails []snailMotion
+
+	stats           [NumPlayers]PlayerStat
+	lastSnailEscape time.Time
+}
+
+func NewGameTracker() *GameTracker {
+	return &GameTracker{Sides: NewTeamSides(false, true)}
+}
+
+// Whether the gold team is on the left side of the cabinet.
+func (tr *GameTracker) GoldOnLeft() bool {
+	return tr.Sides.GoldOnLeft()
+}
+
+func (tr *GameTracker) logln(a ...interface{}) {
+	if tr.Log != nil {
+		fmt.Fprintln(tr.Log, a...)
+	}
+}
+
+// Updates the tracked state and statistics with the next message from the
+// cabinet. Returns whether the game state changed.
+func (tr *GameTracker) Apply(msg kqio.Message) bool {
+	// Stats look at the state from before the message.
+	tr.updateStats(&msg)
+	return tr.updateState(msg)
+}
+
+// Returns a copy of the current game state.
+func (tr *GameTracker) State() kq.GameState {
+	game := tr.game
+	game.Snails = append([]kq.SnailState(nil), game.Snails...)
+	game.WarriorGates = append([]kq.GateState(nil), game.WarriorGates...)
+	game.SpeedGates = append([]kq.GateState(nil), game.SpeedGates...)
+	return game
+}
+
+// Returns a copy of the statistics for each player in the current game,
+// indexed by PlayerId.Index().
+func (tr *GameTracker) PlayerStats() [NumPlayers]PlayerStat {
+	return tr.stats
+}
+
+// Sets up the gates and snails from the map's metadata. Bonus maps have no
+// positions in their metadata, so their gates and snail tracks are learned
+// from the messages that use them.
+func (tr *GameTracker) initForMap(m Map, start time.Time) {
+	game := &tr.game
+	game.Map = m
+	meta := maps.MetadataForMap(m)
+
+	tr.gateMap = make(map[Position]gateData)
+	tr.unknownGateClaims = make(map[Position]Side)
+	game.WarriorGates = make([]kq.GateState, len(meta.WarriorGates))
+	for i, g := range meta.WarriorGates {
+		if g.Pos != (Position{}) {
+			tr.gateMap[g.Pos] = gateData{i, WarriorGate}
+		}
+	}
+	game.SpeedGates = make([]kq.GateState, len(meta.SpeedGates))
+	for i, g := range meta.SpeedGates {
+		if g.Pos != (Position{}) {
+			tr.gateMap[g.Pos] = gateData{i, SpeedGate}
+		}
+	}
+
+	game.Snails = make([]kq.SnailState, len(meta.Snails))
+	tr.snails = make([]snailMotion, len(meta.Snails))
+	for i, s := range meta.Snails {
+		tr.snails[i] = snailMotion{time: start, trackY: -1}
+		if s.Nets == [2]Position{} {
+			game.Snails[i].MaxPos = mapCenter
+			continue
+		}
+		game.Snails[i].MaxPos = (s.Nets[1].X + s.Nets[0].X) / 2
+		tr.snails[i].trackY = s.Nets[0].Y
+	}
+}
+
+// Learns the type and index of a gate that was used, if the map's metadata
+// does not have its position. Gates are numbered in the order they are first
+// used, and any claim made before then is applied.
+func (tr *GameTracker) learnGate(pos Position, typ GateType) {
+	if _, ok := tr.gateMap[pos]; ok {
+		return
+	}
+	gates := tr.game.WarriorGates
+	if typ == SpeedGate {
+		gates = tr.game.SpeedGates
+	}
+	used := make([]bool, len(gates))
+	for _, g := range tr.gateMap {
+		if g.typ == typ {
+			used[g.index] = true
+		}
+	}
+	for i := range used {
+		if !used[i] {
+			tr.gateMap[pos] = gateData{i, typ}
+			if side, ok := tr.unknownGateClaims[pos]; ok {
+				gates[i].ClaimedBy = side
+				delete(tr.unknownGateClaims, pos)
+			}
+			return
+		}
+	}
+}
+
+// Returns the index of the snail whose track is nearest a position, or -1 if
+// the map has no snails. Tracks the metadata does not know are assigned to
+// the first snails seen away from the known ones.
+func (tr *GameTracker) snailAt(pos Position) int {
+	best, bestDist := -1, 0
+	for i, s := range tr.snails {
+		if s.trackY < 0 {
+			continue
+		}
+		dist := pos.Y - s.trackY
+		if dist < 0 {
+			dist = -dist
+		}
+		if best < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	if best >= 0 && bestDist <= snailTrackTolerance {
+		return best
+	}
+	for i := range tr.snails {
+		if tr.snails[i].trackY < 0 {
+			tr.snails[i].trackY = pos.Y
+			return i
+		}
+	}
+	return best
+}
+
+// Estimates the position of the first snail at the given time, based on its
+// last known position and speed. Uses the same coordinates as kq.SnailState.
+// Returns 0 on maps without a snail.
+func (tr *GameTracker) SnailEstimate(t time.Time) int {
+	if len(tr.snails) == 0 {
+		return 0
+	}
+	return tr.snailEstimate(0, t)
+}
+
+// Estimates the positions of every snail on the map at the given time.
+func (tr *GameTracker) SnailEstimates(t time.Time) []int {
+	est := make([]int, len(tr.snails))
+	for i := range est {
+		est[i] = tr.snailEstimate(i, t)
+	}
+	return est
+}
+
+func (tr *GameTracker) snailEstimate(i int, t time.Time) int {
+	s := &tr.snails[i]
+	if !t.After(s.time) {
+		return tr.game.Snails[i].Pos
+	}
+	return tr.game.Snails[i].Pos + int((s.speed*float64(t.Sub(s.time)))/float64(time.Second))
+}
+
+// Estimates how far the snails are toward the right side at the given time,
+// from 0 at the left nets to 1 at the right nets, averaged over the snails on
+// the map. Estimates can fall outside that range. Snails without known nets
+// count as halfway, as does a map without snails.
+func (tr *GameTracker) SnailProgress(t time.Time) float64 {
+	if len(tr.snails) == 0 {
+		return 0.5
+	}
+	meta := maps.MetadataForMap(tr.game.Map)
+	var total float64
+	for i, s := range meta.Snails {
+		snailLim := (s.Nets[1].X - s.Nets[0].X) / 2
+		if snailLim == 0 {
+			total += 0.5
+			continue
+		}
+		total += (float64(tr.snailEstimate(i, t))/float64(snailLim) + 1) / 2
+	}
+	return total / float64(len(tr.snails))
+}
+
+func (tr *GameTracker) checkForFamine(when time.Time) {
+	game := &tr.game
+	maxBerries := maps.MetadataForMap(game.Map).BerriesAvailable
+	if game.BerriesUsed == maxBerries {
+		game.StartFamine(when)
+		tr.logln("Start famine: ", when)
+	}
+}
+func (tr *GameTracker) updateState(msg kqio.Message) bool {
+	game := &tr.game
+	if game.InGame() && game.InFamine() && msg.Time.Sub(game.FamineStart) > FamineDuration {
+		game.EndFamine()
+		tr.logln("End famine: ", msg.Time)
+	}
+	switch msg.Type {
+	case "alive":
+		return false
+	case "playernames", "glance", "reserveMaiden", "unreserveMaiden":
+		return false
+	case "gamestart":
+		// Reset the state, but keep player types since spawn messages come before gamestart.
+		m := msg.Val.(parser.GameStartMessage).Map
+		meta := maps.MetadataForMap(m)
+		var playerTypes [NumPlayers]PlayerType
+		for i := 0; i < NumPlayers; i++ {
+			playerTypes[i] = game.Players[i].Type
+		}
+		*game = kq.GameState{}
+		for i := 0; i < NumPlayers; i++ {
+			switch {
+			case meta.FirstLifeSpeedQueen && playerTypes[i] == Queen:
+				game.Players[i].Type = Queen
+				game.Players[i].HasSpeed = true
+			case meta.FirstLifeSpeedWarrior && playerTypes[i] == Drone:
+				game.Players[i].Type = Warrior
+				game.Players[i].HasSpeed = true
+				switch PlayerId(i + 1).Team() {
+				case BlueSide:
+					game.BlueTeam.Warriors++
+					game.BlueTeam.SpeedWarriors++
+				case GoldSide:
+					game.GoldTeam.Warriors++
+					game.GoldTeam.SpeedWarriors++
+				}
+			default:
+				game.Players[i].Type = playerTypes[i]
+			}
+		}
+		game.Start = msg.Time
+		tr.initForMap(m, msg.Time)
+	case "gameend":
+		game.End = msg.Time
+	case "spawn":
+		data := msg.Val.(parser.PlayerSpawnMessage)
+		p := &game.Players[data.Player.Index()]
+		p.Respawn() // Drop berry, get off snail, etc.
+		p.Type = data.Type
+		if game.InGame() && data.Type == Drone && maps.MetadataForMap(game.Map).FirstLifeSpeedWarrior {
+			p.Type = Warrior
+			p.HasSpeed = true
+			switch data.Player.Team() {
+			case BlueSide:
+				game.BlueTeam.Warriors++
+				game.BlueTeam.SpeedWarriors++
+			case GoldSide:
+				game.GoldTeam.Warriors++
+				game.GoldTeam.SpeedWarriors++
+			}
+		}
+	case "carryFood":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.PickUpBerryMessage)
+		game.Players[data.Player.Index()].HasBerry = true
+	case "useMaiden":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.UseGateMessage)
+		tr.learnGate(data.Pos, data.Type)
+		game.Players[data.Player.Index()].HasBerry = false
+		game.BerriesUsed++
+		tr.checkForFamine(msg.Time)
+		p := &game.Players[data.Player.Index()]
+		switch data.Type {
+		case SpeedGate:
+			p.HasSpeed = true
+		case WarriorGate:
+			p.Type = Warrior
+			switch data.Player.Team() {
+			case BlueSide:
+				game.BlueTeam.Warriors++
+				if p.HasSpeed {
+					game.BlueTeam.SpeedWarriors++
+				}
+			case GoldSide:
+				game.GoldTeam.Warriors++
+				if p.HasSpeed {
+					game.GoldTeam.SpeedWarriors++
+				}
+			}
+		}
+	case "blessMaiden":
+		// TODO: Might be able to tag speed gates before gamestart on day.
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.ClaimGateMessage)
+		gate, ok := tr.gateMap[data.Pos]
+		if !ok {
+			tr.unknownGateClaims[data.Pos] = data.Side
+			break
+		}
+		switch gate.typ {
+		case SpeedGate:
+			game.SpeedGates[gate.index].ClaimedBy = data.Side
+		case WarriorGate:
+			game.WarriorGates[gate.index].ClaimedBy = data.Side
+		}
+	case "playerKill":
+		// TODO: Maybe can have kills before gamestart on trap map due to missing barriers
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.PlayerKillMessage)
+		v := &game.Players[data.Victim.Index()]
+		switch v.Type {
+		case Warrior:
+			switch data.Victim.Team() {
+			case BlueSide:
+				game.BlueTeam.Warriors--
+				if v.HasSpeed {
+					game.BlueTeam.SpeedWarriors--
+				}
+			case GoldSide:
+				game.GoldTeam.Warriors--
+				if v.HasSpeed {
+					game.GoldTeam.SpeedWarriors--
+				}
+			}
+		case Queen:
+			switch data.Victim.Team() {
+			case BlueSide:
+				game.BlueTeam.QueenDeaths++
+			case GoldSide:
+				game.GoldTeam.QueenDeaths++
+			}
+		case Drone, Robot:
+			break
+		}
+		v.Respawn()
+		if s := game.Players[data.Killer.Index()].OnSnail; s != 0 {
+			tr.snails[s-1].time = msg.Time // Position set at start of eating.
+		}
+	case "getOnSnail: ":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.GetOnSnailMessage)
+		i := tr.snailAt(data.Pos)
+		if i < 0 {
+			return false
+		}
+		game.Players[data.Rider.Index()].OnSnail = i + 1
+		pos := data.Pos.X - game.Snails[i].MaxPos
+		s := &tr.snails[i]
+		// running drone speed 250 px/s. may be 1925ish pixels to wrap
+		// robot 200 px/s
+		// eat takes 3.5s, arantius vid says 3.67
+		if game.Players[data.Rider.Index()].HasSpeed {
+			s.speed = 28.209890875 // 27
+		} else {
+			s.speed = 20.896215463 // 20
+		}
+		if data.Rider.Team() == tr.Sides.LeftTeam() {
+			s.speed = -s.speed
+		}
+		game.Snails[i].Pos = pos
+		s.time = msg.Time
+	case "getOffSnail: ":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.GetOffSnailMessage)
+		i := tr.riddenSnail(data.Rider, data.Pos)
+		if i < 0 {
+			return false
+		}
+		game.Players[data.Rider.Index()].OnSnail = 0
+		game.Snails[i].Pos = data.Pos.X - game.Snails[i].MaxPos
+		tr.snails[i].time = msg.Time
+		tr.snails[i].speed = 0
+	case "snailEat":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.SnailStartEatMessage)
+		i := tr.riddenSnail(data.Rider, data.Pos)
+		if i < 0 {
+			return false
+		}
+		game.Snails[i].Pos = data.Pos.X - game.Snails[i].MaxPos
+		tr.snails[i].time = msg.Time.Add(3500 * time.Millisecond)
+	case "snailEscape":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.SnailEscapeEatMessage)
+		i := tr.snailAt(data.Pos)
+		if i < 0 {
+			return false
+		}
+		// The escape event occurs at the snail's mouth, 50 pixels from it's position.
+		var offset int
+		if data.Escapee.Team() == tr.Sides.LeftTeam() {
+			offset = -50
+		} else {
+			offset = 50
+		}
+		// In theory, the snail shouldn't move while someone is sacrificing.
+		// In practice it can, either because it got pushed with a berry or
+		// because the sacrifice carried momentum into the snail.
+		pos := data.Pos.X - game.Snails[i].MaxPos + offset
+		game.Snails[i].Pos = pos
+		tr.snails[i].time = msg.Time
+	case "berryDeposit":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.DepositBerryMessage)
+		// Each team's hive is on its own side, so deposits show which side
+		// the teams are on.
+		if tr.Sides.observe((data.Pos.X < mapCenter) == (data.Player.Team() == GoldSide)) {
+			tr.logln("Detected", tr.Sides.LeftTeam(), "team on the left side")
+		}
+		game.Players[data.Player.Index()].HasBerry = false
+		switch data.Player.Team() {
+		case BlueSide:
+			game.BlueTeam.BerriesIn++
+		case GoldSide:
+			game.GoldTeam.BerriesIn++
+		}
+		game.BerriesUsed++
+		tr.checkForFamine(msg.Time)
+	case "berryKickIn":
+		if !game.InGame() {
+			return false
+		}
+		data := msg.Val.(parser.KickInBerryMessage)
+		if (data.Pos.X < mapCenter) != tr.Sides.GoldOnLeft() {
+			game.BlueTeam.BerriesIn++
+		} else {
+			game.GoldTeam.BerriesIn++
+		}
+		game.BerriesUsed++
+		tr.checkForFamine(msg.Time)
+	case "victory":
+		data := msg.Val.(parser.GameResultMessage)
+		game.Winner = data.Winner
+		game.EndCondition = data.EndCondition
+		tr.logln(game.Winner, "wins on", game.Map, "by", game.EndCondition)
+	default:
+		tr.logln("Unhandled", msg)
+		return false
+	}
+	return true
+}
+
+// Returns the index of the snail a player is riding, or the one nearest the
+// position if the player is not known to be riding one.
+func (tr *GameTracker) riddenSnail(rider PlayerId, pos Position) int {
+	if s := tr.game.Players[rider.Index()].OnSnail; s > 0 && s <= len(tr.snails) {
+		return s - 1
+	}
+	return tr.snailAt(pos)
+}
+
+// snailEscape position is 50px in front of actual snail (in rider's direction)
+// playerKill of rider is at snail position; note a getOffSnail comes just before the kill
+// playerKill of sacrifice may be where they were just before the eat triggered
+// - if coming from behind on ground, 15-16px behind snail position
+// - if coming from front on ground, 66-69px in front of snail position
+// - drone on ground is 9px above snail position
+// - it seems you can sac from further away if in the air, at least in front
+// i have seen a player killed while being eaten (playerKill 1ms after snailEat). they later escaped the eat and got on the snail 1.5 seconds after
+// day/dusk snail is at y position 11 (drone at 20). night at 491 (drone 500)
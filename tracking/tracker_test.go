@@ -0,0 +1,286 @@
+package tracking
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/io"
+	"github.com/ughoavgfhw/libkq/parser"
+)
+
+var testStart = time.Date(2018, 10, 21, 9, 0, 0, 0, time.UTC)
+
+// Returns the time the given number of milliseconds into a test game.
+func at(ms int) time.Time {
+	return testStart.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// Applies messages to a tracker. Each line is formatted like a recorded log,
+// except that the time is in milliseconds from testStart.
+func feed(t *testing.T, tr *GameTracker, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		parts := strings.SplitN(line, ",", 2)
+		ms, err := strconv.Atoi(parts[0])
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		key, val, err := parser.Parser{}.Parse([]byte(parts[1]))
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		tr.Apply(kqio.Message{Time: at(ms), Type: kqio.MessageType(key), Val: val})
+	}
+}
+
+func TestSnail(t *testing.T) {
+	tr := NewGameTracker()
+	feed(t, tr,
+		"0,![k[gamestart],v[map_day,False,0,False]]!",
+		// Blue, on the left, rides the snail toward the left net.
+		"1000,![k[getOnSnail: ],v[960,11,8]]!",
+	)
+	state := tr.State()
+	if len(state.Snails) != 1 || state.Snails[0].MaxPos != 960 || state.Snails[0].Pos != 0 {
+		t.Fatalf("snails after getting on: %+v", state.Snails)
+	}
+	if state.Players[7].OnSnail != 1 {
+		t.Errorf("rider is on snail %d, want 1", state.Players[7].OnSnail)
+	}
+	if est := tr.SnailEstimate(at(3000)); est != -41 {
+		t.Errorf("estimate 2s after getting on is %d, want -41", est)
+	}
+
+	feed(t, tr, "3000,![k[getOffSnail: ],v[886,11,,8]]!")
+	state = tr.State()
+	if state.Snails[0].Pos != -74 || state.Players[7].OnSnail != 0 {
+		t.Errorf("after getting off, snail at %d with rider on %d", state.Snails[0].Pos, state.Players[7].OnSnail)
+	}
+	if est := tr.SnailEstimates(at(5000)); len(est) != 1 || est[0] != -74 {
+		t.Errorf("estimates of a stopped snail are %v, want [-74]", est)
+	}
+	if p, want := tr.SnailProgress(at(5000)), (1-74.0/900)/2; p != want {
+		t.Errorf("progress is %v, want %v", p, want)
+	}
+	stats := tr.PlayerStats()
+	if s := stats[7]; s.SnailTime != 2*time.Second || s.SnailDist != 74 {
+		t.Errorf("rider's snail time %v and distance %d, want 2s and 74", s.SnailTime, s.SnailDist)
+	}
+
+	// Gold gets on, starts eating a blue drone, which escapes and is rescued
+	// by another blue drone knocking the rider off.
+	feed(t, tr,
+		"4000,![k[getOnSnail: ],v[886,11,3]]!",
+		"5000,![k[snailEat],v[900,11,3,10]]!",
+	)
+	if est := tr.SnailEstimate(at(8000)); est != -60 {
+		t.Errorf("estimate while eating is %d, want -60", est)
+	}
+	feed(t, tr,
+		"6000,![k[snailEscape],v[850,11,10]]!",
+		"6010,![k[getOffSnail: ],v[900,11,,3]]!",
+		"6020,![k[playerKill],v[900,20,4,3,Worker]]!",
+	)
+	state = tr.State()
+	if state.Snails[0].Pos != -60 || state.Players[2].OnSnail != 0 {
+		t.Errorf("after the rescue, snail at %d with rider on %d", state.Snails[0].Pos, state.Players[2].OnSnail)
+	}
+	stats = tr.PlayerStats()
+	if s := stats[3]; s.SnailKills != 1 || s.EatRescues != 1 || s.DroneKills != 1 {
+		t.Errorf("rescuer's stats: %+v", s)
+	}
+	if s := stats[2]; s.SnailDeaths != 1 || s.DroneDeaths != 1 || s.SnailDist != 14 {
+		t.Errorf("rider's stats: %+v", s)
+	}
+	if s := stats[9]; s.EatRescued != 1 {
+		t.Errorf("escapee was rescued %d times, want 1", s.EatRescued)
+	}
+}
+
+func TestSnailEscapeOffset(t *testing.T) {
+	tr := NewGameTracker()
+	// The escape is reported at the snail's mouth, ahead of it in the
+	// direction its rider moves it, away from the escapee's side.
+	feed(t, tr,
+		"0,![k[gamestart],v[map_day,False,0,False]]!",
+		"1000,![k[getOnSnail: ],v[960,11,3]]!",
+		"2000,![k[snailEat],v[1000,11,3,10]]!",
+		"3000,![k[snailEscape],v[1050,11,10]]!",
+	)
+	if pos := tr.State().Snails[0].Pos; pos != 40 {
+		t.Errorf("snail at %d after blue escapes, want 40", pos)
+	}
+	tr.Sides.Set(true, false)
+	feed(t, tr,
+		"4000,![k[snailEat],v[1000,11,3,10]]!",
+		"5000,![k[snailEscape],v[1050,11,10]]!",
+	)
+	if pos := tr.State().Snails[0].Pos; pos != 140 {
+		t.Errorf("snail at %d after blue escapes on the right, want 140", pos)
+	}
+}
+
+func TestGates(t *testing.T) {
+	tr := NewGameTracker()
+	feed(t, tr,
+		"0,![k[gamestart],v[map_day,False,0,False]]!",
+		"1000,![k[blessMaiden],v[560,260,Blue]]!",
+		"1100,![k[blessMaiden],v[1510,860,Gold]]!",
+		"1200,![k[blessMaiden],v[960,500,Gold]]!",
+		"1300,![k[blessMaiden],v[960,500,Blue]]!",
+	)
+	state := tr.State()
+	want := []Side{BlueSide, BlueSide, Neutral}
+	for i, g := range state.WarriorGates {
+		if g.ClaimedBy != want[i] {
+			t.Errorf("warrior gate %d claimed by %v, want %v", i, g.ClaimedBy, want[i])
+		}
+	}
+	if c := state.SpeedGates[0].ClaimedBy; c != Neutral {
+		t.Errorf("unused speed gate claimed by %v", c)
+	}
+	if c := state.SpeedGates[1].ClaimedBy; c != GoldSide {
+		t.Errorf("speed gate 1 claimed by %v, want %v", c, GoldSide)
+	}
+
+	// A drone with speed becomes a speed warrior.
+	feed(t, tr,
+		"2000,![k[carryFood],v[7]]!",
+		"3000,![k[useMaiden],v[1510,860,maiden_speed,7]]!",
+		"4000,![k[carryFood],v[7]]!",
+		"5000,![k[useMaiden],v[960,500,maiden_wings,7]]!",
+	)
+	state = tr.State()
+	if p := state.Players[6]; p.Type != Warrior || !p.HasSpeed || p.HasBerry {
+		t.Errorf("player after both gates: %+v", p)
+	}
+	if g := state.GoldTeam; g.Warriors != 1 || g.SpeedWarriors != 1 {
+		t.Errorf("gold has %d warriors, %d with speed; want 1 and 1", g.Warriors, g.SpeedWarriors)
+	}
+	if state.BerriesUsed != 2 {
+		t.Errorf("%d berries used, want 2", state.BerriesUsed)
+	}
+
+	feed(t, tr, "15000,![k[playerKill],v[800,600,8,7,Soldier]]!")
+	state = tr.State()
+	if g := state.GoldTeam; g.Warriors != 0 || g.SpeedWarriors != 0 {
+		t.Errorf("gold has %d warriors, %d with speed after the kill; want none", g.Warriors, g.SpeedWarriors)
+	}
+	stats := tr.PlayerStats()
+	if s := stats[6]; s.WarriorTime != 10*time.Second || s.MaxWarriorTime != 10*time.Second || s.WarriorDeaths != 1 {
+		t.Errorf("warrior's stats: %+v", s)
+	}
+	if s := stats[7]; s.WarriorKills != 1 || s.Kills != 1 {
+		t.Errorf("killer's stats: %+v", s)
+	}
+}
+
+// Bonus maps have no gate positions in their metadata, so gates are learned as
+// they are used, keeping any claims made before then.
+func TestBonusMapGates(t *testing.T) {
+	tr := NewGameTracker()
+	tr.Apply(kqio.Message{
+		Time: at(0),
+		Type: "gamestart",
+		Val:  parser.GameStartMessage{Map: WarriorBonusMap},
+	})
+	feed(t, tr,
+		"1000,![k[blessMaiden],v[700,300,Gold]]!",
+		"2000,![k[useMaiden],v[900,100,maiden_speed,5]]!",
+		"3000,![k[useMaiden],v[1200,300,maiden_wings,5]]!",
+		"4000,![k[useMaiden],v[700,300,maiden_wings,7]]!",
+		"5000,![k[blessMaiden],v[1200,300,Blue]]!",
+	)
+	state := tr.State()
+	want := []Side{BlueSide, GoldSide, Neutral}
+	for i, g := range state.WarriorGates {
+		if g.ClaimedBy != want[i] {
+			t.Errorf("warrior gate %d claimed by %v, want %v", i, g.ClaimedBy, want[i])
+		}
+	}
+	if c := state.SpeedGates[0].ClaimedBy; c != Neutral {
+		t.Errorf("speed gate claimed by %v", c)
+	}
+}
+
+func TestKillStats(t *testing.T) {
+	tr := NewGameTracker()
+	feed(t, tr,
+		"0,![k[gamestart],v[map_day,False,0,False]]!",
+		// A bump shortly before a kill is an assist.
+		"1000,![k[glance],v[4,5]]!",
+		"1500,![k[playerKill],v[500,500,6,5,Worker]]!",
+		// One long before is not.
+		"3000,![k[glance],v[4,9]]!",
+		"5000,![k[playerKill],v[500,500,6,9,Worker]]!",
+		// Bumping a player out of a warrior gate is counted, and killing them
+		// as they leave is a kill in the gate.
+		"6000,![k[reserveMaiden],v[960,500,3]]!",
+		"6100,![k[glance],v[10,3]]!",
+		"6200,![k[unreserveMaiden],v[960,500,,3]]!",
+		"6220,![k[playerKill],v[960,500,8,3,Worker]]!",
+		"7000,![k[spawn],v[2,False]]!",
+		"8000,![k[playerKill],v[500,500,5,2,Queen]]!",
+	)
+	stats := tr.PlayerStats()
+	if s := stats[3]; s.Assists != 1 || s.DroneAssists != 0 {
+		t.Errorf("bumper's assists: %d, %d by drone; want 1, 0", s.Assists, s.DroneAssists)
+	}
+	if s := stats[5]; s.Kills != 2 || s.DroneKills != 2 {
+		t.Errorf("killer's stats: %+v", s)
+	}
+	if s := stats[9]; s.WarriorGateBumpOuts != 1 || s.Assists != 1 {
+		t.Errorf("gate bumper's stats: %+v", s)
+	}
+	if s := stats[7]; s.InGateKills != 1 || s.Kills != 1 {
+		t.Errorf("gate killer's stats: %+v", s)
+	}
+	if s := stats[4]; s.QueenKills != 1 || s.Kills != 1 {
+		t.Errorf("queen killer's stats: %+v", s)
+	}
+	if s := stats[1]; s.Deaths != 1 || s.DroneDeaths != 0 {
+		t.Errorf("queen's stats: %+v", s)
+	}
+	if d := tr.State().BlueTeam.QueenDeaths; d != 1 {
+		t.Errorf("blue queen deaths: %d, want 1", d)
+	}
+}
+
+func TestBerriesAndSides(t *testing.T) {
+	tr := NewGameTracker()
+	feed(t, tr,
+		"0,![k[gamestart],v[map_day,False,0,False]]!",
+		"1000,![k[carryFood],v[8]]!",
+		"2000,![k[berryDeposit],v[1700,940,8]]!",
+	)
+	if !tr.GoldOnLeft() {
+		t.Fatal("a blue deposit on the right did not put gold on the left")
+	}
+	feed(t, tr,
+		"3000,![k[berryKickIn],v[300,140,8]]!",
+		"4000,![k[berryKickIn],v[1600,140,8]]!",
+	)
+	state := tr.State()
+	if state.BlueTeam.BerriesIn != 2 || state.GoldTeam.BerriesIn != 1 || state.BerriesUsed != 3 {
+		t.Errorf("berries in: blue %d, gold %d, of %d used", state.BlueTeam.BerriesIn, state.GoldTeam.BerriesIn, state.BerriesUsed)
+	}
+	if s := tr.PlayerStats()[7]; s.BerriesRun != 1 || s.BerriesKicked != 1 || s.BerriesKickedOpp != 1 {
+		t.Errorf("player's berry stats: %+v", s)
+	}
+
+	// Fixed sides are not changed by deposits.
+	tr.Sides.Set(false, false)
+	feed(t, tr, "5000,![k[berryDeposit],v[1700,940,8]]!")
+	if tr.GoldOnLeft() {
+		t.Error("a deposit changed fixed sides")
+	}
+
+	// Stats start over with each game.
+	feed(t, tr, "100000,![k[gamestart],v[map_night,False,0,False]]!")
+	if s := tr.PlayerStats()[7]; s != (PlayerStat{}) {
+		t.Errorf("stats after a new game: %+v", s)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	kq "github.com/ughoavgfhw/libkq"
+	. "github.com/ughoavgfhw/libkq/common"
+	"github.com/ughoavgfhw/libkq/parser"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// Fits a TrainedModel to the games in recorded logs.
+func runTrain(args []string) {
+	flags := flag.NewFlagSet("train", flag.ExitOnError)
+	interval := flags.Duration("interval", time.Second, "how often to sample the game state, in game time")
+	out := flags.String("out", "trained_model.json", "the path to write the model to")
+	l2 := flags.Float64("l2", 1, "the L2 regularization strength")
+	iterations := flags.Int("iterations", 50, "the maximum number of fitting iterations")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: kq-live train [flags] <cabinet log>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *interval <= 0 || *l2 < 0 || *iterations <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var data trainingData
+	for _, path := range flags.Args() {
+		if err := visitRecordedGames(path, *interval, data.visitor()); err != nil {
+			fmt.Fprintln(logOut, err)
+			os.Exit(1)
+		}
+	}
+	if data.games == 0 {
+		fmt.Fprintln(logOut, "No completed games found")
+		os.Exit(1)
+	}
+	fmt.Fprintf(logOut, "Training on %d samples from %d games\n", len(data.samples), data.games)
+
+	model, err := data.fit(*l2, *iterations)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		os.Exit(1)
+	}
+	err = writeFile(*out, func(w io.Writer) error {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		return e.Encode(model)
+	})
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		os.Exit(1)
+	}
+
+	var logLoss float64
+	correct := 0
+	for _, s := range data.samples {
+		p := math.Min(math.Max(model.predict(s.features), 1e-15), 1-1e-15)
+		logLoss -= s.outcome*math.Log(p) + (1-s.outcome)*math.Log(1-p)
+		if (p >= 0.5) == (s.outcome == 1) {
+			correct++
+		}
+	}
+	n := float64(len(data.samples))
+	fmt.Fprintf(logOut, "Wrote %s; on the training samples, log loss %.4f, accuracy %.1f%%\n", *out, logLoss/n, 100*float64(correct)/n)
+}
+
+type trainingSample struct {
+	features map[string]float64
+	outcome  float64 // 1 if gold won, else 0.
+}
+
+type trainingData struct {
+	samples []trainingSample
+	games   int
+
+	// Samples from the game in progress, which are labeled once it ends.
+	pending []map[string]float64
+}
+
+func (d *trainingData) visitor() gameVisitor {
+	return gameVisitor{
+		Start: func(*kq.GameState) { d.pending = d.pending[:0] },
+		Sample: func(cab *tracking.GameTracker, when time.Time) {
+			d.pending = append(d.pending, stateFeatures(cab, when))
+		},
+		End: func(state *kq.GameState, result parser.GameResultMessage, when time.Time) {
+			if len(d.pending) == 0 {
+				return
+			}
+			d.games++
+			var outcome float64
+			if result.Winner == GoldSide {
+				outcome = 1
+			}
+			for _, f := range d.pending {
+				d.samples = append(d.samples, trainingSample{f, outcome})
+			}
+			d.pending = d.pending[:0]
+		},
+	}
+}
+
+// Returns the features present in the data which vary, in a stable order.
+// Constant features, such as a map which was never played, cannot be fitted.
+func (d *trainingData) featureNames() []string {
+	var mapNames []string
+	for _, name := range mapFeatureNames {
+		mapNames = append(mapNames, name)
+	}
+	sort.Strings(mapNames)
+	var names []string
+	for _, name := range append(append([]string(nil), stateFeatureNames...), mapNames...) {
+		first := d.samples[0].features[name]
+		for _, s := range d.samples[1:] {
+			if s.features[name] != first {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Fits a logistic regression with Newton's method. The features are
+// standardized first, so the L2 penalty treats them equally; the intercept is
+// not penalized.
+func (d *trainingData) fit(l2 float64, iterations int) (*TrainedModel, error) {
+	names := d.featureNames()
+	model := &TrainedModel{
+		Features: make([]TrainedFeature, len(names)),
+		Games:    d.games,
+		Samples:  len(d.samples),
+		Trained:  time.Now().UTC().Truncate(time.Second),
+	}
+	n := float64(len(d.samples))
+	for i, name := range names {
+		var sum, sumSq float64
+		for _, s := range d.samples {
+			sum += s.features[name]
+			sumSq += s.features[name] * s.features[name]
+		}
+		mean := sum / n
+		model.Features[i] = TrainedFeature{
+			Name:  name,
+			Mean:  mean,
+			Scale: math.Sqrt(sumSq/n - mean*mean),
+		}
+	}
+
+	// Row i of x is the standardized features of sample i, with a leading 1
+	// for the intercept.
+	k := len(names) + 1
+	x := make([][]float64, len(d.samples))
+	for i, s := range d.samples {
+		row := make([]float64, k)
+		row[0] = 1
+		for j, f := range model.Features {
+			row[j+1] = (s.features[f.Name] - f.Mean) / f.Scale
+		}
+		x[i] = row
+	}
+
+	theta := make([]float64, k)
+	for iter := 0; iter < iterations; iter++ {
+		grad := make([]float64, k)
+		hess := make([][]float64, k)
+		for j := range hess {
+			hess[j] = make([]float64, k)
+		}
+		for i, row := range x {
+			var z float64
+			for j, v := range row {
+				z += theta[j] * v
+			}
+			p := 1 / (1 + math.Exp(-z))
+			w := p * (1 - p)
+			for j, vj := range row {
+				grad[j] += (p - d.samples[i].outcome) * vj
+				for l := j; l < k; l++ {
+					hess[j][l] += w * vj * row[l]
+				}
+			}
+		}
+		for j := 0; j < k; j++ {
+			for l := 0; l < j; l++ {
+				hess[j][l] = hess[l][j]
+			}
+			if j > 0 {
+				grad[j] += l2 * theta[j]
+				hess[j][j] += l2
+			}
+		}
+		step, err := solveLinear(hess, grad)
+		if err != nil {
+			return nil, err
+		}
+		var maxStep float64
+		for j := range theta {
+			theta[j] -= step[j]
+			maxStep = math.Max(maxStep, math.Abs(step[j]))
+		}
+		if maxStep < 1e-8 {
+			break
+		}
+	}
+
+	model.Intercept = theta[0]
+	for j := range model.Features {
+		model.Features[j].Coefficient = theta[j+1]
+	}
+	return model, nil
+}
+
+// Solves a*x = b using Gaussian elimination with partial pivoting. Both a and
+// b are overwritten.
+func solveLinear(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, errors.New("training data is degenerate; try a larger -l2")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for r := col + 1; r < n; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c < n; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		sum := b[r]
+		for c := r + 1; c < n; c++ {
+			sum -= a[r][c] * x[c]
+		}
+		x[r] = sum / a[r][r]
+	}
+	return x, nil
+}
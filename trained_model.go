@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/ughoavgfhw/libkq/common"
+
+	"github.com/ughoavgfhw/kq-live/tracking"
+)
+
+// The name of the model fitted by the train command.
+const TrainedModelName = "trained"
+
+// The features the trained model can use, in the order they are extracted.
+// There is also one feature per map, named "map:<name>", which is 1 when
+// playing that map and 0 otherwise.
+var stateFeatureNames = []string{
+	"blueBerries", "goldBerries",
+	"blueQueenDeaths", "goldQueenDeaths",
+	"blueWarriors", "goldWarriors",
+	"blueSpeedWarriors", "goldSpeedWarriors",
+	"goldSnail",
+	"famine",
+}
+
+// The bonus maps have no features until there are recorded games on them to
+// fit, so their games are pooled with no map feature set.
+var mapFeatureNames = map[Map]string{
+	DayMap:   "map:day",
+	NightMap: "map:night",
+	DuskMap:  "map:dusk",
+}
+
+// Extracts the features of the current game state, keyed by name.
+func stateFeatures(cab *tracking.GameTracker, when time.Time) map[string]float64 {
+	game := cab.State()
+
+	// How far the snails are toward the gold goal, from 0 at the blue nets to
+	// 1 at the gold nets.
+	goldSnail := cab.SnailProgress(when)
+	goldSnail = math.Min(math.Max(goldSnail, 0), 1)
+	if cab.GoldOnLeft() {
+		goldSnail = 1 - goldSnail
+	}
+
+	// How far through the famine the game is, from 0 before it starts to 1
+	// when berries are restored.
+	var famine float64
+	if game.InFamine() {
+		famine = math.Min(float64(when.Sub(game.FamineStart))/float64(tracking.FamineDuration), 1)
+	}
+
+	f := map[string]float64{
+		"blueBerries":       float64(game.BlueTeam.BerriesIn),
+		"goldBerries":       float64(game.GoldTeam.BerriesIn),
+		"blueQueenDeaths":   float64(game.BlueTeam.QueenDeaths),
+		"goldQueenDeaths":   float64(game.GoldTeam.QueenDeaths),
+		"blueWarriors":      float64(game.BlueTeam.Warriors),
+		"goldWarriors":      float64(game.GoldTeam.Warriors),
+		"blueSpeedWarriors": float64(game.BlueTeam.SpeedWarriors),
+		"goldSpeedWarriors": float64(game.GoldTeam.SpeedWarriors),
+		"goldSnail":         goldSnail,
+		"famine":            famine,
+	}
+	if name, ok := mapFeatureNames[game.Map]; ok {
+		f[name] = 1
+	}
+	return f
+}
+
+// A single feature of a trained model. Features are standardized using the
+// mean and scale seen in training before applying the coefficient.
+type TrainedFeature struct {
+	Name        string
+	Mean, Scale float64
+	Coefficient float64
+}
+
+// A logistic regression predicting whether gold wins, as saved by the train
+// command.
+type TrainedModel struct {
+	Intercept float64
+	Features  []TrainedFeature
+
+	// Informational, describing the training data.
+	Games, Samples int
+	Trained        time.Time
+}
+
+func (m *TrainedModel) validate() error {
+	known := make(map[string]bool)
+	for _, name := range stateFeatureNames {
+		known[name] = true
+	}
+	for _, name := range mapFeatureNames {
+		known[name] = true
+	}
+	for _, f := range m.Features {
+		if !known[f.Name] {
+			return fmt.Errorf("unknown feature %q", f.Name)
+		}
+		if f.Scale == 0 {
+			return fmt.Errorf("feature %q has zero scale", f.Name)
+		}
+	}
+	return nil
+}
+
+func (m *TrainedModel) predict(features map[string]float64) float64 {
+	z := m.Intercept
+	for _, f := range m.Features {
+		z += f.Coefficient * (features[f.Name] - f.Mean) / f.Scale
+	}
+	return 1 / (1 + math.Exp(-z))
+}
+
+func (m *TrainedModel) Score(cab *tracking.GameTracker, when time.Time) float64 {
+	p := m.predict(stateFeatures(cab, when))
+	if cab.GoldOnLeft() {
+		return 1 - p
+	}
+	return p
+}
+
+var trainedModel struct {
+	sync.RWMutex
+	model *TrainedModel
+}
+
+func currentTrainedModel() *TrainedModel {
+	trainedModel.RLock()
+	defer trainedModel.RUnlock()
+	return trainedModel.model
+}
+
+func setTrainedModel(m *TrainedModel) {
+	trainedModel.Lock()
+	defer trainedModel.Unlock()
+	trainedModel.model = m
+}
+
+// Replaces the trained model with the one in f. A nil file removes it. If the
+// file is invalid, the current model is kept.
+func loadTrainedModel(f *os.File) error {
+	if f == nil {
+		setTrainedModel(nil)
+		return nil
+	}
+	m := &TrainedModel{}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return err
+	}
+	if err := m.validate(); err != nil {
+		return err
+	}
+	setTrainedModel(m)
+	return nil
+}
+
+// Loads the trained model from the file at path. A missing file is not an
+// error; there is just no trained model.
+func loadTrainedModelFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return loadTrainedModel(nil)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := loadTrainedModel(f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Loads the trained model from the file at path, then watches it for changes.
+func LoadAndWatchTrainedModelFile(path string) (*FileWatcher, error) {
+	if err := loadTrainedModelFile(path); err != nil {
+		return nil, err
+	}
+	return WatchFile(path, func(f *os.File) {
+		if err := loadTrainedModel(f); err != nil {
+			fmt.Printf("Invalid %s, keeping the previous model: %v\n", path, err)
+		} else {
+			fmt.Println("Loaded trained model from", path)
+		}
+	}), nil
+}
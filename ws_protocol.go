@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The messages of the websocket protocol, in both directions. Every message is
+// a JSON object {"type": ..., "data": ...}, where the type decides the shape of
+// the data. assets/static/ws_protocol.schema.json describes the same messages
+// for clients, and must be kept in sync with these types.
+
+// The protocol versions the server speaks, oldest first. A client lists the
+// versions it speaks in client_start and gets the newest one both sides speak.
+// Clients which don't list any are assumed to speak version 1.
+var wsProtocolVersions = []int{1}
+
+// The sections a client may subscribe to.
+var wsSections = map[string]bool{
+	"prediction":     true,
+	"control":        true,
+	"currentMatch":   true,
+	"famineTracker":  true,
+	"tournamentData": true,
+	"bracket":        true,
+	"standings":      true,
+}
+
+// Returns the newest version in both wsProtocolVersions and versions, or false
+// if there is none.
+func negotiateVersion(versions []int) (int, bool) {
+	if len(versions) == 0 {
+		return 1, true
+	}
+	for i := len(wsProtocolVersions) - 1; i >= 0; i-- {
+		for _, v := range versions {
+			if v == wsProtocolVersions[i] {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Checks a client's sections, and returns them as a set.
+func parseSections(names []string) (map[string]bool, error) {
+	sections := make(map[string]bool)
+	for _, name := range names {
+		if !wsSections[name] {
+			return nil, fmt.Errorf("unknown section %q", name)
+		}
+		sections[name] = true
+	}
+	return sections, nil
+}
+
+// Requests, sent by the client.
+
+type wsMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Data for "client_start", which subscribes the client to sections of the
+// server's data.
+type clientStartRequest struct {
+	Sections []string `json:"sections"`
+	Cabinet  string   `json:"cabinet,omitempty"`
+	Versions []int    `json:"versions,omitempty"`
+}
+
+// Data for "data", which only the control section accepts.
+type dataRequest struct {
+	Section string            `json:"section"`
+	Parts   []dataRequestPart `json:"parts"`
+}
+
+type dataRequestPart struct {
+	Tag  string          `json:"tag"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Data for the "matchSettings" control part. A null victory rule resets it.
+type matchSettingsRequest struct {
+	VictoryRule *victoryRuleJSON `json:"victoryRule"`
+}
+
+// The other control parts take the same data as the match API: matchSides for
+// "currentTeams" and "onDeckTeams", matchScores for "currentScores",
+// teamSidesJSON for "teamSides", TournamentSetup for "tournament" and
+// LineupUpdate for "lineup". "reset" takes the names of the parts to reset.
+
+// Responses, sent by the server.
+
+// Sent in reply to client_start, before the snapshot of the client's sections.
+type clientStartPacket struct {
+	Type string              `json:"type"` // Always "client_start".
+	Data clientStartResponse `json:"data"`
+}
+
+type clientStartResponse struct {
+	Version  int      `json:"version"`
+	Cabinet  string   `json:"cabinet"`
+	Sections []string `json:"sections"`
+	// Set when the client lost events by falling behind, and the server is
+	// resending its snapshot.
+	Resync bool `json:"resync,omitempty"`
+}
+
+type dataPart struct {
+	Tag  string      `json:"tag"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type packetData struct {
+	Section string     `json:"section"`
+	Parts   []dataPart `json:"parts"`
+}
+
+type packet struct {
+	// Assume the encoder processes fields in declared order.
+	Type string     `json:"type"`
+	Data packetData `json:"data"`
+}
+
+// Describes a request the server could not handle. Request is the type of
+// the message at fault, if the error was caused by one.
+type errorData struct {
+	Message string `json:"message"`
+	Request string `json:"request,omitempty"`
+}
+
+type errorPacket struct {
+	Type string    `json:"type"` // Always "error".
+	Data errorData `json:"data"`
+}
+
+func newClientStartPacket(version int, cabinet string, sections map[string]bool, resync bool) clientStartPacket {
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return clientStartPacket{"client_start", clientStartResponse{version, cabinet, names, resync}}
+}
+
+// Decodes a single JSON value from r, rejecting unknown fields and anything
+// after the value.
+func decodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the message")
+	}
+	return nil
+}
+
+// Decodes a message's data, which must be present.
+func decodeData(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 || string(data) == "null" {
+		return errors.New("missing data")
+	}
+	return decodeStrict(bytes.NewReader(data), v)
+}
+
+// Converts a part sent to the control section into the commands it requests.
+func (part dataRequestPart) controlCommands() ([]ControlCommand, error) {
+	switch part.Tag {
+	case "advanceMatch":
+		return []ControlCommand{{AdvanceMatch, nil}}, nil
+	case "swapSides":
+		return []ControlCommand{{SwapSides, nil}}, nil
+	case "undoLastGame":
+		return []ControlCommand{{UndoLastGame, nil}}, nil
+	case "teamSides":
+		var d teamSidesJSON
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		return []ControlCommand{{SetTeamSides, d.LeftTeam}}, nil
+	case "tournament":
+		var d TournamentSetup
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		return []ControlCommand{{SetTournament, d}}, nil
+	case "lineup":
+		var d LineupUpdate
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		return []ControlCommand{{SetLineup, d}}, nil
+	case "onDeckTeams", "currentTeams":
+		var d matchSides
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		typ := SetCurrentTeams
+		if part.Tag == "onDeckTeams" {
+			typ = SetOnDeckTeams
+		}
+		return []ControlCommand{{typ, TeamUpdate{d.Blue, d.Gold}}}, nil
+	case "currentScores":
+		var d matchScores
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		return []ControlCommand{{SetScores, ScoreUpdate{d.Blue, d.Gold}}}, nil
+	case "matchSettings":
+		var d matchSettingsRequest
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		if d.VictoryRule == nil {
+			return []ControlCommand{{SetVictoryRule, BestOfN(0)}}, nil
+		}
+		rule, err := d.VictoryRule.rule()
+		if err != nil {
+			return nil, err
+		}
+		return []ControlCommand{{SetVictoryRule, rule}}, nil
+	case "reset":
+		var d []string
+		if err := decodeData(part.Data, &d); err != nil {
+			return nil, err
+		}
+		var commands []ControlCommand
+		for _, p := range d {
+			switch p {
+			case "matchSettings":
+				commands = append(commands, ControlCommand{SetVictoryRule, BestOfN(0)})
+			case "currentTeams":
+				commands = append(commands, ControlCommand{SetCurrentTeams, TeamUpdate{"", ""}})
+			case "currentScores":
+				commands = append(commands, ControlCommand{SetScores, ScoreUpdate{0, 0}})
+			default:
+				return nil, fmt.Errorf("cannot reset %q", p)
+			}
+		}
+		return commands, nil
+	}
+	return nil, errors.New("unknown tag")
+}